@@ -16,6 +16,8 @@ import (
 	"image/png"
 	"math"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,11 +31,17 @@ const (
 
 	BgEnvironment = 0
 	BgTransparent = 1
+
+	// Integrators
+	IntegratorProgressive = 0
+	IntegratorJensen      = 1
+	IntegratorPathTracer  = 2
+	IntegratorVCM         = 3
 )
 
 type App struct {
 	Scene         *Structs.Scene
-	CameraCloud   *CameraPointCloud
+	Integrator    Integrator
 	threadHandler *PhotonThreadHandler
 	env           *Environment
 	fyneApp       fyne.App
@@ -41,6 +49,7 @@ type App struct {
 	width         int
 	height        int
 	mtlReader     *FileFormats.MTLParser
+	integrator    int
 }
 
 func NewApp(resolutionX, resolutionY int, fov, photonRadius float64) *App {
@@ -62,20 +71,7 @@ func NewApp(resolutionX, resolutionY int, fov, photonRadius float64) *App {
 
 	//The raster update function. We want to keep it as simple as possible
 	nApp.raster = canvas.NewRasterWithPixels(func(x, y, w, h int) color.Color {
-		point := nApp.CameraCloud.Points[fixScreenCoordinates(x, y, w, h, nApp.width, nApp.height)]
-		// Since the photon path is stored in reverse order, we can just use the linked array as is
-		if point.AccumulatedPhotons == MissPoint {
-			return ldrToneMap(nApp.env.SampleEnvironment(point.I)).ToColor()
-		}
-		pixelColor := point.Color.FDiv(float64(point.AccumulatedPhotons))
-		for point.NextPoint != nil {
-			nPoint := point.NextPoint
-			// Here we are treating the light 'reflected' from the other point as a light source
-			// In fact, the Material's SampleLight function can be used for all kinds of light
-			pixelColor = nPoint.Color.FDiv(float64(nPoint.AccumulatedPhotons))
-			point = nPoint
-		}
-		return ldrToneMap(pixelColor).ToColor()
+		return ldrToneMap(nApp.Integrator.Pixel(fixScreenCoordinates(x, y, w, h, nApp.width, nApp.height))).ToColor()
 	})
 
 	Utils.LogSuccess("Created Fyne raster")
@@ -112,13 +108,27 @@ func ldrToneMap(color Math.Vector3) Math.Vector3 {
 
 func (app *App) Run() {
 	app.Scene.RebuildBVH()
-	app.CameraCloud = PhotonMappingFirstPass(app.Scene)
-	app.CameraCloud.ConstructTree()
+	if app.Scene.HasMedia() && app.integrator != IntegratorJensen && app.integrator != IntegratorPathTracer {
+		Utils.LogWarning("participating media are only rendered by the jensen and path integrators")
+	}
+	if app.Scene.HasSubsurface() && app.integrator != IntegratorJensen && app.integrator != IntegratorPathTracer {
+		Utils.LogWarning("subsurface scattering is only rendered by the jensen and path integrators")
+	}
+	switch app.integrator {
+	case IntegratorJensen:
+		app.Integrator = NewJensenIntegrator(app.Scene, app.env)
+	case IntegratorPathTracer:
+		app.Integrator = NewPathTracer(app.Scene, app.env)
+	case IntegratorVCM:
+		app.Integrator = NewVCMIntegrator(app.Scene, app.env)
+	default:
+		app.Integrator = NewProgressiveIntegrator(app.Scene, app.env)
+	}
+	app.Integrator.Prepare()
 	win := app.fyneApp.NewWindow("Photon renderer")
 	win.Resize(fyne.NewSize(float32(app.width), float32(app.height)))
 	win.SetFixedSize(true)
-	Utils.Log("Starting async photon mapping")
-	app.threadHandler.AllocThreads(app.Scene, app.CameraCloud, app.env)
+	app.Integrator.Render(app.threadHandler)
 	win.SetContent(app.raster)
 	Utils.Log("Starting async window updater")
 	go app.asyncAppUpdate()
@@ -140,7 +150,7 @@ func (app *App) asyncKeyboardListener() {
 			}
 			app.exportToImage("Export.png", BgEnvironment)
 		case "resume":
-			app.threadHandler.AllocThreads(app.Scene, app.CameraCloud, app.env)
+			app.Integrator.Render(app.threadHandler)
 			go app.asyncAppUpdate()
 		case "abort":
 			app.threadHandler.Finish()
@@ -151,9 +161,7 @@ func (app *App) asyncKeyboardListener() {
 
 func (app *App) asyncAppUpdate() {
 	for app.threadHandler.busy {
-		app.CameraCloud.Mu.Lock()
 		app.raster.Refresh()
-		app.CameraCloud.Mu.Unlock()
 		time.Sleep(time.Duration(app.Scene.GetSceneSettings().ViewerUpdateTime * intSeconds))
 	}
 	// Adding a Refresh() call on exit in case the render finish didn't fit into the raster update intervals
@@ -175,22 +183,7 @@ func (app *App) exportToImage(filename string, backgroundMode int) {
 
 	for y := 0; y < app.height; y++ {
 		for x := 0; x < app.width; x++ {
-			var pixelColor Math.Vector3
-			point := app.CameraCloud.Points[y*app.width+x]
-			// Since the photon path is stored in reverse order, we can just use the linked array as is
-			if point.AccumulatedPhotons == MissPoint {
-				pixelColor = app.env.SampleEnvironment(point.I)
-			} else {
-				pixelColor = point.Color.FDiv(float64(point.AccumulatedPhotons))
-				for point.NextPoint != nil {
-					nPoint := point.NextPoint
-					pixelColor = Math.InterpolateVector3(nPoint.Triangle.Material.SampleLight(nPoint.Bary, nPoint.I, nPoint.R.Inverse(),
-						nPoint.Triangle.InterpolateNormals(nPoint.Bary), 1, pixelColor), nPoint.Color.FDiv(
-						float64(nPoint.AccumulatedPhotons)), 0.5)
-					point = nPoint
-				}
-			}
-			img.Set(x, y, ldrToneMap(pixelColor).ToColor())
+			img.Set(x, y, ldrToneMap(app.Integrator.Pixel(y*app.width+x)).ToColor())
 		}
 	}
 
@@ -202,12 +195,56 @@ func (app *App) exportToImage(filename string, backgroundMode int) {
 }
 
 func (app *App) AddMeshesFromFile(filename string) {
-	meshes := FileFormats.ReadOBJFile(filename, app.mtlReader)
+	var meshes []Structs.Mesh
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".obj":
+		meshes = FileFormats.ReadOBJFile(filename, app.mtlReader)
+	case ".ply":
+		meshes = FileFormats.ReadPLYFile(filename, app.mtlReader.Brdf)
+	case ".stl":
+		meshes = FileFormats.ReadSTLFile(filename, app.mtlReader.Brdf)
+	default:
+		Utils.LogError("unsupported model format " + filepath.Ext(filename))
+		panic("unsupported model format")
+	}
 	for i := 0; i < len(meshes); i++ {
 		app.Scene.AddObject(&meshes[i])
 	}
 }
 
+// Loads the models, instances and environment of a scene file, along with its texture color space overrides
+
+func (app *App) LoadSceneFile(filename string) {
+	sceneFile := FileFormats.ReadSceneFile(filename)
+	app.mtlReader.ColorSpaces = make(map[string]Structs.ColorSpace)
+	for tex, name := range sceneFile.Textures {
+		space, ok := Structs.ParseColorSpace(name)
+		if !ok {
+			Utils.LogWarning("unknown color space " + name + " for texture " + tex + ", using sRGB")
+		}
+		app.mtlReader.ColorSpaces[tex] = space
+	}
+	for i := 0; i < len(sceneFile.Models); i++ {
+		app.AddMeshesFromFile(sceneFile.Models[i])
+	}
+	for i := 0; i < len(sceneFile.Instances); i++ {
+		instance := &sceneFile.Instances[i]
+		app.Scene.AddInstance(instance.Mesh, instance.Name, instance.GetTransform())
+	}
+	for i := 0; i < len(sceneFile.Hidden); i++ {
+		app.Scene.RemoveInstance(sceneFile.Hidden[i])
+	}
+	if sceneFile.Environment != "" {
+		app.SetEnvironmentImage(sceneFile.Environment)
+	} else if sceneFile.EnvironmentColor != nil {
+		c := sceneFile.EnvironmentColor
+		app.SetEnvironmentSimple(Math.Vector3{X: c[0], Y: c[1], Z: c[2]})
+	}
+	if sceneFile.Medium != nil {
+		app.Scene.SetMedium(sceneFile.Medium.GetMedium())
+	}
+}
+
 func (app *App) AddLightSource(lightSourceType int, position Math.Vector3, direction Math.Vector3, color Math.Vector3,
 	intensity float64, falloff float64) {
 	switch lightSourceType {
@@ -233,6 +270,34 @@ func (app *App) ChangeBRDF(brdf Structs.IBRDF) {
 	app.mtlReader.Brdf = brdf
 }
 
+func (app *App) SetStochasticAlpha(enabled bool) {
+	settings := app.Scene.GetSceneSettings()
+	settings.StochasticAlpha = enabled
+	app.Scene.SetSceneSettings(settings)
+}
+
+func (app *App) SetBVHBuilder(builder int) {
+	settings := app.Scene.GetSceneSettings()
+	settings.BVHBuilder = builder
+	app.Scene.SetSceneSettings(settings)
+}
+
+func (app *App) SetPointLookup(lookup int) {
+	settings := app.Scene.GetSceneSettings()
+	settings.PointLookup = lookup
+	app.Scene.SetSceneSettings(settings)
+}
+
+func (app *App) SetIntegrator(integrator int) {
+	app.integrator = integrator
+}
+
+func (app *App) SetBVHCacheDir(dir string) {
+	settings := app.Scene.GetSceneSettings()
+	settings.BVHCacheDir = dir
+	app.Scene.SetSceneSettings(settings)
+}
+
 func (app *App) SetEnvironmentImage(img string) {
 	app.env = NewHDREnvironment(img)
 }
@@ -1,11 +1,15 @@
 package PhotonMapping
 
-import "sync"
+import (
+	"Photon/Structs"
+	"Photon/Utils"
+	"sync"
+)
 
 type CameraPointCloud struct {
 	Points             []*CameraPoint
 	NonCameraPoints    []*CameraPoint
-	Tree               *KDTreeSpace
+	Lookup             CameraPointLookup
 	MaxPointsPerDomain int
 	Mu                 sync.Mutex
 }
@@ -18,6 +22,13 @@ func (cloud *CameraPointCloud) AddNonCameraPoint(point *CameraPoint) {
 	cloud.NonCameraPoints = append(cloud.NonCameraPoints, point)
 }
 
-func (cloud *CameraPointCloud) ConstructTree() {
-	cloud.Tree = ConstructKDTree(cloud.NonCameraPoints, cloud.MaxPointsPerDomain)
+// The hash grid cells are as wide as the photon gathering spheres, so a query touches at most 8 of them
+
+func (cloud *CameraPointCloud) ConstructLookup(settings Structs.SceneSettings) {
+	switch settings.PointLookup {
+	case Structs.PointLookupHashGrid:
+		cloud.Lookup = ConstructHashGrid(cloud.NonCameraPoints, settings.PhotonRadius*2)
+	default:
+		cloud.Lookup = ConstructKDTree(cloud.NonCameraPoints, cloud.MaxPointsPerDomain, Utils.NewWorkerPool(settings.AsyncThreads))
+	}
 }
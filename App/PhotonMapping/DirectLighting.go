@@ -0,0 +1,122 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Direct lighting
+// Light coming straight from the point, sun and cone lights is computed with shadow rays. For the progressive photon
+// mapper it is computed once for every camera point, while the environment is sampled progressively by the photon
+// threads, one BRDF sampled shadow ray at a time. Photons then only carry the indirect light and the caustics
+
+// Light from the point, sun and cone lights at a surface point in the given medium, with a shadow ray to each
+
+func directLighting(media *sceneMedia, medium *Structs.Medium, triangle *Structs.Triangle, bary Math.Vector2, position, n,
+	wo Math.Vector3, footprint float64) Math.Vector3 {
+	var radiance Math.Vector3
+	lights := media.scene.GetLightSources()
+	for i := 0; i < len(lights); i++ {
+		light := lights[i]
+		lightPosition := light.GetPosition()
+		wi := lightPosition.Sub(position).Normalized()
+		if wi.Dot(n) <= 0 && !triangle.Material.Transmits() {
+			continue
+		}
+		visibility := media.visibility(medium, position, lightPosition)
+		if visibility.Equal(Math.ZeroVector3()) {
+			continue
+		}
+		f := triangle.EvalBRDF(bary, footprint, wo, wi, n)
+		radiance = radiance.Add(f.Mul(light.GetLightColor()).Mul(visibility).FMul(light.GetLightIntensityTo(position)))
+	}
+	return radiance
+}
+
+// Irradiance from the point, sun and cone lights at a surface point in the given medium
+
+func directIrradiance(media *sceneMedia, medium *Structs.Medium, position, n Math.Vector3) Math.Vector3 {
+	var irradiance Math.Vector3
+	lights := media.scene.GetLightSources()
+	for i := 0; i < len(lights); i++ {
+		light := lights[i]
+		lightPosition := light.GetPosition()
+		cos := lightPosition.Sub(position).Normalized().Dot(n)
+		if cos <= 0 {
+			continue
+		}
+		visibility := media.visibility(medium, position, lightPosition)
+		irradiance = irradiance.Add(light.GetLightColor().Mul(visibility).FMul(cos * light.GetLightIntensityTo(position)))
+	}
+	return irradiance
+}
+
+func ComputeDirectLighting(scene *Structs.Scene, cloud *CameraPointCloud) {
+	Utils.Log("computing direct lighting at the camera points")
+	start := time.Now()
+	points := cloud.NonCameraPoints
+	media := newSceneMedia(scene)
+	threads := max(scene.GetSceneSettings().AsyncThreads, 1)
+	var wg sync.WaitGroup
+	for thread := 0; thread < threads; thread++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := thread * len(points) / threads; i < (thread+1)*len(points)/threads; i++ {
+				point := points[i]
+				n := point.Normal.FaceForward(point.I)
+				point.DirectLight = directLighting(media, media.medium, point.Triangle, point.Bary, point.Position, n, point.I.Inverse(),
+					point.Footprint)
+			}
+		}()
+	}
+	wg.Wait()
+	Utils.LogTiming("direct lighting for "+strconv.Itoa(len(points))+" points", start)
+}
+
+// One sample of the environment light reaching the point directly
+
+func sampleEnvironmentLight(scene *Structs.Scene, env *Environment, point *CameraPoint, gen *rand.Rand) Math.Vector3 {
+	n := point.Normal.FaceForward(point.I)
+	wi, weight, _ := point.Triangle.SampleBRDF(point.Bary, point.Footprint, point.I.Inverse(), n,
+		Math.Vector2{U: gen.Float64(), V: gen.Float64()})
+	if weight.Equal(Math.ZeroVector3()) {
+		return Math.Vector3{}
+	}
+	ray := Structs.Ray{Origin: point.Position, Direction: wi, Seed: gen.Uint64()}
+	if scene.IntersectsAny(ray, ray.MinT(), math.Inf(1)) {
+		return Math.Vector3{}
+	}
+	return weight.Mul(env.SampleEnvironment(wi))
+}
+
+// Light leaving the point towards the camera: the direct light plus the average of the photons
+
+func (point *CameraPoint) Radiance() Math.Vector3 {
+	return point.DirectRadiance().Add(point.PhotonRadiance())
+}
+
+// Light from the light sources and the environment, computed with shadow rays
+
+func (point *CameraPoint) DirectRadiance() Math.Vector3 {
+	radiance := point.DirectLight
+	if point.EnvironmentSamples > 0 {
+		radiance = radiance.Add(point.EnvironmentLight.FDiv(float64(point.EnvironmentSamples)))
+	}
+	return radiance
+}
+
+// Indirect light, estimated from the photons gathered at the point
+
+func (point *CameraPoint) PhotonRadiance() Math.Vector3 {
+	if point.AccumulatedPhotons <= 0 {
+		return Math.Vector3{}
+	}
+	return point.Color.FDiv(float64(point.AccumulatedPhotons))
+}
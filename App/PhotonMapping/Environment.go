@@ -4,36 +4,21 @@ import (
 	"Photon/Math"
 	"Photon/Structs"
 	"Photon/Utils"
-	"github.com/mdouchement/hdr"
-	_ "github.com/mdouchement/hdr/codec/rgbe"
-	"image"
 	"math"
-	"os"
+	"math/rand"
 )
 
 func readHDRImage(path string) *Structs.TextureRGB {
 	Utils.Log("reading HDR image \"" + path + "\"")
-	fl, err := os.Open(path)
-	if err != nil {
-		panic(err)
-	}
-	defer fl.Close()
-
-	im, _, err := image.Decode(fl)
-	if err != nil {
-		panic(err)
-	}
-	hdrIm := im.(hdr.Image)
-
-	tex := Structs.TextureRGBFromHDR(hdrIm)
-
-	return tex
+	// Float images (.hdr, .pfm) are read as is, LDR ones are assumed to be sRGB
+	return Structs.ReadTextureRGB(path)
 }
 
 type Environment struct {
 	plainColor bool
 	color      Math.Vector3
 	image      *Structs.TextureRGB
+	sampler    Structs.Sampler
 }
 
 func NewHDREnvironment(hdrImage string) *Environment {
@@ -41,7 +26,10 @@ func NewHDREnvironment(hdrImage string) *Environment {
 		plainColor: false,
 		color:      Math.Vector3{},
 		image:      readHDRImage(hdrImage),
+		sampler:    Structs.DefaultSampler(),
 	}
+	// Environment lookups have no footprint, so there is no point in trilinear filtering
+	env.sampler.Filter = Structs.FilterBilinear
 	return env
 }
 
@@ -60,5 +48,17 @@ func (env *Environment) SampleEnvironment(direction Math.Vector3) Math.Vector3 {
 
 	azimuth := math.Atan2(direction.Dot(Math.Vector3{Y: -1}), direction.Dot(Math.Vector3{X: 1}))/math.Pi + 1
 	elevation := (direction.Dot(Math.Vector3{Z: -1}) + 1) / 2
-	return env.image.At(Math.Vector2{azimuth / 2, elevation})
+	// The sampler uses bottom-up UVs, while the elevation goes from the top of the image
+	return env.sampler.SampleRGB(env.image, Math.Vector2{U: azimuth / 2, V: 1 - elevation}, 0)
+}
+
+// Random photon coming from the environment, starting on a disk outside the scene bounding sphere. The power is the
+// flux of the whole environment as estimated from this one photon
+
+func (env *Environment) EmitPhoton(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (Math.Vector3, Math.Vector3, Math.Vector3) {
+	toEnvironment := Utils.UniformSampleSphere(gen.Float64(), gen.Float64())
+	offset := Utils.UniformSampleDisk(gen.Float64(), gen.Float64()).FMul(sceneRadius).FromSingleVectorBasis(toEnvironment)
+	origin := sceneCenter.Add(toEnvironment.FMul(sceneRadius)).Add(offset)
+	power := env.SampleEnvironment(toEnvironment).FMul(4 * math.Pi * math.Pi * sceneRadius * sceneRadius)
+	return origin, toEnvironment.Inverse(), power
 }
@@ -4,6 +4,8 @@ import (
 	"Photon/Math"
 	"Photon/Structs"
 	"Photon/Utils"
+	"math"
+	"math/rand"
 	"strconv"
 	"time"
 )
@@ -18,39 +20,58 @@ func PhotonMappingFirstPass(scene *Structs.Scene) *CameraPointCloud {
 	Utils.Log("creating camera point cloud (first pass)")
 	cloud := &CameraPointCloud{
 		Points:             make([]*CameraPoint, int(camera.GetResolution().U*camera.GetResolution().V)),
-		Tree:               nil,
+		Lookup:             nil,
 		MaxPointsPerDomain: settings.MaxPointsPerDomain,
 	}
 
 	// Starting from top-left (pixel #0), going to bottom right
 	Utils.Log("iterating through camera pixels...")
 	t := time.Now()
+	gen := rand.New(rand.NewSource(time.Now().UnixMilli()))
 	for y := 0.0; y < camera.GetResolution().V; y++ {
 		for x := 0.0; x < camera.GetResolution().U; x++ {
 			o, d := camera.GetCameraGrid(Math.Vector2{x, y})
 			var prevPoint *CameraPoint
+			// The ray cone grows with distance, and is widened by each glancing reflection
+			var footprint, travelled float64
 			for i := 0; i < settings.MaxInitialRayDepth; i++ {
-				doesIntersect, intersection, barycentric, triangle := Structs.RayCast(d.Normalized(), o, scene)
-				if !doesIntersect {
+				ray := Structs.Ray{Origin: o, Direction: d.Normalized(), Seed: gen.Uint64()}
+				hit, ok := scene.Intersect(ray, Structs.MinHitDistance, math.Inf(1))
+				if !ok {
 					break
 				}
-				n := triangle.InterpolateNormals(barycentric)
+				travelled += hit.T
+				footprint = travelled * camera.GetPixelSpreadAngle() /
+					math.Max(math.Abs(d.Normalized().Dot(hit.GeometricNormal)), 0.1)
+				n := hit.PerturbedNormal(footprint)
 				p := &CameraPoint{
-					Position:  intersection,
+					Position:  hit.Position,
 					NextPoint: nil,
 					I:         d.Normalized(),
-					R:         d.Normalized().Reflect(n),
-					Triangle:  triangle,
-					Bary:      barycentric,
+					Triangle:  hit.Triangle,
+					Bary:      hit.Barycentric,
+					Normal:    n,
+					Footprint: footprint,
+				}
+				// Mirrors reflect the path, other surfaces continue it in a BRDF sampled direction
+				if hit.Triangle.SampleRoughness(hit.Barycentric, footprint) < specularRoughness {
+					p.R = p.I.Reflect(n)
+					p.Weight = hit.Triangle.SampleAlbedo(hit.Barycentric, footprint)
+				} else {
+					p.R, p.Weight, _ = hit.Triangle.SampleBRDF(hit.Barycentric, footprint, p.I.Inverse(), n.FaceForward(p.I),
+						Math.Vector2{U: gen.Float64(), V: gen.Float64()})
 				}
 				cloud.AddNonCameraPoint(p)
-				o = intersection
-				d = d.Normalized().Reflect(n).Normalized()
+				o = hit.Position
+				d = p.R
 				// We are storing the photon path reversed, so that during image construction we don't have to create
 				// arrays in order to reverse them
 				// During construction we will traverse the path from last to first point
 				p.NextPoint = prevPoint
 				prevPoint = p
+				if p.Weight.Equal(Math.ZeroVector3()) {
+					break
+				}
 			}
 			// The point will have an index of y*height+x
 			if prevPoint == nil { // There were no intersections with the scene
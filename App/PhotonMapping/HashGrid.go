@@ -0,0 +1,188 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Camera point lookup structures. Both answer the same queries, the K-D tree adapts to any radius, while the hash grid
+// is faster when the query radii are all close to its cell size (which is the case with a fixed photon radius)
+
+type CameraPointLookup interface {
+	// Appends all the points within the radius to result and returns it
+	PointsInRadius(point Math.Vector3, radius float64, result []*CameraPoint) []*CameraPoint
+	// Appends the k nearest points within maxRadius to result, nearest first
+	NearestPoints(point Math.Vector3, k int, maxRadius float64, result []*CameraPoint) []*CameraPoint
+}
+
+// Spatial hash grid
+// Points are bucketed by the hash of their cell, and stored sorted by bucket in a single array. Different cells can
+// share a bucket, so queries still check the distance to every point. Rebuilding is a counting sort, cheap enough to
+// redo whenever the radius changes
+
+type HashGrid struct {
+	cellSize    float64
+	bounds      Structs.AABoundingBox
+	bucketStart []int32
+	points      []*CameraPoint
+}
+
+// Queries wider than that many cells per axis are answered bucket by bucket instead of cell by cell
+
+const hashGridMaxQueryCells = 8
+
+func ConstructHashGrid(pointCloud []*CameraPoint, cellSize float64) *HashGrid {
+	Utils.Log("Creating hash grid for the point cloud")
+	start := time.Now()
+	buckets := 1
+	for buckets < 2*len(pointCloud) {
+		buckets *= 2
+	}
+	grid := &HashGrid{
+		cellSize:    cellSize,
+		bounds:      getPointCloudBoundaries(pointCloud),
+		bucketStart: make([]int32, buckets+1),
+		points:      make([]*CameraPoint, len(pointCloud)),
+	}
+	bucketOf := make([]int32, len(pointCloud))
+	for i := 0; i < len(pointCloud); i++ {
+		bucketOf[i] = grid.bucket(grid.cell(pointCloud[i].Position))
+		grid.bucketStart[bucketOf[i]+1]++
+	}
+	for b := 0; b < buckets; b++ {
+		grid.bucketStart[b+1] += grid.bucketStart[b]
+	}
+	fill := make([]int32, buckets)
+	copy(fill, grid.bucketStart[:buckets])
+	for i := 0; i < len(pointCloud); i++ {
+		grid.points[fill[bucketOf[i]]] = pointCloud[i]
+		fill[bucketOf[i]]++
+	}
+	Utils.LogTiming("building the hash grid ("+strconv.Itoa(buckets)+" buckets) for the point cloud", start)
+	return grid
+}
+
+type gridCell struct {
+	X, Y, Z int64
+}
+
+func (grid *HashGrid) cell(p Math.Vector3) gridCell {
+	return gridCell{
+		X: int64(math.Floor(p.X / grid.cellSize)),
+		Y: int64(math.Floor(p.Y / grid.cellSize)),
+		Z: int64(math.Floor(p.Z / grid.cellSize)),
+	}
+}
+
+func (grid *HashGrid) bucket(cell gridCell) int32 {
+	h := uint64(cell.X)*73856093 ^ uint64(cell.Y)*19349663 ^ uint64(cell.Z)*83492791
+	h ^= h >> 29
+	h *= 0xBF58476D1CE4E5B9
+	h ^= h >> 32
+	return int32(h & uint64(len(grid.bucketStart)-2))
+}
+
+func (grid *HashGrid) PointsInRadius(point Math.Vector3, radius float64, result []*CameraPoint) []*CameraPoint {
+	if len(grid.points) == 0 {
+		return result
+	}
+	radiusSq := radius * radius
+	// Clamping the query to the points' bounds keeps huge radii from visiting empty cells
+	low := grid.cell(Math.Vector3{
+		X: math.Max(point.X-radius, grid.bounds.Point1.X),
+		Y: math.Max(point.Y-radius, grid.bounds.Point1.Y),
+		Z: math.Max(point.Z-radius, grid.bounds.Point1.Z),
+	})
+	high := grid.cell(Math.Vector3{
+		X: math.Min(point.X+radius, grid.bounds.Point2.X),
+		Y: math.Min(point.Y+radius, grid.bounds.Point2.Y),
+		Z: math.Min(point.Z+radius, grid.bounds.Point2.Z),
+	})
+	if low.X > high.X || low.Y > high.Y || low.Z > high.Z {
+		return result
+	}
+	if high.X-low.X >= hashGridMaxQueryCells || high.Y-low.Y >= hashGridMaxQueryCells ||
+		high.Z-low.Z >= hashGridMaxQueryCells {
+		for i := 0; i < len(grid.points); i++ {
+			if grid.points[i].Position.Sub(point).LenSq() <= radiusSq {
+				result = append(result, grid.points[i])
+			}
+		}
+		return result
+	}
+
+	// Cells of the query can share buckets, every bucket is visited once
+	var visitedBuffer [hashGridMaxQueryCells * hashGridMaxQueryCells * hashGridMaxQueryCells]int32
+	visited := visitedBuffer[:0]
+	for x := low.X; x <= high.X; x++ {
+		for y := low.Y; y <= high.Y; y++ {
+			for z := low.Z; z <= high.Z; z++ {
+				b := grid.bucket(gridCell{X: x, Y: y, Z: z})
+				seen := false
+				for i := 0; i < len(visited); i++ {
+					if visited[i] == b {
+						seen = true
+						break
+					}
+				}
+				if seen {
+					continue
+				}
+				visited = append(visited, b)
+				for i := grid.bucketStart[b]; i < grid.bucketStart[b+1]; i++ {
+					if grid.points[i].Position.Sub(point).LenSq() <= radiusSq {
+						result = append(result, grid.points[i])
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
+// The search radius starts at one cell and doubles until the k-th nearest point is known to be within it
+
+func (grid *HashGrid) NearestPoints(point Math.Vector3, k int, maxRadius float64, result []*CameraPoint) []*CameraPoint {
+	if k <= 0 || len(grid.points) == 0 {
+		return result
+	}
+	// No point is farther than the farthest corner of the bounds
+	farthest := Math.Vector3{
+		X: math.Max(math.Abs(point.X-grid.bounds.Point1.X), math.Abs(point.X-grid.bounds.Point2.X)),
+		Y: math.Max(math.Abs(point.Y-grid.bounds.Point1.Y), math.Abs(point.Y-grid.bounds.Point2.Y)),
+		Z: math.Max(math.Abs(point.Z-grid.bounds.Point1.Z), math.Abs(point.Z-grid.bounds.Point2.Z)),
+	}.Len()
+
+	heap := &pointHeap{
+		points:    make([]*CameraPoint, 0, k),
+		distances: make([]float64, 0, k),
+	}
+	var candidates []*CameraPoint
+	for radius := grid.cellSize; ; radius *= 2 {
+		// Once the radius reaches the farthest corner, the last query takes every point within maxRadius, so that
+		// points right at the corner aren't lost to rounding
+		last := radius >= math.Min(maxRadius, farthest)
+		if last {
+			radius = maxRadius
+		}
+		heap.points = heap.points[:0]
+		heap.distances = heap.distances[:0]
+		candidates = grid.PointsInRadius(point, radius, candidates[:0])
+		for i := 0; i < len(candidates); i++ {
+			d := candidates[i].Position.Sub(point).LenSq()
+			if len(heap.points) < k {
+				heap.push(candidates[i], d)
+			} else if d < heap.distances[0] {
+				heap.replaceTop(candidates[i], d)
+			}
+		}
+		if len(heap.points) == k || last {
+			break
+		}
+	}
+	return heap.appendSorted(result)
+}
@@ -0,0 +1,128 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rendering algorithms. Prepare runs once after the scene BVH is built, Render starts the worker threads (it may be
+// called again after the handler is finished, to resume), and Pixel returns the current estimate of a pixel, indexed
+// from the top-left corner
+
+type Integrator interface {
+	Prepare()
+	Render(handler *PhotonThreadHandler)
+	Pixel(i int) Math.Vector3
+}
+
+// Image accumulated over several passes, filled row by row
+
+type Film struct {
+	Mu      sync.Mutex
+	width   int
+	height  int
+	sum     []Math.Vector3
+	samples []int
+	// Rows handed out so far, over all the passes
+	nextRow atomic.Int64
+}
+
+func NewFilm(width, height int) *Film {
+	return &Film{
+		width:   width,
+		height:  height,
+		sum:     make([]Math.Vector3, width*height),
+		samples: make([]int, width*height),
+	}
+}
+
+func (film *Film) AddRow(y int, row []Math.Vector3) {
+	film.Mu.Lock()
+	defer film.Mu.Unlock()
+	for x := 0; x < film.width; x++ {
+		film.sum[y*film.width+x] = film.sum[y*film.width+x].Add(row[x])
+		film.samples[y*film.width+x]++
+	}
+}
+
+func (film *Film) Pixel(i int) Math.Vector3 {
+	film.Mu.Lock()
+	defer film.Mu.Unlock()
+	if film.samples[i] == 0 {
+		return Math.Vector3{}
+	}
+	return film.sum[i].FDiv(float64(film.samples[i]))
+}
+
+// Renders jittered passes over the film until the handler is finished. newSampler is called once per thread, so that
+// the samplers can keep their own buffers
+
+func renderFilm(handler *PhotonThreadHandler, film *Film, newSampler func() func(x, y float64, gen *rand.Rand) Math.Vector3) {
+	handler.Start(func(thread int) {
+		gen := rand.New(rand.NewSource(time.Now().UnixNano() + int64(thread)))
+		sample := newSampler()
+		row := make([]Math.Vector3, film.width)
+		for handler.busy {
+			y := int(film.nextRow.Add(1)-1) % film.height
+			for x := 0; x < film.width; x++ {
+				row[x] = sample(float64(x)+gen.Float64(), float64(y)+gen.Float64(), gen)
+			}
+			film.AddRow(y, row)
+		}
+	})
+}
+
+func newSceneFilm(scene *Structs.Scene) *Film {
+	resolution := scene.GetCamera().GetResolution()
+	return NewFilm(int(resolution.U), int(resolution.V))
+}
+
+// Progressive photon mapping: camera points from the first pass gather the photons cast by AsyncPhotonCast
+
+type ProgressiveIntegrator struct {
+	CameraCloud *CameraPointCloud
+	scene       *Structs.Scene
+	env         *Environment
+}
+
+func NewProgressiveIntegrator(scene *Structs.Scene, env *Environment) *ProgressiveIntegrator {
+	return &ProgressiveIntegrator{
+		scene: scene,
+		env:   env,
+	}
+}
+
+func (integrator *ProgressiveIntegrator) Prepare() {
+	integrator.CameraCloud = PhotonMappingFirstPass(integrator.scene)
+	integrator.CameraCloud.ConstructLookup(integrator.scene.GetSceneSettings())
+	ComputeDirectLighting(integrator.scene, integrator.CameraCloud)
+}
+
+func (integrator *ProgressiveIntegrator) Render(handler *PhotonThreadHandler) {
+	Utils.Log("Starting async photon mapping")
+	handler.AllocThreads(integrator.scene, integrator.CameraCloud, integrator.env)
+}
+
+func (integrator *ProgressiveIntegrator) Pixel(i int) Math.Vector3 {
+	point := integrator.CameraCloud.Points[i]
+	// Since the photon path is stored in reverse order, we can just use the linked array as is
+	if point.AccumulatedPhotons == MissPoint {
+		return integrator.env.SampleEnvironment(point.I)
+	}
+	pixelColor := point.Radiance()
+	for point.NextPoint != nil {
+		nPoint := point.NextPoint
+		// The light coming from the next point of the path (weighted with the BRDF sample that picked the direction) and
+		// the photons are two estimates of the indirect light, so they are averaged
+		indirect := Math.InterpolateVector3(nPoint.Weight.Mul(pixelColor), nPoint.PhotonRadiance(), 0.5)
+		pixelColor = nPoint.DirectRadiance().Add(indirect)
+		point = nPoint
+	}
+	// The last point in the path is the one the camera sees directly
+	return pixelColor.Add(point.Triangle.SampleEmission(point.Bary, point.Footprint))
+}
@@ -0,0 +1,264 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"math"
+	"math/rand"
+)
+
+// Classic two-pass photon mapping (Jensen). The photon maps are traced once, then camera rays are shaded with direct
+// lighting from shadow rays, caustics from the caustic map and the remaining indirect light from a final gather over
+// the global map. The image is refined progressively with jittered camera rays. In participating media, the single
+// scattering of the lights along the rays is estimated with shadow rays and the rest with a beam radiance estimate
+// over the volume photons
+
+type JensenIntegrator struct {
+	scene *Structs.Scene
+	env   *Environment
+	media *sceneMedia
+	maps  *PhotonMaps
+	film  *Film
+}
+
+func NewJensenIntegrator(scene *Structs.Scene, env *Environment) *JensenIntegrator {
+	return &JensenIntegrator{
+		scene: scene,
+		env:   env,
+	}
+}
+
+// Traces the photon maps. Has to be called after the scene BVH is built
+
+func (integrator *JensenIntegrator) Prepare() {
+	integrator.media = newSceneMedia(integrator.scene)
+	integrator.maps = TracePhotonMaps(integrator.scene, integrator.env)
+	integrator.film = newSceneFilm(integrator.scene)
+}
+
+func (integrator *JensenIntegrator) Render(handler *PhotonThreadHandler) {
+	renderFilm(handler, integrator.film, func() func(x, y float64, gen *rand.Rand) Math.Vector3 {
+		var neighbors []*CameraPoint
+		return func(x, y float64, gen *rand.Rand) Math.Vector3 {
+			var radiance Math.Vector3
+			radiance, neighbors = integrator.sample(x, y, gen, neighbors)
+			return radiance
+		}
+	})
+}
+
+func (integrator *JensenIntegrator) Pixel(i int) Math.Vector3 {
+	return integrator.film.Pixel(i)
+}
+
+// Radiance along the camera ray through the given (fractional) pixel coordinates. Mirror-like surfaces are followed up
+// to MaxInitialRayDepth, the first rough surface is shaded with the photon maps
+
+func (integrator *JensenIntegrator) sample(x, y float64, gen *rand.Rand, neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	scene := integrator.scene
+	camera := scene.GetCamera()
+	origin, direction := camera.GetCameraGrid(Math.Vector2{U: x, V: y})
+	direction = direction.Normalized()
+	throughput := Math.Vector3{X: 1, Y: 1, Z: 1}
+	medium := integrator.media.medium
+	var radiance Math.Vector3
+	var travelled float64
+	for depth := 0; depth < scene.GetSceneSettings().MaxInitialRayDepth; depth++ {
+		ray := Structs.Ray{Origin: origin, Direction: direction, Seed: gen.Uint64()}
+		hit, ok := scene.Intersect(ray, Structs.MinHitDistance, math.Inf(1))
+		if medium != nil {
+			var scattered, transmittance Math.Vector3
+			scattered, transmittance, neighbors = integrator.mediumRadiance(medium, ray, hitDistance(&hit, ok), true, gen,
+				neighbors)
+			radiance = radiance.Add(throughput.Mul(scattered))
+			throughput = throughput.Mul(transmittance)
+		}
+		if !ok {
+			return radiance.Add(throughput.Mul(integrator.env.SampleEnvironment(direction))), neighbors
+		}
+		travelled += hit.T
+		if hit.Triangle.Material.IsMediumBoundary() {
+			medium = integrator.media.cross(&hit)
+			origin = hit.Position
+			continue
+		}
+		footprint := travelled * camera.GetPixelSpreadAngle() / math.Max(math.Abs(direction.Dot(hit.GeometricNormal)), 0.1)
+		n := hit.PerturbedNormal(footprint).FaceForward(direction)
+		radiance = radiance.Add(throughput.Mul(hit.Triangle.SampleEmission(hit.Barycentric, footprint)))
+
+		if hit.Triangle.SampleRoughness(hit.Barycentric, footprint) < specularRoughness {
+			throughput = throughput.Mul(hit.Triangle.SampleAlbedo(hit.Barycentric, footprint))
+			origin = hit.Position
+			direction = direction.Reflect(n)
+			continue
+		}
+
+		var reflected Math.Vector3
+		if pickSubsurface(&hit, gen) {
+			reflected, neighbors = integrator.subsurface(&hit, n, footprint, gen, neighbors)
+			return radiance.Add(throughput.Mul(reflected)), neighbors
+		}
+		reflected, neighbors = integrator.shade(&hit, medium, n, direction.Inverse(), footprint, gen, neighbors)
+		return radiance.Add(throughput.Mul(reflected)), neighbors
+	}
+	return radiance, neighbors
+}
+
+func (integrator *JensenIntegrator) shade(hit *Structs.Hit, medium *Structs.Medium, n, wo Math.Vector3, footprint float64,
+	gen *rand.Rand, neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	settings := integrator.scene.GetSceneSettings()
+	radiance := directLighting(integrator.media, medium, hit.Triangle, hit.Barycentric, hit.Position, n, wo, footprint)
+
+	var caustics Math.Vector3
+	caustics, neighbors = photonRadiance(integrator.maps.Caustic, hit, n, wo, settings.PhotonLookupCount,
+		settings.PhotonRadius, footprint, neighbors)
+	radiance = radiance.Add(caustics)
+
+	var indirect Math.Vector3
+	indirect, neighbors = integrator.finalGather(hit, medium, n, wo, footprint, gen, neighbors)
+	return radiance.Add(indirect), neighbors
+}
+
+// Light leaving the surface after a subsurface random walk. The walk blurs the lighting anyway, so the irradiance where
+// it leaves the surface comes straight from the global map, direct light included
+
+func (integrator *JensenIntegrator) subsurface(hit *Structs.Hit, n Math.Vector3, footprint float64, gen *rand.Rand,
+	neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	exit, exitNormal, weight, ok := subsurfaceWalk(integrator.scene, hit, n, footprint, gen)
+	if !ok {
+		return Math.Vector3{}, neighbors
+	}
+	var irradiance Math.Vector3
+	irradiance, neighbors = photonIrradiance(integrator.maps.Global, exit.Position, exitNormal,
+		integrator.scene.GetSceneSettings().PhotonLookupCount, neighbors)
+	return weight.Mul(irradiance).FDiv(math.Pi), neighbors
+}
+
+// Indirect diffuse light, estimated from the global map where the gather rays land. Gather rays are followed through
+// mirrors, but light reaching the point through mirrors alone is left out, as it is in the caustic map already
+
+func (integrator *JensenIntegrator) finalGather(hit *Structs.Hit, medium *Structs.Medium, n, wo Math.Vector3, footprint float64,
+	gen *rand.Rand, neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	scene := integrator.scene
+	settings := scene.GetSceneSettings()
+	gatherFootprint := settings.PhotonRadius * 2
+	var radiance Math.Vector3
+	for i := 0; i < settings.GatherRays; i++ {
+		wi, throughput, _ := hit.Triangle.SampleBRDF(hit.Barycentric, footprint, wo, n, Math.Vector2{U: gen.Float64(), V: gen.Float64()})
+		if throughput.Equal(Math.ZeroVector3()) {
+			continue
+		}
+		origin, direction, gatherMedium := hit.Position, wi, medium
+		// Environment light reflected by mirrors is in the caustic map
+		mirrored := false
+		for depth := 0; depth <= settings.MaxInitialRayDepth; depth++ {
+			ray := Structs.Ray{Origin: origin, Direction: direction, Seed: gen.Uint64()}
+			gather, ok := scene.Intersect(ray, Structs.MinHitDistance, math.Inf(1))
+			if gatherMedium != nil {
+				var scattered, transmittance Math.Vector3
+				scattered, transmittance, neighbors = integrator.mediumRadiance(gatherMedium, ray, hitDistance(&gather, ok),
+					false, gen, neighbors)
+				radiance = radiance.Add(throughput.Mul(scattered))
+				throughput = throughput.Mul(transmittance)
+			}
+			if !ok {
+				if !mirrored {
+					radiance = radiance.Add(throughput.Mul(integrator.env.SampleEnvironment(direction)))
+				}
+				break
+			}
+			if gather.Triangle.Material.IsMediumBoundary() {
+				gatherMedium = integrator.media.cross(&gather)
+				origin = gather.Position
+				continue
+			}
+			gatherNormal := gather.PerturbedNormal(gatherFootprint).FaceForward(direction)
+			radiance = radiance.Add(throughput.Mul(gather.Triangle.SampleEmission(gather.Barycentric, gatherFootprint)))
+			if gather.Triangle.SampleRoughness(gather.Barycentric, gatherFootprint) < specularRoughness {
+				throughput = throughput.Mul(gather.Triangle.SampleAlbedo(gather.Barycentric, gatherFootprint))
+				origin = gather.Position
+				direction = direction.Reflect(gatherNormal)
+				mirrored = true
+				continue
+			}
+			var estimate Math.Vector3
+			estimate, neighbors = photonRadianceDiffuse(integrator.maps.Global, &gather, gatherNormal,
+				settings.PhotonLookupCount, gatherFootprint, neighbors)
+			radiance = radiance.Add(throughput.Mul(estimate))
+			break
+		}
+	}
+	return radiance.FDiv(float64(max(settings.GatherRays, 1))), neighbors
+}
+
+// Light scattered towards the ray origin by the medium along the ray up to tMax, and the transmittance over that part.
+// Everything is estimated at a uniformly sampled point on the ray, with shadow rays for the single scattering of the
+// lights and the volume photons for the rest. With beam set, the volume photons are gathered over the whole ray with
+// the beam radiance estimate instead, which is less noisy but too slow for the final gather
+
+func (integrator *JensenIntegrator) mediumRadiance(medium *Structs.Medium, ray Structs.Ray, tMax float64, beam bool,
+	gen *rand.Rand, neighbors []*CameraPoint) (Math.Vector3, Math.Vector3, []*CameraPoint) {
+	t0, t1 := integrator.media.segment(medium, ray, tMax)
+	if t1 <= t0 {
+		return Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}, neighbors
+	}
+	if math.IsInf(t1, 1) {
+		// Rays leaving an open medium mesh never get out of the medium
+		return Math.Vector3{}, Math.Vector3{}, neighbors
+	}
+	t := t0 + gen.Float64()*(t1-t0)
+	position := ray.Origin.Add(ray.Direction.FMul(t))
+	// The scattering coefficient is part of the volume photon power already
+	radiance := integrator.media.inScattering(medium, position, ray.Direction).Mul(medium.Scattering)
+	if integrator.maps.Volume != nil && !beam {
+		var photons Math.Vector3
+		photons, neighbors = integrator.volumeRadiance(medium, position, ray.Direction, neighbors)
+		radiance = radiance.Add(photons)
+	}
+	radiance = radiance.Mul(medium.Transmittance(t - t0)).FMul(t1 - t0)
+	if integrator.maps.Volume != nil && beam {
+		var photons Math.Vector3
+		photons, neighbors = integrator.beamRadiance(medium, ray, t0, t1, neighbors)
+		radiance = radiance.Add(photons)
+	}
+	return radiance, medium.Transmittance(t1 - t0), neighbors
+}
+
+// Light scattered towards -direction per unit length at a point, from the volume photons in the sphere around it
+
+func (integrator *JensenIntegrator) volumeRadiance(medium *Structs.Medium, position, direction Math.Vector3,
+	neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	radius := integrator.maps.VolumeRadius
+	neighbors = integrator.maps.Volume.PointsInRadius(position, radius, neighbors[:0])
+	var radiance Math.Vector3
+	for i := 0; i < len(neighbors); i++ {
+		photon := neighbors[i]
+		radiance = radiance.Add(photon.Color.FMul(medium.Phase(-photon.I.Dot(direction))))
+	}
+	return radiance.FDiv(4.0 / 3 * math.Pi * radius * radius * radius), neighbors
+}
+
+// Beam radiance estimate (Jarosz et al.) with a fixed radius: every volume photon closer than VolumeRadius to the ray
+// segment adds its power times the phase function and the transmittance, over the area of its disc. The segment is
+// covered with spheres one radius apart, and each photon is counted by the sphere its projection on the ray falls into
+
+func (integrator *JensenIntegrator) beamRadiance(medium *Structs.Medium, ray Structs.Ray, t0, t1 float64,
+	neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	radius := integrator.maps.VolumeRadius
+	var radiance Math.Vector3
+	for start := t0; start < t1; start += radius {
+		center := ray.Origin.Add(ray.Direction.FMul(start + radius/2))
+		neighbors = integrator.maps.Volume.PointsInRadius(center, radius*math.Sqrt(1.25), neighbors[:0])
+		for i := 0; i < len(neighbors); i++ {
+			photon := neighbors[i]
+			toPhoton := photon.Position.Sub(ray.Origin)
+			t := toPhoton.Dot(ray.Direction)
+			if t < start || t >= start+radius || t > t1 || toPhoton.LenSq()-t*t > radius*radius {
+				continue
+			}
+			phase := medium.Phase(-photon.I.Dot(ray.Direction))
+			radiance = radiance.Add(photon.Color.Mul(medium.Transmittance(t - t0)).FMul(phase))
+		}
+	}
+	return radiance.FDiv(math.Pi * radius * radius), neighbors
+}
@@ -0,0 +1,152 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"math"
+	"math/rand"
+)
+
+// Participating media along rays
+// Paths keep track of the medium they are in. They start in the scene medium (the camera and the lights are assumed to
+// be outside of the medium meshes), switch to the mesh medium when they enter a medium boundary from the front side
+// and go back to the scene medium when they leave it. Nested media are not supported
+
+// Shadow rays give up after that many medium boundaries
+const maxMediumCrossings = 16
+
+type sceneMedia struct {
+	scene *Structs.Scene
+	// Scene medium, nil for vacuum
+	medium *Structs.Medium
+	// The scene medium ends at the scene bounding sphere
+	center Math.Vector3
+	radius float64
+}
+
+// Has to be called after the scene BVH is built
+
+func newSceneMedia(scene *Structs.Scene) *sceneMedia {
+	center, radius := sceneBoundingSphere(scene)
+	return &sceneMedia{
+		scene:  scene,
+		medium: scene.GetMedium(),
+		center: center,
+		radius: radius,
+	}
+}
+
+// Ray parameter of an intersection, infinite on a miss
+
+func hitDistance(hit *Structs.Hit, ok bool) float64 {
+	if !ok {
+		return math.Inf(1)
+	}
+	return hit.T
+}
+
+// Medium on the other side of a medium boundary hit
+
+func (media *sceneMedia) cross(hit *Structs.Hit) *Structs.Medium {
+	if hit.FrontFace {
+		return hit.Triangle.Material.GetMedium()
+	}
+	return media.medium
+}
+
+// Part of the ray (with a normalized direction) before tMax that lies in the medium
+
+func (media *sceneMedia) segment(medium *Structs.Medium, ray Structs.Ray, tMax float64) (float64, float64) {
+	if medium != media.medium {
+		return 0, tMax
+	}
+	toCenter := media.center.Sub(ray.Origin)
+	b := toCenter.Dot(ray.Direction)
+	discriminant := b*b - toCenter.LenSq() + media.radius*media.radius
+	if discriminant <= 0 {
+		return 0, 0
+	}
+	root := math.Sqrt(discriminant)
+	return math.Max(b-root, 0), math.Max(math.Min(b+root, tMax), 0)
+}
+
+// Samples the next medium interaction before tMax, see Medium.SampleDistance. Returns the ray parameter of the
+// interaction (or tMax), the sample weight and whether the ray scattered
+
+func (media *sceneMedia) sample(medium *Structs.Medium, ray Structs.Ray, tMax float64, gen *rand.Rand) (float64, Math.Vector3, bool) {
+	t0, t1 := media.segment(medium, ray, tMax)
+	if t1 <= t0 {
+		return tMax, Math.Vector3{X: 1, Y: 1, Z: 1}, false
+	}
+	distance, weight, scattered := medium.SampleDistance(gen.Float64(), t1-t0)
+	if scattered {
+		return t0 + distance, weight, true
+	}
+	return tMax, weight, false
+}
+
+// Transmittance along the ray up to tMax
+
+func (media *sceneMedia) transmittance(medium *Structs.Medium, ray Structs.Ray, tMax float64) Math.Vector3 {
+	if medium == nil {
+		return Math.Vector3{X: 1, Y: 1, Z: 1}
+	}
+	t0, t1 := media.segment(medium, ray, tMax)
+	if math.IsInf(t1, 1) {
+		// Rays leaving an open medium mesh never get out of the medium
+		return Math.Vector3{}
+	}
+	return medium.Transmittance(math.Max(t1-t0, 0))
+}
+
+// Share of the light getting from one point to another. Without media it is either 0 or 1, with media the shadow ray
+// goes through the medium boundaries and is attenuated by the media on the way
+
+func (media *sceneMedia) visibility(medium *Structs.Medium, from, to Math.Vector3) Math.Vector3 {
+	scene := media.scene
+	if !scene.HasMedia() {
+		if scene.Occluded(from, to) {
+			return Math.Vector3{}
+		}
+		return Math.Vector3{X: 1, Y: 1, Z: 1}
+	}
+	visibility := Math.Vector3{X: 1, Y: 1, Z: 1}
+	for crossing := 0; crossing < maxMediumCrossings; crossing++ {
+		direction := to.Sub(from)
+		length := direction.Len()
+		if length <= 2*Structs.MinHitDistance {
+			return visibility
+		}
+		ray := Structs.Ray{Origin: from, Direction: direction.FDiv(length)}
+		hit, ok := scene.Intersect(ray, Structs.MinHitDistance, length-Structs.MinHitDistance)
+		if !ok {
+			return visibility.Mul(media.transmittance(medium, ray, length))
+		}
+		if !hit.Triangle.Material.IsMediumBoundary() {
+			return Math.Vector3{}
+		}
+		visibility = visibility.Mul(media.transmittance(medium, ray, hit.T))
+		medium = media.cross(&hit)
+		from = hit.Position
+	}
+	return Math.Vector3{}
+}
+
+// Light from the point, sun and cone lights scattered at a point in the medium towards -direction. The scattering
+// coefficient is left out, it is part of the free flight sampling weight
+
+func (media *sceneMedia) inScattering(medium *Structs.Medium, position, direction Math.Vector3) Math.Vector3 {
+	var radiance Math.Vector3
+	lights := media.scene.GetLightSources()
+	for i := 0; i < len(lights); i++ {
+		light := lights[i]
+		lightPosition := light.GetPosition()
+		visibility := media.visibility(medium, position, lightPosition)
+		if visibility.Equal(Math.ZeroVector3()) {
+			continue
+		}
+		phase := medium.Phase(lightPosition.Sub(position).Normalized().Dot(direction))
+		radiance = radiance.Add(light.GetLightColor().Mul(visibility).FMul(phase * light.GetLightIntensityTo(position)))
+	}
+	return radiance
+}
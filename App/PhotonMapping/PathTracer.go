@@ -0,0 +1,140 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+	"math/rand"
+)
+
+// Unidirectional path tracer with next event estimation, meant for reference images. The point, sun and cone lights
+// can't be hit by rays, so they are only reached with shadow rays, while the environment and the emissive triangles are
+// only reached by the paths themselves. That way no light is counted twice and no weighting is needed. In participating
+// media the paths scatter at sampled free flight distances, with shadow rays to the lights from every scattering point
+
+// Paths shorter than that are never terminated by russian roulette
+const pathRouletteDepth = 3
+
+type PathTracer struct {
+	scene *Structs.Scene
+	env   *Environment
+	media *sceneMedia
+	film  *Film
+}
+
+func NewPathTracer(scene *Structs.Scene, env *Environment) *PathTracer {
+	return &PathTracer{
+		scene: scene,
+		env:   env,
+	}
+}
+
+func (tracer *PathTracer) Prepare() {
+	tracer.media = newSceneMedia(tracer.scene)
+	tracer.film = newSceneFilm(tracer.scene)
+}
+
+func (tracer *PathTracer) Render(handler *PhotonThreadHandler) {
+	Utils.Log("Starting async path tracing")
+	renderFilm(handler, tracer.film, func() func(x, y float64, gen *rand.Rand) Math.Vector3 {
+		return tracer.sample
+	})
+}
+
+func (tracer *PathTracer) Pixel(i int) Math.Vector3 {
+	return tracer.film.Pixel(i)
+}
+
+func (tracer *PathTracer) sample(x, y float64, gen *rand.Rand) Math.Vector3 {
+	scene := tracer.scene
+	camera := scene.GetCamera()
+	origin, direction := camera.GetCameraGrid(Math.Vector2{U: x, V: y})
+	direction = direction.Normalized()
+	throughput := Math.Vector3{X: 1, Y: 1, Z: 1}
+	medium := tracer.media.medium
+	var radiance Math.Vector3
+	var travelled float64
+	for depth := 0; depth < scene.GetSceneSettings().MaxPathDepth; depth++ {
+		ray := Structs.Ray{Origin: origin, Direction: direction, Seed: gen.Uint64()}
+		hit, ok := scene.Intersect(ray, Structs.MinHitDistance, math.Inf(1))
+		if medium != nil {
+			t, weight, scattered := tracer.media.sample(medium, ray, hitDistance(&hit, ok), gen)
+			throughput = throughput.Mul(weight)
+			if scattered {
+				travelled += t
+				origin = origin.Add(direction.FMul(t))
+				radiance = radiance.Add(throughput.Mul(tracer.media.inScattering(medium, origin, direction)))
+				direction = medium.SamplePhase(direction, gen.Float64(), gen.Float64())
+				if throughput, ok = pathRoulette(depth, throughput, gen); !ok {
+					break
+				}
+				continue
+			}
+		}
+		if !ok {
+			return radiance.Add(throughput.Mul(tracer.env.SampleEnvironment(direction)))
+		}
+		// Textures are filtered over the camera ray cone, as in the first pass
+		travelled += hit.T
+		origin = hit.Position
+		if hit.Triangle.Material.IsMediumBoundary() {
+			medium = tracer.media.cross(&hit)
+			continue
+		}
+		footprint := travelled * camera.GetPixelSpreadAngle() / math.Max(math.Abs(direction.Dot(hit.GeometricNormal)), 0.1)
+		n := hit.PerturbedNormal(footprint).FaceForward(direction)
+		wo := direction.Inverse()
+		radiance = radiance.Add(throughput.Mul(hit.Triangle.SampleEmission(hit.Barycentric, footprint)))
+
+		if hit.Triangle.SampleRoughness(hit.Barycentric, footprint) < specularRoughness {
+			throughput = throughput.Mul(hit.Triangle.SampleAlbedo(hit.Barycentric, footprint))
+			direction = direction.Reflect(n)
+			continue
+		}
+
+		if pickSubsurface(&hit, gen) {
+			exit, exitNormal, weight, ok := subsurfaceWalk(scene, &hit, n, footprint, gen)
+			if !ok {
+				break
+			}
+			// Diffuse transmission out of the surface, sampled with the cosine so that the weight is 1
+			throughput = throughput.Mul(weight)
+			origin = exit.Position
+			irradiance := directIrradiance(tracer.media, medium, exit.Position, exitNormal)
+			radiance = radiance.Add(throughput.Mul(irradiance).FDiv(math.Pi))
+			if throughput, ok = pathRoulette(depth, throughput, gen); !ok {
+				break
+			}
+			direction = Utils.CosineSampleHemisphere(gen.Float64(), gen.Float64()).FromSingleVectorBasis(exitNormal)
+			continue
+		}
+
+		radiance = radiance.Add(throughput.Mul(directLighting(tracer.media, medium, hit.Triangle, hit.Barycentric, hit.Position,
+			n, wo, footprint)))
+
+		wi, weight, _ := hit.Triangle.SampleBRDF(hit.Barycentric, footprint, wo, n, Math.Vector2{U: gen.Float64(), V: gen.Float64()})
+		if weight.Equal(Math.ZeroVector3()) {
+			break
+		}
+		throughput = throughput.Mul(weight)
+		if throughput, ok = pathRoulette(depth, throughput, gen); !ok {
+			break
+		}
+		direction = wi
+	}
+	return radiance
+}
+
+// Russian roulette for paths longer than pathRouletteDepth, keeping the expected throughput the same
+
+func pathRoulette(depth int, throughput Math.Vector3, gen *rand.Rand) (Math.Vector3, bool) {
+	if depth < pathRouletteDepth {
+		return throughput, true
+	}
+	survival := math.Min(math.Max(throughput.X, math.Max(throughput.Y, throughput.Z)), 0.95)
+	if gen.Float64() >= survival {
+		return throughput, false
+	}
+	return throughput.FDiv(survival), true
+}
@@ -0,0 +1,72 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"time"
+)
+
+// Per-thread photon accumulation
+// Every photon thread collects its deposits in its own buffer, so the hot loop needs no locking. The buffer is flushed
+// into the points (under the cloud mutex, once per many deposits) when it is full or old enough, so the viewer still
+// sees the image progress. Buffers hold deposits rather than per-point sums, so their size doesn't grow with the
+// resolution. Environment light samples are collected the same way
+
+const (
+	photonFlushSize     = 1 << 14
+	photonFlushInterval = 100 * time.Millisecond
+)
+
+type photonDeposit struct {
+	point *CameraPoint
+	flux  Math.Vector3
+}
+
+type PhotonBuffer struct {
+	deposits            []photonDeposit
+	environmentDeposits []photonDeposit
+	lastFlush           time.Time
+}
+
+func NewPhotonBuffer() *PhotonBuffer {
+	return &PhotonBuffer{
+		deposits:  make([]photonDeposit, 0, photonFlushSize),
+		lastFlush: time.Now(),
+	}
+}
+
+func (buffer *PhotonBuffer) Add(point *CameraPoint, flux Math.Vector3) {
+	buffer.deposits = append(buffer.deposits, photonDeposit{point: point, flux: flux})
+}
+
+func (buffer *PhotonBuffer) AddEnvironment(point *CameraPoint, radiance Math.Vector3) {
+	buffer.environmentDeposits = append(buffer.environmentDeposits, photonDeposit{point: point, flux: radiance})
+}
+
+// Flushes the buffer if it is due
+
+func (buffer *PhotonBuffer) MaybeFlush(cloud *CameraPointCloud) {
+	if len(buffer.deposits)+len(buffer.environmentDeposits) >= photonFlushSize || time.Since(buffer.lastFlush) >= photonFlushInterval {
+		buffer.Flush(cloud)
+	}
+}
+
+func (buffer *PhotonBuffer) Flush(cloud *CameraPointCloud) {
+	buffer.lastFlush = time.Now()
+	if len(buffer.deposits) == 0 && len(buffer.environmentDeposits) == 0 {
+		return
+	}
+	cloud.Mu.Lock()
+	for i := 0; i < len(buffer.deposits); i++ {
+		point := buffer.deposits[i].point
+		point.Color = point.Color.Add(buffer.deposits[i].flux)
+		point.AccumulatedPhotons++
+	}
+	for i := 0; i < len(buffer.environmentDeposits); i++ {
+		point := buffer.environmentDeposits[i].point
+		point.EnvironmentLight = point.EnvironmentLight.Add(buffer.environmentDeposits[i].flux)
+		point.EnvironmentSamples++
+	}
+	cloud.Mu.Unlock()
+	buffer.deposits = buffer.deposits[:0]
+	buffer.environmentDeposits = buffer.environmentDeposits[:0]
+}
@@ -0,0 +1,68 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Utils"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Photon deposits from many threads into a fixed cloud, the hot loop of AsyncPhotonCast without the ray tracing: a
+// neighbor query at a random position, a deposit in the thread buffer for every neighbor, and the periodic flush
+
+func BenchmarkPhotonBuffer(b *testing.B) {
+	cloud := &CameraPointCloud{NonCameraPoints: randomPointCloud(1<<16, rand.New(rand.NewSource(1)))}
+	cloud.Lookup = ConstructKDTree(cloud.NonCameraPoints, 16, Utils.NewWorkerPool(4))
+	flux := Math.Vector3{X: 1, Y: 1, Z: 1}
+	for _, threads := range []int{1, 2, 4, 8, 16} {
+		b.Run("threads="+strconv.Itoa(threads), func(b *testing.B) {
+			var wg sync.WaitGroup
+			for thread := 0; thread < threads; thread++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					gen := rand.New(rand.NewSource(int64(thread)))
+					buffer := NewPhotonBuffer()
+					var neighbors []*CameraPoint
+					for i := thread; i < b.N; i += threads {
+						position := Math.Vector3{X: gen.Float64(), Y: gen.Float64(), Z: gen.Float64()}
+						neighbors = cloud.Lookup.PointsInRadius(position, 0.02, neighbors[:0])
+						for j := 0; j < len(neighbors); j++ {
+							buffer.Add(neighbors[j], flux)
+						}
+						buffer.MaybeFlush(cloud)
+					}
+					buffer.Flush(cloud)
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// Every deposit reaches its point, whatever the number of threads
+
+func TestPhotonBufferFlush(t *testing.T) {
+	cloud := &CameraPointCloud{NonCameraPoints: randomPointCloud(1000, rand.New(rand.NewSource(1)))}
+	var wg sync.WaitGroup
+	for thread := 0; thread < 8; thread++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buffer := NewPhotonBuffer()
+			for i := 0; i < 100000; i++ {
+				buffer.Add(cloud.NonCameraPoints[i%len(cloud.NonCameraPoints)], Math.Vector3{X: 1})
+				buffer.MaybeFlush(cloud)
+			}
+			buffer.Flush(cloud)
+		}()
+	}
+	wg.Wait()
+	for _, point := range cloud.NonCameraPoints {
+		if point.AccumulatedPhotons != 800 || point.Color.X != 800 {
+			t.Fatalf("point got %d photons with flux %g, expected 800", point.AccumulatedPhotons, point.Color.X)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Photon maps for two-pass photon mapping
+// Photons are stored as camera points (with the photon travel direction in I and its power in Color), so that they use
+// the same lookup structures. Every photon landing on a diffuse surface goes to the global map, photons that got there
+// through specular bounces only (light -> specular -> ... -> diffuse) go to the caustic map as well. Photons scattering
+// in participating media go to the volume map, except for the first scattering of photons from the lights, which is
+// computed with shadow rays instead
+
+// Surfaces smoother than that reflect photons and camera rays as mirrors
+const specularRoughness = 0.1
+
+type PhotonMaps struct {
+	Global         CameraPointLookup
+	Caustic        CameraPointLookup
+	Volume         CameraPointLookup
+	GlobalPhotons  int
+	CausticPhotons int
+	VolumePhotons  int
+	// Radius of the volume photons in the beam radiance estimate
+	VolumeRadius float64
+}
+
+// Photons traced by one thread
+
+type tracedPhotons struct {
+	global  []*CameraPoint
+	caustic []*CameraPoint
+	volume  []*CameraPoint
+}
+
+// Anything that can emit photons: the scene lights and the environment
+
+type photonEmitter interface {
+	EmitPhoton(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (Math.Vector3, Math.Vector3, Math.Vector3)
+}
+
+func photonEmitters(scene *Structs.Scene, env *Environment) []photonEmitter {
+	var emitters []photonEmitter
+	lights := scene.GetLightSources()
+	for i := 0; i < len(lights); i++ {
+		emitters = append(emitters, lights[i])
+	}
+	if !env.plainColor || env.color.ColorGrayscale() > 0 {
+		emitters = append(emitters, env)
+	}
+	return emitters
+}
+
+func sceneBoundingSphere(scene *Structs.Scene) (Math.Vector3, float64) {
+	bounds := scene.GetBounds()
+	center := bounds.MiddlePoint()
+	return center, math.Max(bounds.Point2.Sub(center).Len(), Structs.MinHitDistance)
+}
+
+func TracePhotonMaps(scene *Structs.Scene, env *Environment) *PhotonMaps {
+	settings := scene.GetSceneSettings()
+	Utils.Log("tracing " + strconv.Itoa(settings.PhotonCount) + " photons")
+	start := time.Now()
+	emitters := photonEmitters(scene, env)
+	threads := max(settings.AsyncThreads, 1)
+	photons := make([]tracedPhotons, threads)
+	if len(emitters) > 0 {
+		media := newSceneMedia(scene)
+		var wg sync.WaitGroup
+		for thread := 0; thread < threads; thread++ {
+			count := settings.PhotonCount/threads + btoi(thread < settings.PhotonCount%threads)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				gen := rand.New(rand.NewSource(time.Now().UnixNano() + int64(thread)))
+				for i := 0; i < count; i++ {
+					tracePhoton(media, emitters, gen, &photons[thread])
+				}
+			}()
+		}
+		wg.Wait()
+	} else {
+		Utils.LogWarning("no lights and a black environment, the photon maps are empty")
+	}
+
+	var global, caustic, volume []*CameraPoint
+	for thread := 0; thread < threads; thread++ {
+		global = append(global, photons[thread].global...)
+		caustic = append(caustic, photons[thread].caustic...)
+		volume = append(volume, photons[thread].volume...)
+	}
+	Utils.LogTiming("tracing "+strconv.Itoa(len(global))+" global, "+strconv.Itoa(len(caustic))+" caustic and "+
+		strconv.Itoa(len(volume))+" volume photons", start)
+	pool := Utils.NewWorkerPool(threads)
+	maps := &PhotonMaps{
+		Global:         ConstructKDTree(global, settings.MaxPointsPerDomain, pool),
+		Caustic:        ConstructKDTree(caustic, settings.MaxPointsPerDomain, pool),
+		GlobalPhotons:  len(global),
+		CausticPhotons: len(caustic),
+		VolumePhotons:  len(volume),
+	}
+	if len(volume) > 0 {
+		maps.VolumeRadius = volumePhotonRadius(volume, ConstructKDTree(volume, settings.MaxPointsPerDomain, pool),
+			settings.PhotonLookupCount)
+		Utils.Log("volume photon radius " + strconv.FormatFloat(maps.VolumeRadius, 'g', 4, 64))
+		maps.Volume = ConstructHashGrid(volume, maps.VolumeRadius)
+	}
+	return maps
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// The beam radiance estimate uses a single radius for all the volume photons: the median distance to the k-th nearest
+// photon, over a subset of the photons
+
+func volumePhotonRadius(volume []*CameraPoint, lookup CameraPointLookup, k int) float64 {
+	const samples = 256
+	step := max(len(volume)/samples, 1)
+	var radii []float64
+	var neighbors []*CameraPoint
+	for i := 0; i < len(volume); i += step {
+		neighbors = lookup.NearestPoints(volume[i].Position, k, math.Inf(1), neighbors[:0])
+		radii = append(radii, neighbors[len(neighbors)-1].Position.Sub(volume[i].Position).Len())
+	}
+	sort.Float64s(radii)
+	return math.Max(radii[len(radii)/2], Structs.MinHitDistance)
+}
+
+func tracePhoton(media *sceneMedia, emitters []photonEmitter, gen *rand.Rand, photons *tracedPhotons) {
+	scene := media.scene
+	settings := scene.GetSceneSettings()
+	footprint := settings.PhotonRadius * 2
+	emitter := emitters[gen.Intn(len(emitters))]
+	origin, direction, power := emitter.EmitPhoton(gen, media.center, media.radius)
+	power = power.FMul(float64(len(emitters)) / float64(settings.PhotonCount))
+	// Single scattering of the light sources is computed with shadow rays, the environment only has photons
+	_, fromEnvironment := emitter.(*Environment)
+
+	medium := media.medium
+	// No scattering or reflection so far
+	direct := true
+	specularOnly := true
+	for depth := 0; depth <= settings.MaxMapperRayDepth; depth++ {
+		ray := Structs.Ray{Origin: origin, Direction: direction, Seed: gen.Uint64()}
+		hit, ok := scene.Intersect(ray, ray.MinT(), math.Inf(1))
+		if medium != nil {
+			t, weight, scattered := media.sample(medium, ray, hitDistance(&hit, ok), gen)
+			power = power.Mul(weight)
+			if scattered {
+				origin = origin.Add(direction.FMul(t))
+				if !direct || fromEnvironment {
+					photons.volume = append(photons.volume, &CameraPoint{
+						Position: origin,
+						I:        direction,
+						Color:    power,
+					})
+				}
+				direct, specularOnly = false, false
+				direction = medium.SamplePhase(direction, gen.Float64(), gen.Float64())
+				// The scattering albedo is already part of the power
+				survival := math.Min(math.Max(weight.X, math.Max(weight.Y, weight.Z)), 0.95)
+				if gen.Float64() >= survival {
+					break
+				}
+				power = power.FDiv(survival)
+				continue
+			}
+		}
+		if !ok {
+			break
+		}
+		origin = hit.Position
+		if hit.Triangle.Material.IsMediumBoundary() {
+			medium = media.cross(&hit)
+			continue
+		}
+		n := hit.PerturbedNormal(footprint).FaceForward(direction)
+		wo := direction.Inverse()
+
+		if hit.Triangle.SampleRoughness(hit.Barycentric, footprint) < specularRoughness {
+			power = power.Mul(hit.Triangle.SampleAlbedo(hit.Barycentric, footprint))
+			direction = direction.Reflect(n)
+			direct = false
+			continue
+		}
+
+		photon := &CameraPoint{
+			Position: hit.Position,
+			I:        direction,
+			Normal:   n,
+			Color:    power,
+		}
+		photons.global = append(photons.global, photon)
+		if specularOnly && !direct {
+			photons.caustic = append(photons.caustic, photon)
+		}
+		direct, specularOnly = false, false
+
+		if pickSubsurface(&hit, gen) {
+			exit, exitNormal, weight, ok := subsurfaceWalk(scene, &hit, n, footprint, gen)
+			if !ok {
+				break
+			}
+			survival := math.Min(math.Max(weight.X, math.Max(weight.Y, weight.Z)), 0.95)
+			if gen.Float64() >= survival {
+				break
+			}
+			power = power.Mul(weight).FDiv(survival)
+			origin = exit.Position
+			direction = Utils.CosineSampleHemisphere(gen.Float64(), gen.Float64()).FromSingleVectorBasis(exitNormal)
+			continue
+		}
+
+		// BRDF sampled bounce with russian roulette, keeping the photon power about the same
+		wi, weight, _ := hit.Triangle.SampleBRDF(hit.Barycentric, footprint, wo, n, Math.Vector2{U: gen.Float64(), V: gen.Float64()})
+		survival := math.Min(math.Max(weight.X, math.Max(weight.Y, weight.Z)), 0.95)
+		if gen.Float64() >= survival {
+			break
+		}
+		power = power.Mul(weight).FDiv(survival)
+		direction = wi
+	}
+}
+
+// Radiance estimate from the k nearest photons, f(wo, wi) * power / (pi * r^2). Photons from the back side of the
+// surface (or on differently oriented surfaces nearby) are skipped
+
+func photonRadiance(photonMap CameraPointLookup, hit *Structs.Hit, n, wo Math.Vector3, k int, maxRadius, footprint float64,
+	neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	neighbors = photonMap.NearestPoints(hit.Position, k, maxRadius, neighbors[:0])
+	if len(neighbors) == 0 {
+		return Math.Vector3{}, neighbors
+	}
+	radiusSq := neighbors[len(neighbors)-1].Position.Sub(hit.Position).LenSq()
+	if len(neighbors) < k && !math.IsInf(maxRadius, 1) {
+		radiusSq = maxRadius * maxRadius
+	}
+	if radiusSq == 0 {
+		return Math.Vector3{}, neighbors
+	}
+	var radiance Math.Vector3
+	for i := 0; i < len(neighbors); i++ {
+		photon := neighbors[i]
+		wi := photon.I.Inverse()
+		cos := wi.Dot(n)
+		if cos <= 0 || photon.Normal.Dot(n) < 0.5 {
+			continue
+		}
+		f := hit.Triangle.EvalBRDF(hit.Barycentric, footprint, wo, wi, n).FDiv(cos)
+		radiance = radiance.Add(f.Mul(photon.Color))
+	}
+	return radiance.FDiv(math.Pi * radiusSq), neighbors
+}
+
+// Cheaper estimate for the final gather hits: the surface is treated as diffuse, so only its albedo is sampled
+
+func photonRadianceDiffuse(photonMap CameraPointLookup, hit *Structs.Hit, n Math.Vector3, k int, footprint float64,
+	neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	var irradiance Math.Vector3
+	irradiance, neighbors = photonIrradiance(photonMap, hit.Position, n, k, neighbors)
+	albedo := hit.Triangle.SampleAlbedo(hit.Barycentric, footprint)
+	return albedo.Mul(irradiance).FDiv(math.Pi), neighbors
+}
+
+// Irradiance from the k nearest photons arriving on the side n faces, power / (pi * r^2)
+
+func photonIrradiance(photonMap CameraPointLookup, position, n Math.Vector3, k int, neighbors []*CameraPoint) (Math.Vector3,
+	[]*CameraPoint) {
+	neighbors = photonMap.NearestPoints(position, k, math.Inf(1), neighbors[:0])
+	if len(neighbors) == 0 {
+		return Math.Vector3{}, neighbors
+	}
+	radiusSq := neighbors[len(neighbors)-1].Position.Sub(position).LenSq()
+	if radiusSq == 0 {
+		return Math.Vector3{}, neighbors
+	}
+	var flux Math.Vector3
+	for i := 0; i < len(neighbors); i++ {
+		photon := neighbors[i]
+		if photon.I.Dot(n) >= 0 || photon.Normal.Dot(n) < 0.5 {
+			continue
+		}
+		flux = flux.Add(photon.Color)
+	}
+	return flux.FDiv(math.Pi * radiusSq), neighbors
+}
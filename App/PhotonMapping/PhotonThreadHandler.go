@@ -34,12 +34,46 @@ func (handler *PhotonThreadHandler) AllocThreads(scene *Structs.Scene, pointClou
 		if lsCount != 0 {
 			lIdx = i % lsCount
 		}
-		go AsyncPhotonCast(scene, env, pointCloud, lIdx, handler)
+		go AsyncPhotonCast(scene, env, pointCloud, i, lIdx, handler)
 		handler.wg.Add(1)
 		Utils.LogSuccess("Allocated thread #" + strconv.Itoa(i))
 	}
 }
 
+// Starts the job on every thread, the job has to return once the handler is finished
+
+func (handler *PhotonThreadHandler) Start(job func(thread int)) {
+	if handler.busy {
+		Utils.LogError("Trying to allocate threads while busy!")
+		return
+	}
+	handler.busy = true
+	for i := 0; i < handler.maxThreads; i++ {
+		handler.wg.Add(1)
+		go func() {
+			defer handler.wg.Done()
+			job(i)
+		}()
+	}
+	Utils.LogSuccess("Allocated " + strconv.Itoa(handler.maxThreads) + " threads")
+}
+
+// Starts a single job, which splits its work between the threads by itself and has to return once the handler is
+// finished
+
+func (handler *PhotonThreadHandler) StartSingle(job func(threads int)) {
+	if handler.busy {
+		Utils.LogError("Trying to allocate threads while busy!")
+		return
+	}
+	handler.busy = true
+	handler.wg.Add(1)
+	go func() {
+		defer handler.wg.Done()
+		job(handler.maxThreads)
+	}()
+}
+
 func (handler *PhotonThreadHandler) UnsafeFinish() {
 	Utils.LogWarning("Finishing async photon mapping without thread exit checks")
 	handler.busy = false
@@ -6,6 +6,8 @@ import (
 	"Photon/Utils"
 	"math"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // First pass point cluster
@@ -14,9 +16,11 @@ import (
 // - Position
 // - Next node
 // - Incoming light vector
-// - Reflected light vector
+// - Direction the camera path continues in (a mirror reflection or a BRDF sample) and its sample weight
 // - Material reference
 // - Normal
+// - Ray footprint (width of the area seen by a pixel at the point, used for texture filtering)
+// - Direct light from the light sources and the environment, computed with shadow rays
 // All point are arranged in a K-D tree. During rendering, the photon point is represented as a "sphere", so that it can
 // Cover multiple nodes at a time
 
@@ -25,18 +29,25 @@ type CameraPoint struct {
 	NextPoint          *CameraPoint
 	I                  Math.Vector3
 	R                  Math.Vector3
+	Weight             Math.Vector3
 	Triangle           *Structs.Triangle
 	Bary               Math.Vector2
+	Normal             Math.Vector3
+	Footprint          float64
 	Color              Math.Vector3
 	AccumulatedPhotons int
+	DirectLight        Math.Vector3
+	EnvironmentLight   Math.Vector3
+	EnvironmentSamples int
 }
 
 type KDTreeSpace struct {
-	Points    []*CameraPoint
-	SplitAxis uint8
-	Domain    Structs.AABoundingBox
-	Subspace1 *KDTreeSpace
-	Subspace2 *KDTreeSpace
+	Points     []*CameraPoint
+	SplitAxis  uint8
+	SplitValue float64
+	Domain     Structs.AABoundingBox
+	Subspace1  *KDTreeSpace
+	Subspace2  *KDTreeSpace
 }
 
 func getPointCloudBoundaries(cloud []*CameraPoint) Structs.AABoundingBox {
@@ -73,113 +84,242 @@ func plane(idx uint8, vec Math.Vector3) float64 {
 	panic("Invalid split plane index in KD-tree")
 }
 
-func planeSet(idx uint8, vec Math.Vector3, val float64) Math.Vector3 {
-	switch idx {
-	case 0: // YZ
-		return Math.Vector3{
-			X: val,
-			Y: vec.Y,
-			Z: vec.Z,
-		}
-	case 1: // XZ
-		return Math.Vector3{
-			X: vec.X,
-			Y: val,
-			Z: vec.Z,
-		}
-	case 2: // XY
-		return Math.Vector3{
-			X: vec.X,
-			Y: vec.Y,
-			Z: val,
-		}
-	}
-	panic("Invalid split plane index in KD-tree")
-}
+// Balanced K-D tree over the camera points
+// Nodes are split at the median point along the longest axis of their bounds, until they hold at most
+// maxPointsPerDomain points. The points are partitioned in place, so the Points of every node are a part of the same
+// array. Subspaces with more than kdParallelThreshold points are split in their own goroutines
 
-func splitAABB(splitPlane uint8, splitThreshold float64, aabb Structs.AABoundingBox) (Structs.AABoundingBox, Structs.AABoundingBox) {
-	return Structs.AABoundingBox{
-			Point1: aabb.Point1,
-			Point2: planeSet(splitPlane, aabb.Point2, splitThreshold),
-		}, Structs.AABoundingBox{
-			Point1: planeSet(splitPlane, aabb.Point1, splitThreshold),
-			Point2: aabb.Point2,
-		}
-}
+const kdParallelThreshold = 8192
 
-func ConstructKDTree(pointCloud []*CameraPoint, maxPointsPerDomain int) *KDTreeSpace {
+func ConstructKDTree(pointCloud []*CameraPoint, maxPointsPerDomain int, pool *Utils.WorkerPool) *KDTreeSpace {
 	Utils.Log("Creating K-D tree for the point cloud")
+	start := time.Now()
 	bounds := getPointCloudBoundaries(pointCloud)
 	Utils.LogSuccess("Cloud bounds found. diagonal size: " + strconv.FormatFloat(bounds.Point2.Sub(bounds.Point1).Len(), 'f', 3, 64))
+	// The tree reorders its points, the cloud keeps its own order
+	points := make([]*CameraPoint, len(pointCloud))
+	copy(points, pointCloud)
 	root := &KDTreeSpace{
-		Points:    pointCloud,
+		Points:    points,
 		SplitAxis: 0,
 		Domain:    bounds,
 		Subspace1: nil,
 		Subspace2: nil,
 	}
-	nodeQueue := []*KDTreeSpace{root}
 
 	Utils.Log("Creating the tree...")
+	var wg sync.WaitGroup
+	root.split(max(maxPointsPerDomain, 1), pool, &wg)
+	wg.Wait()
+
+	Utils.LogTiming("building the K-D tree for the point cloud", start)
+
+	return root
+}
+
+func (tree *KDTreeSpace) split(maxPointsPerDomain int, pool *Utils.WorkerPool, wg *sync.WaitGroup) {
+	if len(tree.Points) <= maxPointsPerDomain {
+		return
+	}
+	size := tree.Domain.Point2.Sub(tree.Domain.Point1)
+	tree.SplitAxis = 0
+	if size.Y > size.X && size.Y >= size.Z {
+		tree.SplitAxis = 1
+	} else if size.Z > size.X && size.Z > size.Y {
+		tree.SplitAxis = 2
+	}
+	mid := len(tree.Points) / 2
+	selectNth(tree.Points, mid, tree.SplitAxis)
+	tree.SplitValue = plane(tree.SplitAxis, tree.Points[mid].Position)
 
-	for len(nodeQueue) > 0 {
-		node := nodeQueue[0]
-		if len(node.Points) <= maxPointsPerDomain {
-			nodeQueue = nodeQueue[1:]
-			continue
+	lessNode, moreNode := &KDTreeSpace{
+		Points:    tree.Points[:mid],
+		Domain:    getPointCloudBoundaries(tree.Points[:mid]),
+		Subspace1: nil,
+		Subspace2: nil,
+	}, &KDTreeSpace{
+		Points:    tree.Points[mid:],
+		Domain:    getPointCloudBoundaries(tree.Points[mid:]),
+		Subspace1: nil,
+		Subspace2: nil,
+	}
+	tree.Subspace1 = lessNode
+	tree.Subspace2 = moreNode
+
+	if len(lessNode.Points) <= kdParallelThreshold ||
+		!pool.TryGo(wg, func() { lessNode.split(maxPointsPerDomain, pool, wg) }) {
+		lessNode.split(maxPointsPerDomain, pool, wg)
+	}
+	moreNode.split(maxPointsPerDomain, pool, wg)
+}
+
+// Quickselect: moves the nth point along the axis into place, with no greater points before it and no smaller ones
+// after it
+
+func selectNth(points []*CameraPoint, n int, axis uint8) {
+	left, right := 0, len(points)-1
+	for left < right {
+		pivot := plane(axis, points[(left+right)/2].Position)
+		i, j := left, right
+		for i <= j {
+			for plane(axis, points[i].Position) < pivot {
+				i++
+			}
+			for plane(axis, points[j].Position) > pivot {
+				j--
+			}
+			if i <= j {
+				points[i], points[j] = points[j], points[i]
+				i++
+				j--
+			}
 		}
-		splitAxis := node.SplitAxis
-		splitThreshold := plane(splitAxis, node.Domain.MiddlePoint())
-		lessAABB, moreAABB := splitAABB(splitAxis, splitThreshold, node.Domain)
-		lessNode, moreNode := &KDTreeSpace{
-			Points:    []*CameraPoint{},
-			SplitAxis: (splitAxis + 1) % 3,
-			Domain:    lessAABB,
-			Subspace1: nil,
-			Subspace2: nil,
-		}, &KDTreeSpace{
-			Points:    []*CameraPoint{},
-			SplitAxis: (splitAxis + 1) % 3,
-			Domain:    moreAABB,
-			Subspace1: nil,
-			Subspace2: nil,
+		if n <= j {
+			right = j
+		} else if n >= i {
+			left = i
+		} else {
+			return
 		}
-		for i := 0; i < len(node.Points); i++ {
-			point := node.Points[i]
-			if plane(splitAxis, point.Position) <= splitThreshold {
-				lessNode.Points = append(lessNode.Points, point)
-			} else {
-				moreNode.Points = append(moreNode.Points, point)
+	}
+}
+
+func (tree *KDTreeSpace) IsALeaf() bool {
+	return tree.Subspace1 == nil
+}
+
+// Squared distance from a point to the bounds of the node's points, 0 inside
+
+func (tree *KDTreeSpace) distanceSq(point Math.Vector3) float64 {
+	d := Math.Vector3{
+		X: math.Max(math.Max(tree.Domain.Point1.X-point.X, point.X-tree.Domain.Point2.X), 0),
+		Y: math.Max(math.Max(tree.Domain.Point1.Y-point.Y, point.Y-tree.Domain.Point2.Y), 0),
+		Z: math.Max(math.Max(tree.Domain.Point1.Z-point.Z, point.Z-tree.Domain.Point2.Z), 0),
+	}
+	return d.LenSq()
+}
+
+// Fixed radius query. Appends all the points within the radius to result (which can be reused between queries to
+// avoid allocations) and returns it
+
+func (tree *KDTreeSpace) PointsInRadius(point Math.Vector3, radius float64, result []*CameraPoint) []*CameraPoint {
+	radiusSq := radius * radius
+	if len(tree.Points) == 0 || tree.distanceSq(point) > radiusSq {
+		return result
+	}
+	if tree.IsALeaf() {
+		for i := 0; i < len(tree.Points); i++ {
+			if tree.Points[i].Position.Sub(point).LenSq() <= radiusSq {
+				result = append(result, tree.Points[i])
 			}
 		}
-		node.Subspace1 = lessNode
-		node.Subspace2 = moreNode
-		nodeQueue = nodeQueue[1:]
-		nodeQueue = append(nodeQueue, lessNode, moreNode)
+		return result
 	}
+	result = tree.Subspace1.PointsInRadius(point, radius, result)
+	return tree.Subspace2.PointsInRadius(point, radius, result)
+}
 
-	Utils.LogSuccess("Done building the K-D tree for the point cloud")
+// Bounded max-heap of the nearest point candidates, so that the farthest one can be dropped when a closer point is
+// found
 
-	return root
+type pointHeap struct {
+	points    []*CameraPoint
+	distances []float64
 }
 
-func (tree *KDTreeSpace) LocateNeighborPoints(point Math.Vector3, phR float64) *KDTreeSpace {
-	currentNode := tree
-	for currentNode.Subspace1 != nil {
-		if currentNode.Subspace1 == nil {
-			return currentNode
+func (heap *pointHeap) push(point *CameraPoint, distanceSq float64) {
+	heap.points = append(heap.points, point)
+	heap.distances = append(heap.distances, distanceSq)
+	i := len(heap.points) - 1
+	for i > 0 {
+		parent := (i - 1) / 2
+		if heap.distances[parent] >= heap.distances[i] {
+			break
 		}
-		splitThreshold := plane(currentNode.SplitAxis, currentNode.Domain.MiddlePoint())
-		pPos := plane(currentNode.SplitAxis, point)
-		d := splitThreshold - pPos
-		if math.Abs(d) < phR {
-			return currentNode
+		heap.swap(i, parent)
+		i = parent
+	}
+}
+
+// Replaces the farthest point, then restores the heap order
+
+func (heap *pointHeap) replaceTop(point *CameraPoint, distanceSq float64) {
+	heap.points[0] = point
+	heap.distances[0] = distanceSq
+	heap.siftDown(0, len(heap.points))
+}
+
+func (heap *pointHeap) siftDown(i, n int) {
+	for {
+		largest := i
+		if left := 2*i + 1; left < n && heap.distances[left] > heap.distances[largest] {
+			largest = left
 		}
-		if d < 0 {
-			currentNode = currentNode.Subspace2
-		} else {
-			currentNode = currentNode.Subspace1
+		if right := 2*i + 2; right < n && heap.distances[right] > heap.distances[largest] {
+			largest = right
+		}
+		if largest == i {
+			return
+		}
+		heap.swap(i, largest)
+		i = largest
+	}
+}
+
+// Heap sort, which leaves the nearest point first
+
+func (heap *pointHeap) appendSorted(result []*CameraPoint) []*CameraPoint {
+	for n := len(heap.points) - 1; n > 0; n-- {
+		heap.swap(0, n)
+		heap.siftDown(0, n)
+	}
+	return append(result, heap.points...)
+}
+
+func (heap *pointHeap) swap(i, j int) {
+	heap.points[i], heap.points[j] = heap.points[j], heap.points[i]
+	heap.distances[i], heap.distances[j] = heap.distances[j], heap.distances[i]
+}
+
+// k nearest points within maxRadius (use math.Inf(1) for no limit), appended to result nearest first
+
+func (tree *KDTreeSpace) NearestPoints(point Math.Vector3, k int, maxRadius float64, result []*CameraPoint) []*CameraPoint {
+	if k <= 0 {
+		return result
+	}
+	heap := &pointHeap{
+		points:    make([]*CameraPoint, 0, k),
+		distances: make([]float64, 0, k),
+	}
+	tree.nearestPoints(point, k, maxRadius*maxRadius, heap)
+	return heap.appendSorted(result)
+}
+
+func (tree *KDTreeSpace) nearestPoints(point Math.Vector3, k int, maxDistanceSq float64, heap *pointHeap) {
+	if len(heap.points) == k {
+		maxDistanceSq = math.Min(maxDistanceSq, heap.distances[0])
+	}
+	if len(tree.Points) == 0 || tree.distanceSq(point) > maxDistanceSq {
+		return
+	}
+	if tree.IsALeaf() {
+		for i := 0; i < len(tree.Points); i++ {
+			d := tree.Points[i].Position.Sub(point).LenSq()
+			if len(heap.points) < k {
+				if d <= maxDistanceSq {
+					heap.push(tree.Points[i], d)
+				}
+			} else if d < heap.distances[0] {
+				heap.replaceTop(tree.Points[i], d)
+			}
 		}
+		return
+	}
+	// The side of the split containing the point first, the other one is often skipped then
+	near, far := tree.Subspace1, tree.Subspace2
+	if plane(tree.SplitAxis, point) > tree.SplitValue {
+		near, far = far, near
 	}
-	return currentNode
+	near.nearestPoints(point, k, maxDistanceSq, heap)
+	far.nearestPoints(point, k, maxDistanceSq, heap)
 }
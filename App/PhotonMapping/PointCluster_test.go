@@ -0,0 +1,232 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Utils"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Synthetic camera point clouds
+
+func randomPointCloud(count int, gen *rand.Rand) []*CameraPoint {
+	points := make([]*CameraPoint, count)
+	for i := 0; i < count; i++ {
+		points[i] = &CameraPoint{Position: Math.Vector3{X: gen.Float64(), Y: gen.Float64(), Z: gen.Float64()}}
+	}
+	return points
+}
+
+// A few tight clusters far apart, so that most of the space is empty
+
+func clusteredPointCloud(count int, gen *rand.Rand) []*CameraPoint {
+	centers := randomPointCloud(5, gen)
+	points := make([]*CameraPoint, count)
+	for i := 0; i < count; i++ {
+		center := centers[gen.Intn(len(centers))].Position.FMul(10)
+		points[i] = &CameraPoint{Position: center.Add(Math.Vector3{
+			X: gen.NormFloat64() * 0.05,
+			Y: gen.NormFloat64() * 0.05,
+			Z: gen.NormFloat64() * 0.05,
+		})}
+	}
+	return points
+}
+
+// Points on a coarse lattice, so that many of them share coordinates and lie exactly on the split planes
+
+func latticePointCloud(count int, gen *rand.Rand) []*CameraPoint {
+	points := make([]*CameraPoint, count)
+	for i := 0; i < count; i++ {
+		points[i] = &CameraPoint{Position: Math.Vector3{
+			X: float64(gen.Intn(6)) * 0.2,
+			Y: float64(gen.Intn(6)) * 0.2,
+			Z: float64(gen.Intn(3)) * 0.2,
+		}}
+	}
+	return points
+}
+
+type testCloud struct {
+	name   string
+	points []*CameraPoint
+}
+
+func testClouds() []testCloud {
+	gen := rand.New(rand.NewSource(1))
+	return []testCloud{
+		{name: "random", points: randomPointCloud(3000, gen)},
+		{name: "clustered", points: clusteredPointCloud(3000, gen)},
+		{name: "lattice", points: latticePointCloud(3000, gen)},
+		{name: "single", points: randomPointCloud(1, gen)},
+		{name: "empty", points: nil},
+	}
+}
+
+type testLookup struct {
+	name   string
+	lookup CameraPointLookup
+}
+
+func testLookups(points []*CameraPoint) []testLookup {
+	return []testLookup{
+		{name: "kdtree", lookup: ConstructKDTree(points, 8, Utils.NewWorkerPool(4))},
+		{name: "grid", lookup: ConstructHashGrid(points, 0.1)},
+	}
+}
+
+// Query positions: random ones around the cloud, the cloud points themselves, and points on the split planes of the
+// K-D tree
+
+func testQueries(points []*CameraPoint, tree *KDTreeSpace, gen *rand.Rand) []Math.Vector3 {
+	var queries []Math.Vector3
+	box := getPointCloudBoundaries(points)
+	if len(points) == 0 {
+		box.Point1, box.Point2 = Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}
+	}
+	size := box.Point2.Sub(box.Point1)
+	for i := 0; i < 50; i++ {
+		queries = append(queries, box.Point1.Add(Math.Vector3{
+			X: (gen.Float64()*1.2 - 0.1) * size.X,
+			Y: (gen.Float64()*1.2 - 0.1) * size.Y,
+			Z: (gen.Float64()*1.2 - 0.1) * size.Z,
+		}))
+	}
+	for i := 0; i < len(points) && i < 50; i++ {
+		queries = append(queries, points[gen.Intn(len(points))].Position)
+	}
+	var walk func(node *KDTreeSpace)
+	walk = func(node *KDTreeSpace) {
+		if node.IsALeaf() || len(queries) > 200 {
+			return
+		}
+		query := node.Points[gen.Intn(len(node.Points))].Position
+		switch node.SplitAxis {
+		case 0:
+			query.X = node.SplitValue
+		case 1:
+			query.Y = node.SplitValue
+		default:
+			query.Z = node.SplitValue
+		}
+		queries = append(queries, query)
+		walk(node.Subspace1)
+		walk(node.Subspace2)
+	}
+	walk(tree)
+	return queries
+}
+
+func bruteForceInRadius(points []*CameraPoint, query Math.Vector3, radius float64) map[*CameraPoint]bool {
+	result := make(map[*CameraPoint]bool)
+	for _, point := range points {
+		if point.Position.Sub(query).LenSq() <= radius*radius {
+			result[point] = true
+		}
+	}
+	return result
+}
+
+// Distances of the k nearest points within maxRadius, nearest first. Points at equal distances can come in any order,
+// so the queries are compared by their distances
+
+func bruteForceNearest(points []*CameraPoint, query Math.Vector3, k int, maxRadius float64) []float64 {
+	var distances []float64
+	for _, point := range points {
+		if d := point.Position.Sub(query).LenSq(); d <= maxRadius*maxRadius {
+			distances = append(distances, d)
+		}
+	}
+	sort.Float64s(distances)
+	if len(distances) > k {
+		distances = distances[:k]
+	}
+	return distances
+}
+
+func TestPointsInRadius(t *testing.T) {
+	gen := rand.New(rand.NewSource(2))
+	for _, cloud := range testClouds() {
+		tree := ConstructKDTree(cloud.points, 8, Utils.NewWorkerPool(4))
+		queries := testQueries(cloud.points, tree, gen)
+		for _, lookup := range testLookups(cloud.points) {
+			for _, radius := range []float64{0, 0.05, 0.2, 1, math.Inf(1)} {
+				var result []*CameraPoint
+				for _, query := range queries {
+					result = lookup.lookup.PointsInRadius(query, radius, result[:0])
+					expected := bruteForceInRadius(cloud.points, query, radius)
+					found := make(map[*CameraPoint]bool)
+					for _, point := range result {
+						if found[point] {
+							t.Fatalf("%s/%s: point %v returned twice", cloud.name, lookup.name, point.Position)
+						}
+						found[point] = true
+						if !expected[point] {
+							t.Fatalf("%s/%s: point %v outside of radius %g around %v", cloud.name, lookup.name,
+								point.Position, radius, query)
+						}
+					}
+					if len(found) != len(expected) {
+						t.Fatalf("%s/%s: %d points in radius %g around %v, expected %d", cloud.name, lookup.name,
+							len(found), radius, query, len(expected))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestNearestPoints(t *testing.T) {
+	gen := rand.New(rand.NewSource(3))
+	for _, cloud := range testClouds() {
+		tree := ConstructKDTree(cloud.points, 8, Utils.NewWorkerPool(4))
+		queries := testQueries(cloud.points, tree, gen)
+		for _, lookup := range testLookups(cloud.points) {
+			for _, k := range []int{0, 1, 7, 64, len(cloud.points) + 10} {
+				for _, maxRadius := range []float64{0.05, 0.5, math.Inf(1)} {
+					var result []*CameraPoint
+					for _, query := range queries {
+						result = lookup.lookup.NearestPoints(query, k, maxRadius, result[:0])
+						expected := bruteForceNearest(cloud.points, query, k, maxRadius)
+						if len(result) != len(expected) {
+							t.Fatalf("%s/%s: %d nearest points (k %d, max radius %g) around %v, expected %d",
+								cloud.name, lookup.name, len(result), k, maxRadius, query, len(expected))
+						}
+						for i, point := range result {
+							if d := point.Position.Sub(query).LenSq(); d != expected[i] {
+								t.Fatalf("%s/%s: nearest point #%d (k %d, max radius %g) around %v at squared "+
+									"distance %g, expected %g", cloud.name, lookup.name, i, k, maxRadius, query, d,
+									expected[i])
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// The median split leaves the tree balanced, whatever the distribution
+
+func TestKDTreeBalanced(t *testing.T) {
+	for _, cloud := range testClouds() {
+		tree := ConstructKDTree(cloud.points, 8, Utils.NewWorkerPool(4))
+		var walk func(node *KDTreeSpace, depth int) int
+		walk = func(node *KDTreeSpace, depth int) int {
+			if node.IsALeaf() {
+				if len(node.Points) > 8 {
+					t.Fatalf("%s: leaf with %d points", cloud.name, len(node.Points))
+				}
+				return depth
+			}
+			if diff := len(node.Subspace1.Points) - len(node.Subspace2.Points); diff < -1 || diff > 1 {
+				t.Fatalf("%s: unbalanced split, %d and %d points", cloud.name, len(node.Subspace1.Points),
+					len(node.Subspace2.Points))
+			}
+			return max(walk(node.Subspace1, depth+1), walk(node.Subspace2, depth+1))
+		}
+		walk(tree, 0)
+	}
+}
@@ -15,10 +15,9 @@ const (
 	LightSourcePhoton = 0
 )
 
-func addPhotonToAPoint(photonColor Math.Vector3, rayDir Math.Vector3, point *CameraPoint) {
-	weight := point.Triangle.Material.SampleLight(point.Bary, point.I, rayDir,
-		point.Triangle.InterpolateNormals(point.Bary), 1, photonColor)
-	point.Color = point.Color.Add(weight)
+func addPhotonToAPoint(buffer *PhotonBuffer, photonColor Math.Vector3, rayDir Math.Vector3, point *CameraPoint) {
+	weight := point.Triangle.SampleLight(point.Bary, point.Footprint, point.I, rayDir, point.Normal, 1, photonColor)
+	buffer.Add(point, weight)
 }
 
 func rayAbsorptionDice(rayColor Math.Vector3, randGen *rand.Rand) bool {
@@ -29,9 +28,9 @@ func rayAbsorptionDice(rayColor Math.Vector3, randGen *rand.Rand) bool {
 
 // That function should be called in a separate thread
 
-func AsyncPhotonCast(scene *Structs.Scene, env *Environment, pointCloud *CameraPointCloud, firstLightSource int,
+func AsyncPhotonCast(scene *Structs.Scene, env *Environment, pointCloud *CameraPointCloud, thread, firstLightSource int,
 	handler *PhotonThreadHandler) {
-	randGen := rand.New(rand.NewSource(time.Now().UnixMilli()))
+	randGen := rand.New(rand.NewSource(time.Now().UnixNano() + int64(thread)))
 	if len(pointCloud.NonCameraPoints) == 0 {
 		handler.wg.Done()
 		return
@@ -42,11 +41,16 @@ func AsyncPhotonCast(scene *Structs.Scene, env *Environment, pointCloud *CameraP
 	settings := scene.GetSceneSettings()
 	envWindowSize := float64(settings.MaxPointsPerDomain) * 8
 	envWindow := 0.0
+	// Photons are blurred over the gathering radius anyway, so textures are filtered over the same area
+	photonFootprint := settings.PhotonRadius * 2
 	var rayOrigin Math.Vector3
 	var rayDirection Math.Vector3
 	var rayColor Math.Vector3
 	var tri *Structs.Triangle
 	var bary Math.Vector2
+	// Reused by the neighbor queries
+	var neighbors []*CameraPoint
+	buffer := NewPhotonBuffer()
 
 	for handler.busy {
 		if i == LightSourcePhoton { // The current photon is cast from a light source
@@ -68,43 +72,30 @@ func AsyncPhotonCast(scene *Structs.Scene, env *Environment, pointCloud *CameraP
 			// Selecting a random point in the cloud
 			randNum := randGen.NormFloat64()
 			rnd := int(math.Abs(randNum)*envWindowSize+envWindow) % len(pointCloud.NonCameraPoints)
-			randGen.Seed(time.Now().UnixMilli())
 			point := pointCloud.NonCameraPoints[rnd]
 			envWindow = float64(rnd % len(pointCloud.NonCameraPoints))
 			tri = point.Triangle
 			bary = point.Bary
 
-			// Point's normal
-			normal := point.Triangle.InterpolateNormals(bary)
-			// Selecting a random direction on a hemisphere (with its pole parallel to the point's normal)
-			roughness := 1 - math.Pow(tri.Material.GetRoughness(tri.InterpolateTexcoords(bary)), 2)
-			refl := point.I.Reflect(normal)
-			rayDirection = Utils.RandomPointOnHemisphere(randGen).FromSingleVectorBasis(normal.Inverse())
-			rayDirection = Math.InterpolateVector3(rayDirection, refl, roughness)
+			// The direction the environment light comes from is sampled with the BRDF of the point
+			normal := point.Normal.FaceForward(point.I)
+			rayDirection, _, _ = tri.SampleBRDF(bary, point.Footprint, point.I.Inverse(), normal,
+				Math.Vector2{U: randGen.Float64(), V: randGen.Float64()})
 			rayOrigin = point.Position
-			// We only need to know whether we hit anything or not, all other data is irrelevant
-			hit, _, _, _ := Structs.RayCast(rayDirection, rayOrigin, scene)
-			n := pointCloud.Tree.LocateNeighborPoints(point.Position, settings.PhotonRadius)
+			neighbors = pointCloud.Lookup.PointsInRadius(point.Position, settings.PhotonRadius, neighbors[:0])
 			rayColor = env.SampleEnvironment(rayDirection)
-			// Adding the environment photon to the neighboring points
-			pointCloud.Mu.Lock()
-			for j := 0; j < len(n.Points); j++ {
-				if n.Points[j].Position.Sub(rayOrigin).Len() > settings.PhotonRadius {
-					continue
-				}
-				if !hit {
-					addPhotonToAPoint(rayColor, rayDirection.Inverse(), n.Points[j])
-				}
-				n.Points[j].AccumulatedPhotons += 1
+			// The direct environment light is sampled with its own shadow ray, the photon is still counted by the
+			// neighboring points, so that the photon averages keep their weight
+			buffer.AddEnvironment(point, sampleEnvironmentLight(scene, env, point, randGen))
+			for j := 0; j < len(neighbors); j++ {
+				buffer.Add(neighbors[j], Math.Vector3{})
 			}
-			pointCloud.Mu.Unlock()
-			rayRefl := rayDirection.Inverse().Reflect(normal)
-			rayColor = point.Triangle.Material.SampleLight(point.Bary, rayRefl, rayDirection,
-				point.Triangle.InterpolateNormals(point.Bary), 1, rayColor)
-			// Ray direction for the next photon is a reflection of the current direction's inverse over the point's
-			// normal
+			// The photon then scatters on from the point, the other way around
+			wi, weight, _ := tri.SampleBRDF(bary, point.Footprint, rayDirection, normal,
+				Math.Vector2{U: randGen.Float64(), V: randGen.Float64()})
+			rayColor = rayColor.Mul(weight)
 			// And the ray origin stays the same
-			rayDirection = rayRefl
+			rayDirection = wi
 			handler.phCount.Add(1)
 		}
 
@@ -114,34 +105,45 @@ func AsyncPhotonCast(scene *Structs.Scene, env *Environment, pointCloud *CameraP
 
 		for n := settings.MaxMapperRayDepth; n >= 0 && !rayAbsorptionDice(rayColor, randGen); n-- {
 			// Cast a ray from the previously selected point
-			hit, pos, nBary, nTri := Structs.RayCast(rayDirection, rayOrigin, scene)
-			if !hit {
+			ray := Structs.Ray{Origin: rayOrigin, Direction: rayDirection, Seed: randGen.Uint64()}
+			hit, ok := scene.Intersect(ray, ray.MinT(), math.Inf(1))
+			if !ok {
 				break
 			} else {
-				normal := nTri.InterpolateNormals(nBary)
+				pos, nBary, nTri := hit.Position, hit.Barycentric, hit.Triangle
+				normal := hit.PerturbedNormal(photonFootprint)
 				// In case the ray did hit something, locate all the nearest points to the hit position
 				// And add this photon to them
-				neighbors := pointCloud.Tree.LocateNeighborPoints(pos, settings.PhotonRadius)
-				pointCloud.Mu.Lock()
-				for p := 0; p < len(neighbors.Points); p++ {
-					if neighbors.Points[p].Position.Sub(pos).Len() > settings.PhotonRadius {
-						continue
+				neighbors = pointCloud.Lookup.PointsInRadius(pos, settings.PhotonRadius, neighbors[:0])
+				// Light photons landing for the first time are direct light, which the shadow rays account for
+				direct := i == LightSourcePhoton && n == settings.MaxMapperRayDepth
+				for p := 0; p < len(neighbors); p++ {
+					if direct {
+						buffer.Add(neighbors[p], Math.Vector3{})
+					} else {
+						addPhotonToAPoint(buffer, rayColor, rayDirection, neighbors[p])
 					}
-					addPhotonToAPoint(rayColor, rayDirection, neighbors.Points[p])
-					neighbors.Points[p].AccumulatedPhotons += 1
 				}
-				pointCloud.Mu.Unlock()
-				rayRefl := rayDirection.Reflect(normal)
-				rayColor = tri.Material.SampleLight(bary, rayRefl.Inverse(), rayDirection, normal, 1, rayColor)
 				tri = nTri
 				bary = nBary
 				rayOrigin = pos
-				rayDirection = rayRefl
+				normal = normal.FaceForward(rayDirection)
+				if nTri.SampleRoughness(nBary, photonFootprint) < specularRoughness {
+					rayColor = rayColor.Mul(nTri.SampleAlbedo(nBary, photonFootprint))
+					rayDirection = rayDirection.Reflect(normal)
+				} else {
+					wi, weight, _ := nTri.SampleBRDF(nBary, photonFootprint, rayDirection.Inverse(), normal,
+						Math.Vector2{U: randGen.Float64(), V: randGen.Float64()})
+					rayColor = rayColor.Mul(weight)
+					rayDirection = wi
+				}
 				handler.phCount.Add(1)
 			}
 		}
 		i = (i + 1) % 2
+		buffer.MaybeFlush(pointCloud)
 	}
+	buffer.Flush(pointCloud)
 	Utils.LogSuccess("Exiting thread #" + strconv.Itoa(firstLightSource))
 	handler.wg.Done()
 }
@@ -0,0 +1,61 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+	"math/rand"
+)
+
+// Random walk subsurface scattering
+// At a subsurface scattering material, a share of the light (the subsurface weight) goes under the surface instead of
+// being reflected. It enters with a diffuse transmission, scatters in the medium given by the material radius and
+// color until it hits a surface from the inside and leaves there with another diffuse transmission. Camera paths and
+// photons take the same walk, picking the subsurface part at random
+
+// Walks giving up after that many scattering events are dropped
+const maxSubsurfaceSteps = 256
+
+// Whether to take the subsurface part at a hit
+
+func pickSubsurface(hit *Structs.Hit, gen *rand.Rand) bool {
+	sss := hit.Triangle.Material.GetSubsurface()
+	return sss > 0 && gen.Float64() < sss
+}
+
+// Walk from a surface point, with the normal n facing the side the light comes from. Returns the hit where the walk
+// leaves the surface, the normal facing outwards there and the walk throughput
+
+func subsurfaceWalk(scene *Structs.Scene, hit *Structs.Hit, n Math.Vector3, footprint float64, gen *rand.Rand) (Structs.Hit,
+	Math.Vector3, Math.Vector3, bool) {
+	medium := hit.Triangle.SubsurfaceMedium(hit.Barycentric, footprint)
+	origin := hit.Position
+	direction := Utils.CosineSampleHemisphere(gen.Float64(), gen.Float64()).FromSingleVectorBasis(n.Inverse())
+	throughput := Math.Vector3{X: 1, Y: 1, Z: 1}
+	// Scattering points are not on a surface, so they don't need the self intersection offset. Mean free paths are
+	// often shorter than that
+	tMin := Structs.MinHitDistance
+	for step := 0; step < maxSubsurfaceSteps; step++ {
+		exit, ok := scene.Intersect(Structs.Ray{Origin: origin, Direction: direction, Seed: gen.Uint64()}, tMin, math.Inf(1))
+		if !ok {
+			// Open mesh
+			break
+		}
+		t, weight, scattered := medium.SampleDistance(gen.Float64(), exit.T)
+		throughput = throughput.Mul(weight)
+		if !scattered {
+			return exit, exit.PerturbedNormal(footprint).FaceForward(direction).Inverse(), throughput, true
+		}
+		origin = origin.Add(direction.FMul(t))
+		tMin = 0
+		direction = medium.SamplePhase(direction, gen.Float64(), gen.Float64())
+		// Russian roulette, keeping the expected throughput the same
+		survival := math.Min(math.Max(throughput.X, math.Max(throughput.Y, throughput.Z)), 0.99)
+		if gen.Float64() >= survival {
+			break
+		}
+		throughput = throughput.FDiv(survival)
+	}
+	return Structs.Hit{}, Math.Vector3{}, Math.Vector3{}, false
+}
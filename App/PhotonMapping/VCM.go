@@ -0,0 +1,649 @@
+package PhotonMapping
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Vertex connection and merging (Georgiev et al. 2012), following the SmallVCM reference implementation
+// Every iteration traces one light subpath per pixel, connecting its vertices to the camera, then one camera subpath per
+// pixel. Camera vertices are connected to a light (next event estimation) and to the vertices of the light subpath of
+// the same index, and merged with all the light vertices within the merging radius, like photons. All the strategies
+// are weighted with the balance heuristic, using the recursive dVCM / dVC / dVM quantities carried along the subpaths.
+// The merging radius shrinks with the iterations, as in progressive photon mapping
+// BRDFs are importance sampled by the materials themselves (with their own pdfs in both directions), mirror-like
+// surfaces are treated as perfectly specular. Camera rays start at the focal point, so that the camera is a plain
+// pinhole that light subpaths can connect to
+
+// Radius reduction exponent
+const vcmRadiusAlpha = 0.75
+
+// A light source or the environment, along with the pdfs VCM needs for it
+
+type vcmLight struct {
+	light Structs.LightSource
+	// Set instead of light for the environment
+	env *Environment
+}
+
+// Point, cone and sun lights can't be hit by rays
+
+func (light vcmLight) isDelta() bool {
+	return light.env == nil
+}
+
+func (light vcmLight) isFinite() bool {
+	switch light.light.(type) {
+	case *Structs.PointLight, *Structs.ConeLight:
+		return true
+	}
+	return false
+}
+
+// Pdf of emitting a given photon (the direction, and the starting point on the scene disk for the lights outside the
+// scene), and pdf of picking the same light point with illuminate
+
+func (light vcmLight) emissionPdfs(sceneRadius float64) (float64, float64) {
+	diskPdf := 1 / (math.Pi * sceneRadius * sceneRadius)
+	if light.env != nil {
+		return diskPdf / (4 * math.Pi), 1 / (4 * math.Pi)
+	}
+	switch l := light.light.(type) {
+	case *Structs.PointLight:
+		return 1 / (4 * math.Pi), 1
+	case *Structs.ConeLight:
+		cosMax := math.Max(math.Min(l.Falloff, 1), -1)
+		return 1 / (2 * math.Pi * (1 - cosMax)), 1
+	case *Structs.SunLight:
+		return diskPdf, 1
+	}
+	Utils.LogError("VCM does not support this light source type")
+	panic("unsupported light source type")
+}
+
+// Light arriving at the point: direction and distance to the light, radiance (intensity for the delta lights), the pdf
+// of the direction (squared distance for point lights), the emission pdf of the same photon and the cosine at the light
+
+func (light vcmLight) illuminate(point Math.Vector3, sceneRadius float64, gen *rand.Rand) (Math.Vector3, float64, Math.Vector3,
+	float64, float64, float64) {
+	emissionPdfW, _ := light.emissionPdfs(sceneRadius)
+	if light.env != nil {
+		dir := Utils.UniformSampleSphere(gen.Float64(), gen.Float64())
+		return dir, math.Inf(1), light.env.SampleEnvironment(dir), 1 / (4 * math.Pi), emissionPdfW, 1
+	}
+	if sun, ok := light.light.(*Structs.SunLight); ok {
+		return sun.Direction.Normalized().Inverse(), math.Inf(1), sun.Color.FMul(sun.Intensity), 1, emissionPdfW, 1
+	}
+	toLight := light.light.GetPosition().Sub(point)
+	distanceSq := toLight.LenSq()
+	distance := math.Sqrt(distanceSq)
+	dir := toLight.FDiv(distance)
+	radiance := light.light.GetLightColor().FMul(light.light.GetLightIntensityInDirection(dir.Inverse()))
+	return dir, distance, radiance, distanceSq, emissionPdfW, 1
+}
+
+func (light vcmLight) emit(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (Math.Vector3, Math.Vector3, Math.Vector3) {
+	if light.env != nil {
+		return light.env.EmitPhoton(gen, sceneCenter, sceneRadius)
+	}
+	return light.light.EmitPhoton(gen, sceneCenter, sceneRadius)
+}
+
+// Surface point of a subpath
+
+type vcmSurface struct {
+	triangle *Structs.Triangle
+	bary     Math.Vector2
+	position Math.Vector3
+	// Shading normal, on the side of wFix
+	normal Math.Vector3
+	// Direction back along the subpath (towards the light for light subpaths)
+	wFix      Math.Vector3
+	footprint float64
+	fromLight bool
+	specular  bool
+}
+
+// BRDF value for the direction leaving the surface, the cosine at it, and the pdfs of sampling it from wFix and the
+// other way around
+
+func (surface *vcmSurface) evaluate(wGen Math.Vector3) (Math.Vector3, float64, float64, float64) {
+	cosFix := surface.wFix.Dot(surface.normal)
+	cosGen := wGen.Dot(surface.normal)
+	if surface.specular || cosFix <= 0 || cosGen <= 0 {
+		return Math.Vector3{}, 0, 0, 0
+	}
+	// The BRDFs aren't symmetric, the light always comes from the light side
+	var f Math.Vector3
+	if surface.fromLight {
+		f = surface.triangle.EvalBRDF(surface.bary, surface.footprint, wGen, surface.wFix, surface.normal).FDiv(cosFix)
+	} else {
+		f = surface.triangle.EvalBRDF(surface.bary, surface.footprint, surface.wFix, wGen, surface.normal).FDiv(cosGen)
+	}
+	pdfForward := surface.triangle.BRDFPdf(surface.bary, surface.footprint, surface.wFix, wGen, surface.normal)
+	pdfReverse := surface.triangle.BRDFPdf(surface.bary, surface.footprint, wGen, surface.wFix, surface.normal)
+	return f, cosGen, pdfForward, pdfReverse
+}
+
+// Samples the direction to continue the subpath with. Returns the direction, the throughput weight, the cosine and the
+// forward and reverse pdfs (unused for specular surfaces)
+
+func (surface *vcmSurface) sample(gen *rand.Rand) (Math.Vector3, Math.Vector3, float64, float64, float64, bool) {
+	if surface.specular {
+		wGen := surface.wFix.Inverse().Reflect(surface.normal)
+		albedo := surface.triangle.SampleAlbedo(surface.bary, surface.footprint)
+		return wGen, albedo, math.Abs(wGen.Dot(surface.normal)), 0, 0, true
+	}
+	wGen, _, _ := surface.triangle.SampleBRDF(surface.bary, surface.footprint, surface.wFix, surface.normal,
+		Math.Vector2{U: gen.Float64(), V: gen.Float64()})
+	f, cosGen, pdfForward, pdfReverse := surface.evaluate(wGen)
+	if pdfForward <= 0 {
+		return wGen, Math.Vector3{}, 0, 0, 0, false
+	}
+	return wGen, f.FMul(cosGen / pdfForward), cosGen, pdfForward, pdfReverse, true
+}
+
+type vcmPathState struct {
+	origin     Math.Vector3
+	direction  Math.Vector3
+	throughput Math.Vector3
+	pathLength int
+	// Camera subpaths count as coming from a finite light
+	isFiniteLight bool
+	dVCM          float64
+	dVC           float64
+	dVM           float64
+}
+
+// MIS update when the subpath reaches a surface
+
+func (state *vcmPathState) enter(distance, cosIn float64) {
+	if state.pathLength > 1 || state.isFiniteLight {
+		state.dVCM *= distance * distance
+	}
+	state.dVCM /= cosIn
+	state.dVC /= cosIn
+	state.dVM /= cosIn
+}
+
+type vcmVertex struct {
+	surface    vcmSurface
+	throughput Math.Vector3
+	pathLength int
+	dVCM       float64
+	dVC        float64
+	dVM        float64
+}
+
+type vcmSplat struct {
+	pixel int
+	color Math.Vector3
+}
+
+type VCMIntegrator struct {
+	Mu          sync.Mutex
+	scene       *Structs.Scene
+	env         *Environment
+	lights      []vcmLight
+	sceneCenter Math.Vector3
+	sceneRadius float64
+	width       int
+	height      int
+	// Sum of the finished iterations
+	accumulated []Math.Vector3
+	iterations  int
+	// Current iteration
+	radius          float64
+	misVMWeight     float64
+	misVCWeight     float64
+	vmNormalization float64
+	lightVertices   []vcmVertex
+	// The vertices of light subpath i are lightVertices[pathEnds[i-1]:pathEnds[i]]
+	pathEnds []int32
+	lookup   *HashGrid
+}
+
+func NewVCMIntegrator(scene *Structs.Scene, env *Environment) *VCMIntegrator {
+	return &VCMIntegrator{
+		scene: scene,
+		env:   env,
+	}
+}
+
+func (integrator *VCMIntegrator) Prepare() {
+	lights := integrator.scene.GetLightSources()
+	integrator.lights = nil
+	for i := 0; i < len(lights); i++ {
+		integrator.lights = append(integrator.lights, vcmLight{light: lights[i]})
+	}
+	if !integrator.env.plainColor || integrator.env.color.ColorGrayscale() > 0 {
+		integrator.lights = append(integrator.lights, vcmLight{env: integrator.env})
+	}
+	integrator.sceneCenter, integrator.sceneRadius = sceneBoundingSphere(integrator.scene)
+	resolution := integrator.scene.GetCamera().GetResolution()
+	integrator.width = int(resolution.U)
+	integrator.height = int(resolution.V)
+	integrator.accumulated = make([]Math.Vector3, integrator.width*integrator.height)
+	integrator.iterations = 0
+}
+
+func (integrator *VCMIntegrator) Render(handler *PhotonThreadHandler) {
+	Utils.Log("Starting async VCM")
+	handler.StartSingle(func(threads int) {
+		for handler.busy {
+			integrator.iteration(threads, handler)
+		}
+	})
+}
+
+func (integrator *VCMIntegrator) Pixel(i int) Math.Vector3 {
+	integrator.Mu.Lock()
+	defer integrator.Mu.Unlock()
+	if integrator.iterations == 0 {
+		return Math.Vector3{}
+	}
+	return integrator.accumulated[i].FDiv(float64(integrator.iterations))
+}
+
+// Renders one iteration with the given number of threads. Iterations interrupted by the handler are dropped
+
+func (integrator *VCMIntegrator) iteration(threads int, handler *PhotonThreadHandler) {
+	start := time.Now()
+	settings := integrator.scene.GetSceneSettings()
+	pathCount := integrator.width * integrator.height
+	integrator.radius = settings.PhotonRadius * math.Pow(float64(integrator.iterations+1), 0.5*(vcmRadiusAlpha-1))
+	eta := math.Pi * integrator.radius * integrator.radius * float64(pathCount)
+	integrator.misVMWeight = eta
+	integrator.misVCWeight = 1 / eta
+	integrator.vmNormalization = 1 / eta
+
+	// Light subpaths, each thread tracing a contiguous range of them
+	threadVertices := make([][]vcmVertex, threads)
+	threadEnds := make([][]int32, threads)
+	threadSplats := make([][]vcmSplat, threads)
+	var wg sync.WaitGroup
+	for thread := 0; thread < threads; thread++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gen := rand.New(rand.NewSource(time.Now().UnixNano() + int64(thread)))
+			for i := thread * pathCount / threads; i < (thread+1)*pathCount/threads; i++ {
+				threadVertices[thread], threadSplats[thread] = integrator.traceLightPath(gen, threadVertices[thread], threadSplats[thread])
+				threadEnds[thread] = append(threadEnds[thread], int32(len(threadVertices[thread])))
+			}
+		}()
+	}
+	wg.Wait()
+	if !handler.busy {
+		return
+	}
+	integrator.lightVertices = integrator.lightVertices[:0]
+	integrator.pathEnds = integrator.pathEnds[:0]
+	for thread := 0; thread < threads; thread++ {
+		offset := int32(len(integrator.lightVertices))
+		integrator.lightVertices = append(integrator.lightVertices, threadVertices[thread]...)
+		for i := 0; i < len(threadEnds[thread]); i++ {
+			integrator.pathEnds = append(integrator.pathEnds, threadEnds[thread][i]+offset)
+		}
+	}
+	// The merging lookup works on camera points, which keep the index of their vertex
+	points := make([]CameraPoint, len(integrator.lightVertices))
+	pointers := make([]*CameraPoint, len(integrator.lightVertices))
+	for i := 0; i < len(points); i++ {
+		points[i] = CameraPoint{
+			Position:           integrator.lightVertices[i].surface.position,
+			AccumulatedPhotons: i,
+		}
+		pointers[i] = &points[i]
+	}
+	integrator.lookup = ConstructHashGrid(pointers, integrator.radius*2)
+
+	// Camera subpaths, row by row
+	frame := make([]Math.Vector3, pathCount)
+	var nextRow atomic.Int64
+	for thread := 0; thread < threads; thread++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gen := rand.New(rand.NewSource(time.Now().UnixNano() + int64(thread)))
+			var neighbors []*CameraPoint
+			for y := int(nextRow.Add(1) - 1); y < integrator.height && handler.busy; y = int(nextRow.Add(1) - 1) {
+				for x := 0; x < integrator.width; x++ {
+					frame[y*integrator.width+x], neighbors = integrator.traceCameraPath(x, y, gen, neighbors)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !handler.busy {
+		return
+	}
+
+	for thread := 0; thread < threads; thread++ {
+		for i := 0; i < len(threadSplats[thread]); i++ {
+			splat := &threadSplats[thread][i]
+			frame[splat.pixel] = frame[splat.pixel].Add(splat.color)
+		}
+	}
+	integrator.Mu.Lock()
+	for i := 0; i < pathCount; i++ {
+		integrator.accumulated[i] = integrator.accumulated[i].Add(frame[i])
+	}
+	integrator.iterations++
+	integrator.Mu.Unlock()
+	Utils.LogTiming("VCM iteration #"+strconv.Itoa(integrator.iterations)+" with "+
+		strconv.Itoa(len(integrator.lightVertices))+" light vertices", start)
+}
+
+func (integrator *VCMIntegrator) traceLightPath(gen *rand.Rand, vertices []vcmVertex, splats []vcmSplat) ([]vcmVertex, []vcmSplat) {
+	if len(integrator.lights) == 0 {
+		return vertices, splats
+	}
+	scene := integrator.scene
+	settings := scene.GetSceneSettings()
+	light := integrator.lights[gen.Intn(len(integrator.lights))]
+	pickPdf := 1 / float64(len(integrator.lights))
+	origin, direction, power := light.emit(gen, integrator.sceneCenter, integrator.sceneRadius)
+	emissionPdfW, directPdf := light.emissionPdfs(integrator.sceneRadius)
+	emissionPdfW *= pickPdf
+	directPdf *= pickPdf
+
+	state := vcmPathState{
+		origin:        origin,
+		direction:     direction,
+		throughput:    power.FDiv(pickPdf),
+		pathLength:    1,
+		isFiniteLight: light.isFinite(),
+		dVCM:          directPdf / emissionPdfW,
+	}
+	// All the supported lights emit along their normal (cosine of 1)
+	if !light.isDelta() {
+		state.dVC = 1 / emissionPdfW
+	}
+	state.dVM = state.dVC * integrator.misVCWeight
+
+	// Photons are blurred over the merging radius anyway, so textures are filtered over the same area
+	footprint := settings.PhotonRadius * 2
+	for {
+		hit, ok := scene.Intersect(Structs.Ray{Origin: state.origin, Direction: state.direction, Seed: gen.Uint64()},
+			Structs.MinHitDistance, math.Inf(1))
+		if !ok {
+			break
+		}
+		n := hit.PerturbedNormal(footprint).FaceForward(state.direction)
+		cosIn := n.Dot(state.direction.Inverse())
+		if cosIn <= 0 {
+			break
+		}
+		state.enter(hit.T, cosIn)
+		surface := vcmSurface{
+			triangle:  hit.Triangle,
+			bary:      hit.Barycentric,
+			position:  hit.Position,
+			normal:    n,
+			wFix:      state.direction.Inverse(),
+			footprint: footprint,
+			fromLight: true,
+			specular:  hit.Triangle.SampleRoughness(hit.Barycentric, footprint) < specularRoughness,
+		}
+		if !surface.specular {
+			vertices = append(vertices, vcmVertex{
+				surface:    surface,
+				throughput: state.throughput,
+				pathLength: state.pathLength,
+				dVCM:       state.dVCM,
+				dVC:        state.dVC,
+				dVM:        state.dVM,
+			})
+			splats = integrator.connectToCamera(&state, &surface, splats)
+		}
+		// Connecting to the camera adds a segment
+		if state.pathLength+2 > settings.MaxPathDepth || !integrator.scatter(&state, &surface, gen) {
+			break
+		}
+		state.pathLength++
+	}
+	return vertices, splats
+}
+
+// Light tracing: connects a light vertex to the camera and splats the contribution to the pixel it is seen at
+
+func (integrator *VCMIntegrator) connectToCamera(state *vcmPathState, surface *vcmSurface, splats []vcmSplat) []vcmSplat {
+	camera := integrator.scene.GetCamera()
+	pixel, ok := camera.Project(surface.position)
+	if !ok {
+		return splats
+	}
+	focalPoint := camera.GetFocalPoint()
+	toCamera := focalPoint.Sub(surface.position)
+	distanceSq := toCamera.LenSq()
+	dir := toCamera.FDiv(math.Sqrt(distanceSq))
+	f, cosToCamera, _, pdfReverse := surface.evaluate(dir)
+	cosAtCamera := camera.ViewDirection().Dot(dir.Inverse())
+	if cosToCamera <= 0 || cosAtCamera <= 0 {
+		return splats
+	}
+
+	// Pdf of the camera generating the same vertex, per unit area
+	imagePointToCameraDistance := camera.GetImagePlaneDistance() / cosAtCamera
+	imageToSurface := imagePointToCameraDistance * imagePointToCameraDistance / cosAtCamera * cosToCamera / distanceSq
+	pathCount := float64(integrator.width * integrator.height)
+	wLight := imageToSurface / pathCount * (integrator.misVMWeight + state.dVCM + state.dVC*pdfReverse)
+	weight := 1 / (wLight + 1)
+	if integrator.scene.Occluded(surface.position, focalPoint) {
+		return splats
+	}
+	return append(splats, vcmSplat{
+		pixel: int(pixel.V)*integrator.width + int(pixel.U),
+		color: state.throughput.Mul(f).FMul(weight * imageToSurface / pathCount),
+	})
+}
+
+// Continues the subpath from the surface. Returns false if it was absorbed
+
+func (integrator *VCMIntegrator) scatter(state *vcmPathState, surface *vcmSurface, gen *rand.Rand) bool {
+	wGen, weight, cosGen, pdfForward, pdfReverse, ok := surface.sample(gen)
+	if !ok || weight.ColorGrayscale() <= 0 {
+		return false
+	}
+	if surface.specular {
+		state.dVCM = 0
+		state.dVC *= cosGen
+		state.dVM *= cosGen
+	} else {
+		state.dVC = cosGen / pdfForward * (state.dVC*pdfReverse + state.dVCM + integrator.misVMWeight)
+		state.dVM = cosGen / pdfForward * (state.dVM*pdfReverse + state.dVCM*integrator.misVCWeight + 1)
+		state.dVCM = 1 / pdfForward
+	}
+	state.origin = surface.position
+	state.direction = wGen
+	state.throughput = state.throughput.Mul(weight)
+	return true
+}
+
+func (integrator *VCMIntegrator) traceCameraPath(x, y int, gen *rand.Rand, neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	scene := integrator.scene
+	settings := scene.GetSceneSettings()
+	camera := scene.GetCamera()
+	_, direction := camera.GetCameraGrid(Math.Vector2{U: float64(x) + gen.Float64(), V: float64(y) + gen.Float64()})
+	direction = direction.Normalized()
+	cosAtCamera := camera.ViewDirection().Dot(direction)
+	imagePointToCameraDistance := camera.GetImagePlaneDistance() / cosAtCamera
+	cameraPdfW := imagePointToCameraDistance * imagePointToCameraDistance / cosAtCamera
+	state := vcmPathState{
+		origin:        camera.GetFocalPoint(),
+		direction:     direction,
+		throughput:    Math.Vector3{X: 1, Y: 1, Z: 1},
+		pathLength:    1,
+		isFiniteLight: true,
+		dVCM:          float64(integrator.width*integrator.height) / cameraPdfW,
+	}
+
+	var radiance Math.Vector3
+	var travelled float64
+	for {
+		hit, ok := scene.Intersect(Structs.Ray{Origin: state.origin, Direction: state.direction, Seed: gen.Uint64()},
+			Structs.MinHitDistance, math.Inf(1))
+		if !ok {
+			radiance = radiance.Add(state.throughput.Mul(integrator.environmentRadiance(&state)))
+			break
+		}
+		// Textures are filtered over the camera ray cone, as in the first pass
+		travelled += hit.T
+		footprint := travelled * camera.GetPixelSpreadAngle() / math.Max(math.Abs(state.direction.Dot(hit.GeometricNormal)), 0.1)
+		n := hit.PerturbedNormal(footprint).FaceForward(state.direction)
+		cosIn := n.Dot(state.direction.Inverse())
+		if cosIn <= 0 {
+			break
+		}
+		state.enter(hit.T, cosIn)
+		// Emissive triangles can only be reached this way
+		radiance = radiance.Add(state.throughput.Mul(hit.Triangle.SampleEmission(hit.Barycentric, footprint)))
+		if state.pathLength >= settings.MaxPathDepth {
+			break
+		}
+
+		surface := vcmSurface{
+			triangle:  hit.Triangle,
+			bary:      hit.Barycentric,
+			position:  hit.Position,
+			normal:    n,
+			wFix:      state.direction.Inverse(),
+			footprint: footprint,
+			specular:  hit.Triangle.SampleRoughness(hit.Barycentric, footprint) < specularRoughness,
+		}
+		if !surface.specular {
+			var contribution Math.Vector3
+			contribution = contribution.Add(integrator.directIllumination(&state, &surface, gen))
+			pathIndex := y*integrator.width + x
+			first := int32(0)
+			if pathIndex > 0 {
+				first = integrator.pathEnds[pathIndex-1]
+			}
+			for i := first; i < integrator.pathEnds[pathIndex]; i++ {
+				vertex := &integrator.lightVertices[i]
+				if vertex.pathLength+1+state.pathLength > settings.MaxPathDepth {
+					break
+				}
+				contribution = contribution.Add(vertex.throughput.Mul(integrator.connectVertices(&state, &surface, vertex)))
+			}
+			var merged Math.Vector3
+			merged, neighbors = integrator.merge(&state, &surface, neighbors)
+			contribution = contribution.Add(merged)
+			radiance = radiance.Add(state.throughput.Mul(contribution))
+		}
+
+		if !integrator.scatter(&state, &surface, gen) {
+			break
+		}
+		state.pathLength++
+	}
+	return radiance, neighbors
+}
+
+// Environment seen by a camera subpath, weighted against sampling it from the surface
+
+func (integrator *VCMIntegrator) environmentRadiance(state *vcmPathState) Math.Vector3 {
+	radiance := integrator.env.SampleEnvironment(state.direction)
+	if state.pathLength == 1 || len(integrator.lights) == 0 || integrator.lights[len(integrator.lights)-1].env == nil {
+		return radiance
+	}
+	pickPdf := 1 / float64(len(integrator.lights))
+	emissionPdfW, directPdf := vcmLight{env: integrator.env}.emissionPdfs(integrator.sceneRadius)
+	wCamera := directPdf*pickPdf*state.dVCM + emissionPdfW*pickPdf*state.dVC
+	return radiance.FDiv(1 + wCamera)
+}
+
+// Next event estimation with a random light
+
+func (integrator *VCMIntegrator) directIllumination(state *vcmPathState, surface *vcmSurface, gen *rand.Rand) Math.Vector3 {
+	if len(integrator.lights) == 0 {
+		return Math.Vector3{}
+	}
+	light := integrator.lights[gen.Intn(len(integrator.lights))]
+	pickPdf := 1 / float64(len(integrator.lights))
+	dir, distance, radiance, directPdfW, emissionPdfW, cosAtLight := light.illuminate(surface.position, integrator.sceneRadius, gen)
+	if radiance.ColorGrayscale() <= 0 {
+		return Math.Vector3{}
+	}
+	f, cosToLight, pdfForward, pdfReverse := surface.evaluate(dir)
+	if cosToLight <= 0 {
+		return Math.Vector3{}
+	}
+
+	wLight := 0.0
+	if !light.isDelta() {
+		wLight = pdfForward / (pickPdf * directPdfW)
+	}
+	wCamera := emissionPdfW * cosToLight / (directPdfW * cosAtLight) *
+		(integrator.misVMWeight + state.dVCM + state.dVC*pdfReverse)
+	weight := 1 / (wLight + 1 + wCamera)
+
+	if math.IsInf(distance, 1) {
+		ray := Structs.Ray{Origin: surface.position, Direction: dir, Seed: gen.Uint64()}
+		if integrator.scene.IntersectsAny(ray, ray.MinT(), math.Inf(1)) {
+			return Math.Vector3{}
+		}
+	} else if integrator.scene.Occluded(surface.position, surface.position.Add(dir.FMul(distance))) {
+		return Math.Vector3{}
+	}
+	return radiance.Mul(f).FMul(weight * cosToLight / (pickPdf * directPdfW))
+}
+
+// Connection between a camera and a light vertex, without the light vertex throughput
+
+func (integrator *VCMIntegrator) connectVertices(state *vcmPathState, surface *vcmSurface, vertex *vcmVertex) Math.Vector3 {
+	toLight := vertex.surface.position.Sub(surface.position)
+	distanceSq := toLight.LenSq()
+	dir := toLight.FDiv(math.Sqrt(distanceSq))
+	cameraF, cosCamera, cameraPdfForward, cameraPdfReverse := surface.evaluate(dir)
+	if cosCamera <= 0 {
+		return Math.Vector3{}
+	}
+	lightF, cosLight, lightPdfForward, lightPdfReverse := vertex.surface.evaluate(dir.Inverse())
+	if cosLight <= 0 {
+		return Math.Vector3{}
+	}
+
+	// Pdfs converted to area measure
+	cameraPdfA := cameraPdfForward * cosLight / distanceSq
+	lightPdfA := lightPdfForward * cosCamera / distanceSq
+	wLight := cameraPdfA * (integrator.misVMWeight + vertex.dVCM + vertex.dVC*lightPdfReverse)
+	wCamera := lightPdfA * (integrator.misVMWeight + state.dVCM + state.dVC*cameraPdfReverse)
+	weight := 1 / (wLight + 1 + wCamera)
+
+	if integrator.scene.Occluded(surface.position, vertex.surface.position) {
+		return Math.Vector3{}
+	}
+	return cameraF.Mul(lightF).FMul(weight * cosLight * cosCamera / distanceSq)
+}
+
+// Photon merging with all the light vertices within the radius
+
+func (integrator *VCMIntegrator) merge(state *vcmPathState, surface *vcmSurface, neighbors []*CameraPoint) (Math.Vector3, []*CameraPoint) {
+	maxPathDepth := integrator.scene.GetSceneSettings().MaxPathDepth
+	neighbors = integrator.lookup.PointsInRadius(surface.position, integrator.radius, neighbors[:0])
+	var radiance Math.Vector3
+	for i := 0; i < len(neighbors); i++ {
+		vertex := &integrator.lightVertices[neighbors[i].AccumulatedPhotons]
+		if vertex.pathLength+state.pathLength > maxPathDepth {
+			continue
+		}
+		f, cosGen, pdfForward, pdfReverse := surface.evaluate(vertex.surface.wFix)
+		if cosGen <= 0 {
+			continue
+		}
+		wLight := vertex.dVCM*integrator.misVCWeight + vertex.dVM*pdfForward
+		wCamera := state.dVCM*integrator.misVCWeight + state.dVM*pdfReverse
+		weight := 1 / (wLight + 1 + wCamera)
+		radiance = radiance.Add(f.Mul(vertex.throughput).FMul(weight))
+	}
+	return radiance.FMul(integrator.vmNormalization), neighbors
+}
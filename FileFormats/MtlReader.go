@@ -3,140 +3,431 @@ package FileFormats
 import (
 	"Photon/Math"
 	"Photon/Structs"
+	"Photon/Structs/BRDFS"
+	"Photon/Utils"
 	"bufio"
+	"math"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// Colors that can't be read (spectral or CIE XYZ ones) are skipped with a warning, so the previous color is kept
+
+func parseColor(line []string, component string) (Math.Vector3, bool) {
+	checkLen(line, 2, component)
+	r, g, b, err := tryParseColor(line)
+	if err != nil {
+		Utils.LogWarning("unsupported " + line[0] + " color \"" + strings.Join(line[1:], " ") + "\", keeping the previous one")
+		return Math.Vector3{}, false
+	}
+	return Math.Vector3{X: r, Y: g, Z: b}, true
+}
+
 func tryParseColor(line []string) (r, g, b float64, err error) {
 	r, err = strconv.ParseFloat(line[1], 64)
+	if err != nil {
+		return
+	}
+	// A single value means a gray color
+	if len(line) < 4 {
+		return r, r, r, nil
+	}
 	g, err = strconv.ParseFloat(line[2], 64)
+	if err != nil {
+		return
+	}
 	b, err = strconv.ParseFloat(line[3], 64)
 	return
 }
 
+func tryParseFloat(line []string, component string) float64 {
+	checkLen(line, 2, component)
+	v, err := strconv.ParseFloat(line[1], 64)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
 func checkLen(ln []string, desired int, component string) {
 	if len(ln) < desired {
 		panic(component + " has not enough values")
 	}
 }
 
+// Texture statements look like "map_Kd -s 2 2 1 -clamp on texture file.png". Returns the file name, its options
+// and the channel to use for grayscale textures. Besides the standard options, "-wrap repeat|mirror|clamp" and
+// "-filter nearest|bilinear|trilinear" select the sampling modes
+
+func parseTextureStatement(line []string) (string, Structs.TextureOptions, int) {
+	options := Structs.DefaultTextureOptions()
+	channel := Structs.ChannelLuminance
+	// Options with a variable number of values (-s, -o, -t) take up to 3 numbers
+	readVector := func(i int) (Math.Vector3, int) {
+		values := []float64{0, 0, 0}
+		n := 0
+		for ; n < 3 && i+n < len(line); n++ {
+			v, err := strconv.ParseFloat(line[i+n], 64)
+			if err != nil {
+				break
+			}
+			values[n] = v
+		}
+		return Math.Vector3{X: values[0], Y: values[1], Z: values[2]}, n
+	}
+	readFloat := func(i int, option string) float64 {
+		checkLen(line, i+1, option)
+		v, err := strconv.ParseFloat(line[i], 64)
+		if err != nil {
+			panic(err)
+		}
+		return v
+	}
+
+	i := 1
+	for i < len(line) && strings.HasPrefix(line[i], "-") {
+		option := strings.ToLower(line[i])
+		i++
+		switch option {
+		case "-s":
+			v, n := readVector(i)
+			if n == 1 {
+				v.Y = v.X
+			}
+			options.Scale = Math.Vector2{U: v.X, V: v.Y}
+			i += n
+		case "-o":
+			v, n := readVector(i)
+			options.Offset = Math.Vector2{U: v.X, V: v.Y}
+			i += n
+		case "-t":
+			_, n := readVector(i)
+			i += n
+		case "-clamp":
+			checkLen(line, i+1, option)
+			options.Wrap = Structs.WrapRepeat
+			if strings.ToLower(line[i]) == "on" {
+				options.Wrap = Structs.WrapClamp
+			}
+			i++
+		case "-wrap":
+			checkLen(line, i+1, option)
+			if wrap, ok := Structs.ParseWrapMode(line[i]); ok {
+				options.Wrap = wrap
+			} else {
+				Utils.LogWarning("unknown texture wrap mode " + line[i])
+			}
+			i++
+		case "-filter":
+			checkLen(line, i+1, option)
+			if filter, ok := Structs.ParseFilterMode(line[i]); ok {
+				options.Filter = filter
+			} else {
+				Utils.LogWarning("unknown texture filter " + line[i])
+			}
+			i++
+		case "-bm":
+			options.BumpMultiplier = readFloat(i, option)
+			i++
+		case "-mm":
+			options.Base = readFloat(i, option)
+			options.Gain = readFloat(i+1, option)
+			i += 2
+		case "-imfchan":
+			checkLen(line, i+1, option)
+			switch strings.ToLower(line[i]) {
+			case "r":
+				channel = Structs.ChannelRed
+			case "g":
+				channel = Structs.ChannelGreen
+			case "b":
+				channel = Structs.ChannelBlue
+			case "m":
+				channel = Structs.ChannelAlpha
+			}
+			i++
+		case "-blendu", "-blendv", "-boost", "-texres", "-cc", "-type":
+			// Not supported, the value is skipped
+			i++
+		default:
+			Utils.LogWarning("unknown texture option " + option)
+		}
+	}
+	if i >= len(line) {
+		panic(line[0] + " has no texture file")
+	}
+	// File names might contain spaces
+	return strings.Join(line[i:], " "), options, channel
+}
+
+// Medium statements can come in any order, the first one creates the medium
+
+func materialMedium(material *Structs.Material) *Structs.Medium {
+	if material.GetMedium() == nil {
+		material.SetMedium(Structs.NewMedium(Math.Vector3{}, Math.Vector3{}, 0))
+	}
+	return material.GetMedium()
+}
+
+type rgbTextureKey struct {
+	file  string
+	space Structs.ColorSpace
+}
+
+type grayscaleTextureKey struct {
+	file    string
+	channel int
+	space   Structs.ColorSpace
+}
+
 type MTLParser struct {
-	albedoTextures    map[string]*Structs.TextureRGB
-	roughnessTextures map[string]*Structs.TextureGrayscale
-	metallicTextures  map[string]*Structs.TextureGrayscale
-	Brdf              Structs.IBRDF
+	rgbTextures       map[rgbTextureKey]*Structs.TextureRGB
+	grayscaleTextures map[grayscaleTextureKey]*Structs.TextureGrayscale
+	// Color space overrides, keyed by the texture path as written in the MTL file or by its file name
+	ColorSpaces map[string]Structs.ColorSpace
+	Brdf        Structs.IBRDF
 }
 
 func (parser *MTLParser) DropTables() {
-	parser.albedoTextures = make(map[string]*Structs.TextureRGB)
-	parser.roughnessTextures = make(map[string]*Structs.TextureGrayscale)
-	parser.metallicTextures = make(map[string]*Structs.TextureGrayscale)
+	parser.rgbTextures = make(map[rgbTextureKey]*Structs.TextureRGB)
+	parser.grayscaleTextures = make(map[grayscaleTextureKey]*Structs.TextureGrayscale)
 }
 
-func (parser *MTLParser) lookupOrOpenAlbedoTexture(tex string) *Structs.TextureRGB {
-	if parser.albedoTextures[tex] != nil {
-		return parser.albedoTextures[tex]
+func (parser *MTLParser) colorSpace(tex string, fallback Structs.ColorSpace) Structs.ColorSpace {
+	if space, ok := parser.ColorSpaces[tex]; ok {
+		return space
 	}
-	otex := Structs.ReadTextureRGB(tex)
-	parser.albedoTextures[tex] = otex
-	return otex
+	if space, ok := parser.ColorSpaces[filepath.Base(tex)]; ok {
+		return space
+	}
+	return fallback
 }
 
-func (parser *MTLParser) lookupOrOpenMetallicTexture(tex string) *Structs.TextureGrayscale {
-	if parser.albedoTextures[tex] != nil {
-		return parser.metallicTextures[tex]
+// The color space is the default one for the map type, unless it is overridden
+
+func (parser *MTLParser) lookupOrOpenRGBTexture(tex string, space Structs.ColorSpace) *Structs.TextureRGB {
+	key := rgbTextureKey{tex, parser.colorSpace(tex, space)}
+	if parser.rgbTextures[key] != nil {
+		return parser.rgbTextures[key]
 	}
-	otex := Structs.ReadTextureGrayscale(tex)
-	parser.metallicTextures[tex] = otex
+	otex := Structs.ReadTextureRGBWithColorSpace(tex, key.space)
+	parser.rgbTextures[key] = otex
 	return otex
 }
 
-func (parser *MTLParser) lookupOrOpenRoughnessTexture(tex string) *Structs.TextureGrayscale {
-	if parser.albedoTextures[tex] != nil {
-		return parser.roughnessTextures[tex]
+func (parser *MTLParser) lookupOrOpenGrayscaleTexture(tex string, channel int) *Structs.TextureGrayscale {
+	key := grayscaleTextureKey{tex, channel, parser.colorSpace(tex, Structs.ColorSpaceLinear)}
+	if parser.grayscaleTextures[key] != nil {
+		return parser.grayscaleTextures[key]
 	}
-	otex := Structs.ReadTextureGrayscale(tex)
-	parser.roughnessTextures[tex] = otex
+	otex := Structs.ReadTextureGrayscaleWithColorSpace(tex, channel, key.space)
+	parser.grayscaleTextures[key] = otex
 	return otex
 }
 
+// Blender writes tangent-space normal maps as map_Bump, while height maps use the same statement everywhere else.
+// Height maps are gray, normal maps are mostly blue
+
+func isNormalMap(tex *Structs.TextureRGB) bool {
+	var deviation float64
+	samples := 0
+	for y := 0.0; y < 1; y += 1.0 / 16 {
+		for x := 0.0; x < 1; x += 1.0 / 16 {
+			c := tex.At(Math.Vector2{U: x, V: y})
+			deviation += math.Abs(c.Z-c.X) + math.Abs(c.Z-c.Y)
+			samples++
+		}
+	}
+	return deviation/float64(samples) > 0.2
+}
+
 func (parser *MTLParser) Parse(mtlFile string) map[string]*Structs.Material {
 	var parsedMaterials map[string]*Structs.Material = make(map[string]*Structs.Material)
 	var currentMaterial *Structs.Material
-	var currentMaterialName string
+	// Pr and map_Pr take priority over Ns and map_Ns, and texture maps take priority over plain values of the same kind,
+	// no matter the order
+	var roughnessSet, brdfSet bool
+	var albedoTextured, roughnessTextured, glossinessTextured, metallicTextured bool
 
 	fl, err := os.Open(mtlFile)
 	if err != nil {
 		panic(err)
 	}
+	defer fl.Close()
 	scanner := bufio.NewScanner(fl)
 
 	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), " ")
-		switch strings.ToLower(line[0]) {
-		case "newmtl": // new material
-			if currentMaterial != nil {
-				parsedMaterials[currentMaterialName] = currentMaterial
-			}
-			currentMaterial = &Structs.Material{BRDF: parser.Brdf}
-			currentMaterialName = line[1]
-			break
+		text := scanner.Text()
+		if comment := strings.IndexByte(text, '#'); comment != -1 {
+			text = text[:comment]
+		}
+		line := strings.Fields(text)
+		if len(line) == 0 {
+			continue
+		}
+		key := strings.ToLower(line[0])
+		if key == "newmtl" {
+			checkLen(line, 2, "newmtl")
+			currentMaterial = Structs.NewMaterial(parser.Brdf)
+			parsedMaterials[strings.Join(line[1:], " ")] = currentMaterial
+			roughnessSet, brdfSet = false, false
+			albedoTextured, roughnessTextured, glossinessTextured, metallicTextured = false, false, false, false
+			continue
+		}
+		if currentMaterial == nil {
+			Utils.LogWarning("MTL statement " + line[0] + " outside of a material, skipping")
+			continue
+		}
 
+		switch key {
 		case "kd": // Albedo color
-			checkLen(line, 4, "kd")
-			r, g, b, err := tryParseColor(line)
-			if err != nil {
-				panic(err)
+			if color, ok := parseColor(line, "kd"); ok && !albedoTextured {
+				currentMaterial.SetAlbedo(color)
 			}
-			currentMaterial.SetAlbedo(Math.Vector3{r, g, b})
-			break
 		case "map_kd":
-			checkLen(line, 2, "map_kd")
-			mkd := parser.lookupOrOpenAlbedoTexture(line[1])
-			currentMaterial.SetAlbedoTexture(mkd)
-			break
-
-		case "ns": // Roughness
-			checkLen(line, 2, "ns")
-			ks, err := strconv.ParseFloat(line[1], 64)
-			if err != nil {
-				panic(err)
+			file, options, _ := parseTextureStatement(line)
+			currentMaterial.SetAlbedoTextureWithOptions(parser.lookupOrOpenRGBTexture(file, Structs.ColorSpaceSRGB), options)
+			albedoTextured = true
+
+		case "ns": // Specular exponent, only used when there is no PBR roughness
+			if !roughnessSet && !roughnessTextured && !glossinessTextured {
+				ns := math.Min(math.Max(tryParseFloat(line, "ns"), 0), 1000)
+				currentMaterial.SetRoughness(1 - math.Sqrt(ns/1000))
 			}
-			currentMaterial.SetRoughness(1 - ks/1000)
-			break
-		case "map_ks":
-			checkLen(line, 2, "map_ks")
-			mks := parser.lookupOrOpenRoughnessTexture(line[1])
-			currentMaterial.SetRoughnessTexture(mks)
-			break
-
-		case "ka": // Metallic. MTL is old so Blender uses ambient light (Ka) for metallic
-			checkLen(line, 2, "ka")
-			ka, err := strconv.ParseFloat(line[1], 64)
-			if err != nil {
-				panic(err)
+		case "pr": // Roughness
+			roughness := tryParseFloat(line, "pr")
+			if !roughnessTextured {
+				currentMaterial.SetRoughness(roughness)
+			}
+			roughnessSet = true
+		case "map_pr":
+			file, options, channel := parseTextureStatement(line)
+			currentMaterial.SetRoughnessTextureWithOptions(parser.lookupOrOpenGrayscaleTexture(file, channel), options)
+			roughnessTextured = true
+		case "map_ns": // Specular exponent map, as a glossiness map, so it is inverted like Ns
+			file, options, channel := parseTextureStatement(line)
+			if !roughnessSet && !roughnessTextured {
+				options.Base, options.Gain = 1-options.Base, -options.Gain
+				currentMaterial.SetRoughnessTextureWithOptions(parser.lookupOrOpenGrayscaleTexture(file, channel), options)
 			}
-			currentMaterial.SetMetallic(ka)
-			break
-		case "map_ka":
-			checkLen(line, 2, "map_ka")
-			mka := parser.lookupOrOpenMetallicTexture(line[1])
-			currentMaterial.SetMetallicTexture(mka)
-			break
-
-		case "Ni": // IOR
-			checkLen(line, 2, "ni")
-			ni, err := strconv.ParseFloat(line[1], 64)
+			glossinessTextured = true
+
+		case "pm": // Metallic
+			metallic := tryParseFloat(line, "pm")
+			if !metallicTextured {
+				currentMaterial.SetMetallic(metallic)
+			}
+		case "map_pm":
+			file, options, channel := parseTextureStatement(line)
+			currentMaterial.SetMetallicTextureWithOptions(parser.lookupOrOpenGrayscaleTexture(file, channel), options)
+			metallicTextured = true
+
+		case "ps": // Sheen
+			currentMaterial.SetSheen(tryParseFloat(line, "ps"))
+		case "pc": // Clearcoat
+			currentMaterial.SetClearcoat(tryParseFloat(line, "pc"))
+		case "pcr":
+			currentMaterial.SetClearcoatRoughness(tryParseFloat(line, "pcr"))
+
+		case "ke": // Emission
+			if color, ok := parseColor(line, "ke"); ok {
+				currentMaterial.SetEmission(color)
+			}
+		case "map_ke":
+			file, options, _ := parseTextureStatement(line)
+			currentMaterial.SetEmissionTextureWithOptions(parser.lookupOrOpenRGBTexture(file, Structs.ColorSpaceSRGB), options)
+
+		case "norm": // Tangent-space normal map
+			file, options, _ := parseTextureStatement(line)
+			currentMaterial.SetNormalTextureWithOptions(parser.lookupOrOpenRGBTexture(file, Structs.ColorSpaceLinear), options)
+		case "map_bump", "bump":
+			file, options, channel := parseTextureStatement(line)
+			tex := parser.lookupOrOpenRGBTexture(file, Structs.ColorSpaceLinear)
+			if isNormalMap(tex) {
+				currentMaterial.SetNormalTextureWithOptions(tex, options)
+			} else {
+				currentMaterial.SetBumpTextureWithOptions(parser.lookupOrOpenGrayscaleTexture(file, channel), options)
+			}
+
+		case "d": // Dissolve
+			if len(line) > 1 && strings.ToLower(line[1]) == "-halo" {
+				// The orientation dependent dissolve is not supported, it is read as a plain one
+				Utils.LogWarning("d -halo is not supported, using a plain dissolve")
+				line = line[1:]
+			}
+			currentMaterial.SetOpacity(tryParseFloat(line, "d"))
+		case "map_d": // Alpha cutout
+			file, options, channel := parseTextureStatement(line)
+			// Images with an alpha channel use it, unless another channel is requested
+			if channel == Structs.ChannelLuminance {
+				channel = Structs.ChannelOpacity
+			}
+			currentMaterial.SetOpacityTextureWithOptions(parser.lookupOrOpenGrayscaleTexture(file, channel), options)
+		case "transmission": // Share of the light going through the surface, for the principled BSDF
+			currentMaterial.SetTransmission(tryParseFloat(line, "transmission"))
+		case "alpha_cutoff": // Alpha below which map_d lets rays through
+			currentMaterial.SetAlphaCutoff(tryParseFloat(line, "alpha_cutoff"))
+		case "tr": // Transparency
+			currentMaterial.SetOpacity(1 - tryParseFloat(line, "tr"))
+		case "illum": // Illumination model, only the ones without highlights change the BRDF, unless it is set explicitly
+			checkLen(line, 2, "illum")
+			illum, err := strconv.Atoi(line[1])
 			if err != nil {
 				panic(err)
 			}
-			currentMaterial.SetIOR(ni)
-			break
+			if !brdfSet && illum == 0 {
+				currentMaterial.SetBRDF(BRDFS.UnlitBRDF{})
+			} else if !brdfSet && illum == 1 {
+				currentMaterial.SetBRDF(BRDFS.LambertBRDF{})
+			}
+
+		case "ni": // IOR
+			currentMaterial.SetIOR(tryParseFloat(line, "ni"))
+
+		case "medium_absorption": // Medium inside the mesh, per unit length
+			if color, ok := parseColor(line, key); ok {
+				materialMedium(currentMaterial).Absorption = color
+			}
+		case "medium_scattering":
+			if color, ok := parseColor(line, key); ok {
+				materialMedium(currentMaterial).Scattering = color
+			}
+		case "medium_g": // Henyey-Greenstein asymmetry
+			materialMedium(currentMaterial).SetAsymmetry(tryParseFloat(line, "medium_g"))
+
+		case "sss": // Subsurface scattering weight
+			currentMaterial.SetSubsurface(tryParseFloat(line, "sss"))
+		case "sss_radius": // Mean free path
+			if color, ok := parseColor(line, "sss_radius"); ok {
+				currentMaterial.SetSubsurfaceRadius(color)
+			}
+		case "sss_color":
+			if color, ok := parseColor(line, "sss_color"); ok {
+				currentMaterial.SetSubsurfaceColor(color)
+			}
+
+		case "brdf": // Material model, overriding the one the parser was given
+			checkLen(line, 2, "brdf")
+			if brdf, ok := BRDFS.ByName(line[1]); ok {
+				currentMaterial.SetBRDF(brdf)
+				brdfSet = true
+			} else {
+				Utils.LogWarning("unknown BRDF " + line[1])
+			}
+
+		case "map_ks":
+			Utils.LogWarning("map_Ks is not supported, the specular color comes from the albedo and metallic")
+		case "ka", "map_ka", "ks", "tf", "sharpness", "aniso", "anisor":
+			// Legacy and unsupported statements
+		default:
+			Utils.LogWarning("unknown MTL statement " + line[0])
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
 
-	parsedMaterials[currentMaterialName] = currentMaterial
 	return parsedMaterials
 }
@@ -0,0 +1,61 @@
+package FileFormats
+
+import (
+	"Photon/Math"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestPNG(t *testing.T, file string, c color.NRGBA) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < 4; i++ {
+		img.SetNRGBA(i%2, i/2, c)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Colors that can't be read keep the previous ones, and map_d uses the alpha channel only when the image has one
+
+func TestParseMTL(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPNG(t, filepath.Join(dir, "alpha.png"), color.NRGBA{R: 255, G: 255, B: 255, A: 51})
+	writeTestPNG(t, filepath.Join(dir, "gray.png"), color.NRGBA{R: 153, G: 153, B: 153, A: 255})
+	source := "newmtl cutout\nKd 0.5 0.25 0\nKd spectral file.rfl\nKd xyz 1 1 1\nKe 1 2 3\nKe xyz 1 1 1\n" +
+		"map_d " + filepath.Join(dir, "alpha.png") + "\n" +
+		"newmtl gray\nmap_d " + filepath.Join(dir, "gray.png") + "\n"
+	file := filepath.Join(dir, "test.mtl")
+	if err := os.WriteFile(file, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parser := &MTLParser{}
+	parser.DropTables()
+	materials := parser.Parse(file)
+
+	uv := Math.Vector2{U: 0.5, V: 0.5}
+	cutout := materials["cutout"]
+	if albedo := cutout.SampleAlbedo(uv, 0); !albedo.Equal(Math.Vector3{X: 0.5, Y: 0.25}) {
+		t.Fatalf("albedo %v, expected the last readable Kd", albedo)
+	}
+	if emission := cutout.SampleEmission(uv, 0); !emission.Equal(Math.Vector3{X: 1, Y: 2, Z: 3}) {
+		t.Fatalf("emission %v, expected the last readable Ke", emission)
+	}
+	if alpha := cutout.SampleAlpha(uv, 0); math.Abs(alpha-0.2) > 1e-3 {
+		t.Fatalf("alpha %g, expected the alpha channel", alpha)
+	}
+	if alpha := materials["gray"].SampleAlpha(uv, 0); math.Abs(alpha-0.6) > 1e-3 {
+		t.Fatalf("alpha %g, expected the luminance", alpha)
+	}
+}
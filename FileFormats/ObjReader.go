@@ -3,16 +3,109 @@ package FileFormats
 import (
 	"Photon/Math"
 	"Photon/Structs"
+	"Photon/Utils"
 	"bufio"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// Wavefront OBJ reader
+// OBJ files are Y-up, while the renderer is Z-up. Swapping Y and Z mirrors the geometry, so the face winding is
+// reversed as well in order to keep the face normals pointing the same way as the vertex normals
+
+type objFaceVertex struct {
+	position int
+	texture  int
+	normal   int
+}
+
+type objFace struct {
+	vertices  []objFaceVertex
+	material  *Structs.Material
+	smoothing int
+}
+
+type objMesh struct {
+	name  string
+	faces []objFace
+}
+
 func moveToCorrectSubdir(file string) {
-	dir := strings.Split(file, "/")
-	joinedDir := strings.Join(dir[:len(dir)-1], "/")
-	os.Chdir(joinedDir)
+	dir := filepath.Dir(file)
+	if err := os.Chdir(dir); err != nil {
+		Utils.LogWarning("could not move to the model directory " + dir)
+	}
+}
+
+// OBJ indices are 1-based, negative ones are relative to the end of the current list. Returns -1 for missing indices
+
+func resolveOBJIndex(index string, count int) int {
+	if index == "" {
+		return -1
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		panic(err)
+	}
+	if i < 0 {
+		i = count + i
+	} else {
+		i -= 1
+	}
+	if i < 0 || i >= count {
+		panic("OBJ index " + index + " is out of range")
+	}
+	return i
+}
+
+func parseOBJFloats(line []string, count int, component string) []float64 {
+	checkLen(line, count+1, component)
+	values := make([]float64, count)
+	for i := 0; i < count; i++ {
+		v, err := strconv.ParseFloat(line[i+1], 64)
+		if err != nil {
+			panic(err)
+		}
+		values[i] = v
+	}
+	return values
+}
+
+// Reading lines, while dropping comments and joining lines ending with a backslash. Comments are dropped first, so a
+// backslash at the end of a comment doesn't continue it
+
+func readOBJLines(file io.Reader, handler func(line []string)) {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	var continued string
+	for scanner.Scan() {
+		text := scanner.Text()
+		if comment := strings.IndexByte(text, '#'); comment != -1 {
+			text = text[:comment]
+		}
+		text = strings.TrimRight(text, " \t\r")
+		if strings.HasSuffix(text, "\\") {
+			continued += text[:len(text)-1] + " "
+			continue
+		}
+		text = continued + text
+		continued = ""
+		line := strings.Fields(text)
+		if len(line) > 0 {
+			handler(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+	if continued != "" {
+		if line := strings.Fields(continued); len(line) > 0 {
+			handler(line)
+		}
+	}
 }
 
 func ReadOBJFile(file string, mtlReader *MTLParser) []Structs.Mesh {
@@ -22,156 +115,249 @@ func ReadOBJFile(file string, mtlReader *MTLParser) []Structs.Mesh {
 	}
 	defer objFile.Close()
 
-	objFileBuff := bufio.NewScanner(objFile)
-
 	baseDir, err := os.Getwd()
 	if err != nil {
 		panic(err)
 	}
 	moveToCorrectSubdir(file)
+	defer os.Chdir(baseDir)
+
+	Utils.Log("reading OBJ file \"" + file + "\"")
 
 	// Mesh data
-	var currentMesh *Structs.Mesh
-	var meshes []Structs.Mesh
 	var vertices []Math.Vector3
 	var textureCoords []Math.Vector2
 	var normals []Math.Vector3
-	var materialLibs map[string]map[string]*Structs.Material = make(map[string]map[string]*Structs.Material)
-	var currentLib map[string]*Structs.Material = make(map[string]*Structs.Material)
+	var meshes []*objMesh
+	var currentMesh *objMesh
+	var materialLibs = make(map[string]map[string]*Structs.Material)
+	var currentLib = make(map[string]*Structs.Material)
 	var currentMaterial *Structs.Material
-	var x, y, z float64
+	var defaultMaterial *Structs.Material
+	var objectName, groupName string
+	var smoothing int
+	fileName := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+
+	// Objects and groups both split the file into meshes. Groups that are visited again append to the same mesh
+	selectMesh := func() {
+		name := objectName
+		if groupName != "" {
+			if name != "" {
+				name += "." + groupName
+			} else {
+				name = groupName
+			}
+		}
+		if name == "" {
+			name = fileName
+		}
+		for i := 0; i < len(meshes); i++ {
+			if meshes[i].name == name {
+				currentMesh = meshes[i]
+				return
+			}
+		}
+		currentMesh = &objMesh{name: name}
+		meshes = append(meshes, currentMesh)
+	}
 
-	for objFileBuff.Scan() {
-		line := strings.Split(objFileBuff.Text(), " ")
-		lineType := line[0]
-		switch lineType {
+	readOBJLines(objFile, func(line []string) {
+		switch line[0] {
 		case "o":
-			if currentMesh != nil {
-				meshes = append(meshes, *currentMesh)
+			objectName = strings.Join(line[1:], " ")
+			groupName = ""
+			currentMesh = nil
+		case "g":
+			groupName = strings.Join(line[1:], "_")
+			if groupName == "default" {
+				groupName = ""
+			}
+			currentMesh = nil
+		case "s":
+			smoothing = 0
+			if len(line) > 1 {
+				switch strings.ToLower(line[1]) {
+				case "off": // Stays 0
+				case "on":
+					smoothing = 1
+				default:
+					if s, err := strconv.Atoi(line[1]); err == nil {
+						smoothing = s
+					} else {
+						Utils.LogWarning("unknown smoothing group " + line[1] + ", smoothing is turned off")
+					}
+				}
 			}
-			currentMesh = &Structs.Mesh{MeshName: line[1], Transform: Math.NewTransform(Math.Vector3{0, 0, 0}, Math.Vector3{0, 0, 0}, Math.Vector3{1, 1, 1})}
-			break
 		case "v": // Vertices
-			x, err = strconv.ParseFloat(line[1], 64)
-			z, err = strconv.ParseFloat(line[2], 64)
-			y, err = strconv.ParseFloat(line[3], 64)
-			if err != nil {
-				panic(err)
-			}
-			vertices = append(vertices, Math.Vector3{x, y, z})
-			break
+			v := parseOBJFloats(line, 3, "v")
+			vertices = append(vertices, Math.Vector3{X: v[0], Y: v[2], Z: v[1]})
 		case "vt": // Texture coords
-			x, err = strconv.ParseFloat(line[1], 64)
+			components := 1
 			if len(line) > 2 {
-				y, err = strconv.ParseFloat(line[2], 64)
-			} else {
-				y = 0
-			}
-			if err != nil {
-				panic(err)
+				components = 2
 			}
-			textureCoords = append(textureCoords, Math.Vector2{x, y})
-			break
+			v := append(parseOBJFloats(line, components, "vt"), 0)
+			textureCoords = append(textureCoords, Math.Vector2{U: v[0], V: v[1]})
 		case "vn":
-			x, err = strconv.ParseFloat(line[1], 64)
-			z, err = strconv.ParseFloat(line[2], 64)
-			y, err = strconv.ParseFloat(line[3], 64)
-			if err != nil {
-				panic(err)
-			}
-			normals = append(normals, Math.Vector3{x, y, z}.Normalized())
-			break
+			v := parseOBJFloats(line, 3, "vn")
+			normals = append(normals, Math.Vector3{X: v[0], Y: v[2], Z: v[1]}.Normalized())
 		case "f":
-			if len(line) >= 4 {
-				p1 := strings.Split(line[1], "/")
-				p2 := strings.Split(line[2], "/")
-				p3 := strings.Split(line[3], "/")
-				x, err = strconv.ParseFloat(p1[0], 64)
-				po1 := vertices[int(x-1)]
-				y, err = strconv.ParseFloat(p2[0], 64)
-				po2 := vertices[int(y-1)]
-				z, err = strconv.ParseFloat(p3[0], 64)
-				po3 := vertices[int(z-1)]
-				var tx1, tx2, tx3 Math.Vector2
-				var n1, n2, n3 Math.Vector3
-				if len(p1) > 1 && p1[1] != "" {
-					// First vertex texture coordinates
-					x, err = strconv.ParseFloat(p1[1], 64)
-					tx1 = textureCoords[int(x-1)]
-				}
-				if len(p2) > 1 && p2[1] != "" {
-					// Second vertex texture coordinates
-					y, err = strconv.ParseFloat(p2[1], 64)
-					tx2 = textureCoords[int(y-1)]
-				}
-				if len(p3) > 1 && p3[1] != "" {
-					// Third vertex texture coordinates
-					z, err = strconv.ParseFloat(p3[1], 64)
-					tx3 = textureCoords[int(z-1)]
-				}
-				if len(p1) > 2 && p1[2] != "" {
-					// First vertex normal
-					x, err = strconv.ParseFloat(p1[2], 64)
-					n1 = normals[int(x-1)]
-				}
-				if len(p2) > 2 && p2[2] != "" {
-					// Second vertex normal
-					y, err = strconv.ParseFloat(p2[2], 64)
-					n2 = normals[int(y-1)]
+			if len(line) < 4 {
+				Utils.LogWarning("skipping a face with less than 3 vertices")
+				return
+			}
+			face := objFace{smoothing: smoothing}
+			for i := 1; i < len(line); i++ {
+				idx := strings.Split(line[i], "/")
+				fv := objFaceVertex{
+					position: resolveOBJIndex(idx[0], len(vertices)),
+					texture:  -1,
+					normal:   -1,
 				}
-				if len(p3) > 2 && p3[2] != "" {
-					// Third vertex normal
-					z, err = strconv.ParseFloat(p3[2], 64)
-					n3 = normals[int(z-1)]
+				if fv.position == -1 {
+					panic("OBJ face vertex has no position")
 				}
-				if err != nil {
-					panic(err)
+				if len(idx) > 1 {
+					fv.texture = resolveOBJIndex(idx[1], len(textureCoords))
 				}
-				face := Structs.Triangle{
-					V1Pos:    po1,
-					V2Pos:    po2,
-					V3Pos:    po3,
-					V1Tex:    tx1,
-					V2Tex:    tx2,
-					V3Tex:    tx3,
-					V1Normal: n1,
-					V2Normal: n2,
-					V3Normal: n3,
-					Material: nil,
+				if len(idx) > 2 {
+					fv.normal = resolveOBJIndex(idx[2], len(normals))
 				}
-				face.RecalcNormal()
-				if currentMaterial == nil {
-					panic("face had no material to use")
+				face.vertices = append(face.vertices, fv)
+			}
+			if currentMaterial == nil {
+				if defaultMaterial == nil {
+					Utils.LogWarning("faces without a material found, using the default material")
+					defaultMaterial = Structs.NewMaterial(mtlReader.Brdf)
 				}
-				face.Material = currentMaterial
-				currentMesh.Triangles = append(currentMesh.Triangles, face)
-				break
+				currentMaterial = defaultMaterial
+			}
+			face.material = currentMaterial
+			if currentMesh == nil {
+				selectMesh()
 			}
+			currentMesh.faces = append(currentMesh.faces, face)
 		case "mtllib":
 			if len(line) < 2 {
-				panic("mtl file not provided")
+				Utils.LogWarning("mtllib without a file name")
+				return
 			}
-			if materialLibs[line[1]] != nil {
-				currentLib = materialLibs[line[1]]
-			} else {
-				materialLibs[line[1]] = mtlReader.Parse(line[1])
-				currentLib = materialLibs[line[1]]
+			// Multiple libraries might be listed on the same line
+			currentLib = make(map[string]*Structs.Material)
+			for i := 1; i < len(line); i++ {
+				lib := materialLibs[line[i]]
+				if lib == nil {
+					if _, err := os.Stat(line[i]); err != nil {
+						Utils.LogWarning("material library " + line[i] + " not found")
+						continue
+					}
+					lib = mtlReader.Parse(line[i])
+					materialLibs[line[i]] = lib
+				}
+				for name, mat := range lib {
+					currentLib[name] = mat
+				}
 			}
-			break
 		case "usemtl":
 			if len(line) < 2 {
-				panic("material not provided")
+				Utils.LogWarning("usemtl without a material name")
+				return
 			}
-			mat := currentLib[line[1]]
+			name := strings.Join(line[1:], " ")
+			mat := currentLib[name]
 			if mat == nil {
-				panic("material not found")
+				Utils.LogWarning("material " + name + " not found, using the default material")
+				if defaultMaterial == nil {
+					defaultMaterial = Structs.NewMaterial(mtlReader.Brdf)
+				}
+				mat = defaultMaterial
 			}
 			currentMaterial = mat
-			break
 		}
+	})
+
+	var result []Structs.Mesh
+	for i := 0; i < len(meshes); i++ {
+		mesh := buildOBJMesh(meshes[i], vertices, textureCoords, normals)
+		if len(mesh.Triangles) == 0 {
+			Utils.LogWarning("mesh " + mesh.MeshName + " has no faces, skipping")
+			continue
+		}
+		result = append(result, mesh)
+	}
+	Utils.LogSuccess("read " + strconv.Itoa(len(result)) + " meshes from " + file)
+	return result
+}
+
+type objSmoothingKey struct {
+	position  int
+	smoothing int
+}
+
+func buildOBJMesh(source *objMesh, vertices []Math.Vector3, textureCoords []Math.Vector2, normals []Math.Vector3) Structs.Mesh {
+	mesh := Structs.Mesh{
+		MeshName:  source.name,
+		Transform: Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}),
 	}
-	meshes = append(meshes, *currentMesh)
 
-	os.Chdir(baseDir)
-	return meshes
+	// Triangle corners, used for smoothing group normals later on
+	var corners [][3]objFaceVertex
+	var smoothingGroups []int
+	smoothNormals := make(map[objSmoothingKey]Math.Vector3)
+
+	for f := 0; f < len(source.faces); f++ {
+		face := &source.faces[f]
+		points := make([]Math.Vector3, len(face.vertices))
+		for i := 0; i < len(points); i++ {
+			points[i] = vertices[face.vertices[i].position]
+		}
+		for _, t := range triangulatePolygon(points) {
+			// Reversed winding, see the comment at the top of the file
+			fv := [3]objFaceVertex{face.vertices[t[0]], face.vertices[t[2]], face.vertices[t[1]]}
+			tri := Structs.Triangle{
+				V1Pos:    vertices[fv[0].position],
+				V2Pos:    vertices[fv[1].position],
+				V3Pos:    vertices[fv[2].position],
+				Material: face.material,
+			}
+			area := tri.Edge12().Cross(tri.Edge13())
+			if area.LenSq() == 0 {
+				continue
+			}
+			tri.RecalcNormal()
+			if fv[0].texture != -1 && fv[1].texture != -1 && fv[2].texture != -1 {
+				tri.V1Tex = textureCoords[fv[0].texture]
+				tri.V2Tex = textureCoords[fv[1].texture]
+				tri.V3Tex = textureCoords[fv[2].texture]
+			}
+			if fv[0].normal != -1 && fv[1].normal != -1 && fv[2].normal != -1 {
+				tri.V1Normal = normals[fv[0].normal]
+				tri.V2Normal = normals[fv[1].normal]
+				tri.V3Normal = normals[fv[2].normal]
+				tri.Smooth = true
+			} else if face.smoothing != 0 {
+				// Area-weighted normals, accumulated per position within the smoothing group
+				for i := 0; i < 3; i++ {
+					key := objSmoothingKey{fv[i].position, face.smoothing}
+					smoothNormals[key] = smoothNormals[key].Add(area)
+				}
+			}
+			mesh.Triangles = append(mesh.Triangles, tri)
+			corners = append(corners, fv)
+			smoothingGroups = append(smoothingGroups, face.smoothing)
+		}
+	}
+
+	for i := 0; i < len(mesh.Triangles); i++ {
+		tri := &mesh.Triangles[i]
+		if tri.Smooth || smoothingGroups[i] == 0 {
+			continue
+		}
+		tri.V1Normal = smoothNormals[objSmoothingKey{corners[i][0].position, smoothingGroups[i]}].Normalized()
+		tri.V2Normal = smoothNormals[objSmoothingKey{corners[i][1].position, smoothingGroups[i]}].Normalized()
+		tri.V3Normal = smoothNormals[objSmoothingKey{corners[i][2].position, smoothingGroups[i]}].Normalized()
+		tri.Smooth = true
+	}
+	mesh.CalculateTangents()
+	return mesh
 }
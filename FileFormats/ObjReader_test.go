@@ -0,0 +1,171 @@
+package FileFormats
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const objTestFold = `v 0 0 0
+v 1 0 0
+v 0 1 0
+v -1 0 1
+`
+
+var objReaderTests = []struct {
+	name      string
+	source    string
+	meshes    []string
+	triangles []int
+	// Expected face normal of every triangle and the summed area, zero ones aren't checked
+	normal Math.Vector3
+	area   float64
+	smooth bool
+	// Whether the triangles agree on the normals of the positions they share
+	shared bool
+}{
+	{
+		name:      "triangle",
+		source:    "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n",
+		meshes:    []string{"test"},
+		triangles: []int{1},
+		normal:    Math.Vector3{Y: 1},
+		area:      0.5,
+	},
+	{
+		name:      "quad",
+		source:    "v 0 0 0\nv 1 0 0\nv 1 1 0\nv 0 1 0\nf 1 2 3 4\n",
+		meshes:    []string{"test"},
+		triangles: []int{2},
+		normal:    Math.Vector3{Y: 1},
+		area:      1,
+	},
+	{
+		name:      "ngon",
+		source:    "v 2 0 0\nv 1 1.7 0\nv -1 1.7 0\nv -2 0 0\nv -1 -1.7 0\nv 1 -1.7 0\nf 1 2 3 4 5 6\n",
+		meshes:    []string{"test"},
+		triangles: []int{4},
+		normal:    Math.Vector3{Y: 1},
+		area:      10.2,
+	},
+	{
+		name:      "concave",
+		source:    "v 0 0 0\nv 2 0 0\nv 2 1 0\nv 1 1 0\nv 1 2 0\nv 0 2 0\nf 1 2 3 4 5 6\n",
+		meshes:    []string{"test"},
+		triangles: []int{4},
+		normal:    Math.Vector3{Y: 1},
+		area:      3,
+	},
+	{
+		name:      "negative indices",
+		source:    "v 5 5 5\nv 0 0 0\nv 1 0 0\nv 0 1 0\nf -3 -2 -1\nv 0 0 1\nf -5 -2 -1\n",
+		meshes:    []string{"test"},
+		triangles: []int{2},
+	},
+	{
+		name:      "continuation",
+		source:    "v 0 0 0\nv 1 \\\n0 0\nv 0 1 0\nf 1 \\\r\n2 \\\n3\n",
+		meshes:    []string{"test"},
+		triangles: []int{1},
+		normal:    Math.Vector3{Y: 1},
+	},
+	{
+		name:      "comment ending with a backslash",
+		source:    "v 0 0 0\nv 1 0 0\nv 0 1 0\n# not continued \\\nf 1 2 3\n",
+		meshes:    []string{"test"},
+		triangles: []int{1},
+	},
+	{
+		name:      "crlf",
+		source:    "v 0 0 0\r\nv 1 0 0\r\nv 0 1 0\r\nf 1 2 3\r\n",
+		meshes:    []string{"test"},
+		triangles: []int{1},
+		normal:    Math.Vector3{Y: 1},
+	},
+	{
+		name:      "smoothing on",
+		source:    objTestFold + "s on\nf 1 2 3\nf 1 3 4\n",
+		meshes:    []string{"test"},
+		triangles: []int{2},
+		smooth:    true,
+		shared:    true,
+	},
+	{
+		name:      "smoothing off",
+		source:    objTestFold + "s 1\ns off\nf 1 2 3\nf 1 3 4\n",
+		meshes:    []string{"test"},
+		triangles: []int{2},
+	},
+	{
+		name:      "smoothing groups",
+		source:    objTestFold + "s 1\nf 1 2 3\ns 2\nf 1 3 4\n",
+		meshes:    []string{"test"},
+		triangles: []int{2},
+		smooth:    true,
+	},
+	{
+		name: "groups and objects",
+		source: "v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\no a\nf 1 2 3\ng x\nf 1 2 3\ng y\nf 1 2 3\ng x\nf 1 2 3\n" +
+			"g default\nf 1 2 3\no b\ng\nf 1 2 3\n",
+		meshes:    []string{"test", "a", "a.x", "a.y", "b"},
+		triangles: []int{1, 2, 2, 1, 1},
+	},
+}
+
+func TestReadOBJFile(t *testing.T) {
+	for _, test := range objReaderTests {
+		file := filepath.Join(t.TempDir(), "test.obj")
+		if err := os.WriteFile(file, []byte(test.source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		meshes := ReadOBJFile(file, &MTLParser{})
+		if len(meshes) != len(test.meshes) {
+			t.Fatalf("%s: %d meshes, expected %d", test.name, len(meshes), len(test.meshes))
+		}
+		for i := range meshes {
+			mesh := &meshes[i]
+			if mesh.MeshName != test.meshes[i] || len(mesh.Triangles) != test.triangles[i] {
+				t.Fatalf("%s: mesh %s with %d triangles, expected %s with %d", test.name, mesh.MeshName,
+					len(mesh.Triangles), test.meshes[i], test.triangles[i])
+			}
+			checkOBJMesh(t, test.name, mesh, test.normal, test.area, test.smooth, test.shared)
+		}
+	}
+}
+
+func checkOBJMesh(t *testing.T, name string, mesh *Structs.Mesh, normal Math.Vector3, area float64, smooth, shared bool) {
+	t.Helper()
+	sum := 0.0
+	for i := range mesh.Triangles {
+		tri := &mesh.Triangles[i]
+		sum += tri.Edge12().Cross(tri.Edge13()).Len() / 2
+		// The winding has to agree with the stored face normal
+		if tri.Edge12().Cross(tri.Edge13()).Dot(tri.TriangleNormal) <= 0 {
+			t.Fatalf("%s: triangle %d is wound against its normal", name, i)
+		}
+		if normal.LenSq() > 0 && tri.TriangleNormal.Sub(normal).Len() > 1e-9 {
+			t.Fatalf("%s: triangle %d normal %v, expected %v", name, i, tri.TriangleNormal, normal)
+		}
+		if tri.Smooth != smooth {
+			t.Fatalf("%s: triangle %d smooth is %v", name, i, tri.Smooth)
+		}
+	}
+	if area > 0 && math.Abs(sum-area) > 1e-9 {
+		t.Fatalf("%s: area %g, expected %g", name, sum, area)
+	}
+	if !smooth {
+		return
+	}
+
+	// The first two triangles share their first vertex
+	a, b := &mesh.Triangles[0], &mesh.Triangles[1]
+	if !a.V1Pos.Equal(b.V1Pos) {
+		t.Fatalf("%s: the triangles don't start at the same vertex", name)
+	}
+	if equal := a.V1Normal.Sub(b.V1Normal).Len() < 1e-9; equal != shared {
+		t.Fatalf("%s: shared vertex normals %v and %v", name, a.V1Normal, b.V1Normal)
+	}
+}
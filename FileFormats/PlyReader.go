@@ -0,0 +1,362 @@
+package FileFormats
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PLY (Stanford polygon file) reader
+// Supports ascii, binary_little_endian and binary_big_endian files. Only the "vertex" and "face" elements are used,
+// all the other elements are read and thrown away
+
+const (
+	plyASCII = iota
+	plyBinaryLittleEndian
+	plyBinaryBigEndian
+)
+
+type plyProperty struct {
+	name      string
+	dataType  string
+	isList    bool
+	countType string
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+func (element *plyElement) propertyIndex(names ...string) int {
+	for _, name := range names {
+		for i := 0; i < len(element.properties); i++ {
+			if element.properties[i].name == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Value readers. Every value is returned as float64, since that's what we need anyway
+
+type plyValueReader interface {
+	read(dataType string) float64
+}
+
+type plyASCIIReader struct {
+	scanner *bufio.Scanner
+}
+
+func (reader *plyASCIIReader) read(dataType string) float64 {
+	if !reader.scanner.Scan() {
+		panic("unexpected end of PLY data")
+	}
+	v, err := strconv.ParseFloat(reader.scanner.Text(), 64)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+type plyBinaryReader struct {
+	reader io.Reader
+	order  binary.ByteOrder
+	buf    [8]byte
+}
+
+func (reader *plyBinaryReader) read(dataType string) float64 {
+	size := plyTypeSize(dataType)
+	b := reader.buf[:size]
+	if _, err := io.ReadFull(reader.reader, b); err != nil {
+		panic(err)
+	}
+	switch dataType {
+	case "char", "int8":
+		return float64(int8(b[0]))
+	case "uchar", "uint8":
+		return float64(b[0])
+	case "short", "int16":
+		return float64(int16(reader.order.Uint16(b)))
+	case "ushort", "uint16":
+		return float64(reader.order.Uint16(b))
+	case "int", "int32":
+		return float64(int32(reader.order.Uint32(b)))
+	case "uint", "uint32":
+		return float64(reader.order.Uint32(b))
+	case "float", "float32":
+		return float64(math.Float32frombits(reader.order.Uint32(b)))
+	case "double", "float64":
+		return math.Float64frombits(reader.order.Uint64(b))
+	}
+	panic("unknown PLY data type " + dataType)
+}
+
+func plyTypeSize(dataType string) int {
+	switch dataType {
+	case "char", "int8", "uchar", "uint8":
+		return 1
+	case "short", "int16", "ushort", "uint16":
+		return 2
+	case "int", "int32", "uint", "uint32", "float", "float32":
+		return 4
+	case "double", "float64":
+		return 8
+	}
+	panic("unknown PLY data type " + dataType)
+}
+
+// Integer color channels are normalized to [0;1], float ones are used as is
+
+func plyColorScale(dataType string) float64 {
+	switch dataType {
+	case "uchar", "uint8", "char", "int8":
+		return 1.0 / 255
+	case "ushort", "uint16", "short", "int16":
+		return 1.0 / 65535
+	}
+	return 1
+}
+
+func readPLYHeader(reader *bufio.Reader) (int, []plyElement) {
+	magic, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(magic) != "ply" {
+		panic("not a PLY file")
+	}
+	format := -1
+	var elements []plyElement
+	for {
+		ln, err := reader.ReadString('\n')
+		if err != nil {
+			panic("unexpected end of PLY header")
+		}
+		line := strings.Fields(ln)
+		if len(line) == 0 {
+			continue
+		}
+		switch line[0] {
+		case "format":
+			checkLen(line, 2, "format")
+			switch line[1] {
+			case "ascii":
+				format = plyASCII
+			case "binary_little_endian":
+				format = plyBinaryLittleEndian
+			case "binary_big_endian":
+				format = plyBinaryBigEndian
+			default:
+				panic("unknown PLY format " + line[1])
+			}
+		case "element":
+			checkLen(line, 3, "element")
+			count, err := strconv.Atoi(line[2])
+			if err != nil {
+				panic(err)
+			}
+			elements = append(elements, plyElement{name: line[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				panic("PLY property declared outside of an element")
+			}
+			element := &elements[len(elements)-1]
+			if len(line) >= 5 && line[1] == "list" {
+				element.properties = append(element.properties, plyProperty{
+					name:      line[4],
+					dataType:  line[3],
+					isList:    true,
+					countType: line[2],
+				})
+			} else {
+				checkLen(line, 3, "property")
+				element.properties = append(element.properties, plyProperty{name: line[2], dataType: line[1]})
+			}
+		case "end_header":
+			if format == -1 {
+				panic("PLY format not specified")
+			}
+			return format, elements
+		}
+		// comment and obj_info lines are skipped
+	}
+}
+
+func ReadPLYFile(file string, brdf Structs.IBRDF) []Structs.Mesh {
+	plyFile, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer plyFile.Close()
+
+	Utils.Log("reading PLY file \"" + file + "\"")
+	buffered := bufio.NewReader(plyFile)
+	format, elements := readPLYHeader(buffered)
+
+	var valueReader plyValueReader
+	switch format {
+	case plyASCII:
+		scanner := bufio.NewScanner(buffered)
+		scanner.Split(bufio.ScanWords)
+		valueReader = &plyASCIIReader{scanner: scanner}
+	case plyBinaryLittleEndian:
+		valueReader = &plyBinaryReader{reader: buffered, order: binary.LittleEndian}
+	case plyBinaryBigEndian:
+		valueReader = &plyBinaryReader{reader: buffered, order: binary.BigEndian}
+	}
+
+	// Vertex data
+	var positions []Math.Vector3
+	var normals []Math.Vector3
+	var colors []Math.Vector3
+	var texCoords []Math.Vector2
+	var faces [][]int
+
+	for e := 0; e < len(elements); e++ {
+		element := &elements[e]
+		values := make([]float64, len(element.properties))
+		lists := make([][]float64, len(element.properties))
+
+		x, y, z := element.propertyIndex("x"), element.propertyIndex("y"), element.propertyIndex("z")
+		nx, ny, nz := element.propertyIndex("nx"), element.propertyIndex("ny"), element.propertyIndex("nz")
+		r := element.propertyIndex("red", "r", "diffuse_red")
+		g := element.propertyIndex("green", "g", "diffuse_green")
+		b := element.propertyIndex("blue", "b", "diffuse_blue")
+		u := element.propertyIndex("u", "s", "texture_u", "texture_s")
+		v := element.propertyIndex("v", "t", "texture_v", "texture_t")
+		indices := element.propertyIndex("vertex_indices", "vertex_index")
+		hasNormals := nx != -1 && ny != -1 && nz != -1
+		hasColors := r != -1 && g != -1 && b != -1
+		hasTexCoords := u != -1 && v != -1
+
+		if element.name == "vertex" && (x == -1 || y == -1 || z == -1) {
+			panic("PLY vertex element has no position")
+		}
+		if element.name == "face" && indices == -1 {
+			panic("PLY face element has no vertex indices")
+		}
+
+		for i := 0; i < element.count; i++ {
+			for p := 0; p < len(element.properties); p++ {
+				property := element.properties[p]
+				if !property.isList {
+					values[p] = valueReader.read(property.dataType)
+					continue
+				}
+				count := int(valueReader.read(property.countType))
+				lists[p] = lists[p][:0]
+				for j := 0; j < count; j++ {
+					lists[p] = append(lists[p], valueReader.read(property.dataType))
+				}
+			}
+
+			switch element.name {
+			case "vertex":
+				// PLY files are Y-up like OBJ ones, so Y and Z are swapped the same way
+				positions = append(positions, Math.Vector3{X: values[x], Y: values[z], Z: values[y]})
+				if hasNormals {
+					normals = append(normals, Math.Vector3{X: values[nx], Y: values[nz], Z: values[ny]}.Normalized())
+				}
+				if hasColors {
+					colors = append(colors, Math.Vector3{
+						X: values[r] * plyColorScale(element.properties[r].dataType),
+						Y: values[g] * plyColorScale(element.properties[g].dataType),
+						Z: values[b] * plyColorScale(element.properties[b].dataType),
+					})
+				}
+				if hasTexCoords {
+					texCoords = append(texCoords, Math.Vector2{U: values[u], V: values[v]})
+				}
+			case "face":
+				face := make([]int, len(lists[indices]))
+				for j := 0; j < len(face); j++ {
+					face[j] = int(lists[indices][j])
+				}
+				faces = append(faces, face)
+			}
+		}
+	}
+
+	material := Structs.NewMaterial(brdf)
+	if len(colors) > 0 {
+		material.SetAlbedo(Math.Vector3{X: 1, Y: 1, Z: 1})
+		material.SetVertexColorsUsed(true)
+	}
+
+	mesh := Structs.Mesh{
+		MeshName:  strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		Transform: Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}),
+	}
+	skipped := 0
+
+	vertex := func(tri *Structs.Triangle, corner int, idx int) {
+		var pos, normal, color Math.Vector3
+		var tex Math.Vector2
+		pos = positions[idx]
+		if len(normals) > 0 {
+			normal = normals[idx]
+		}
+		if len(colors) > 0 {
+			color = colors[idx]
+		}
+		if len(texCoords) > 0 {
+			tex = texCoords[idx]
+		}
+		switch corner {
+		case 0:
+			tri.V1Pos, tri.V1Normal, tri.V1Color, tri.V1Tex = pos, normal, color, tex
+		case 1:
+			tri.V2Pos, tri.V2Normal, tri.V2Color, tri.V2Tex = pos, normal, color, tex
+		case 2:
+			tri.V3Pos, tri.V3Normal, tri.V3Color, tri.V3Tex = pos, normal, color, tex
+		}
+	}
+
+	for f := 0; f < len(faces); f++ {
+		face := faces[f]
+		points := make([]Math.Vector3, len(face))
+		for j := 0; j < len(face); j++ {
+			if face[j] < 0 || face[j] >= len(positions) {
+				panic("PLY face references a missing vertex")
+			}
+			points[j] = positions[face[j]]
+		}
+		for _, t := range triangulatePolygon(points) {
+			tri := Structs.Triangle{
+				Smooth:   len(normals) > 0,
+				Material: material,
+			}
+			vertex(&tri, 0, face[t[0]])
+			vertex(&tri, 1, face[t[1]])
+			vertex(&tri, 2, face[t[2]])
+			if tri.Edge12().Cross(tri.Edge13()).LenSq() == 0 {
+				skipped++
+				continue
+			}
+			tri.RecalcNormal()
+			mesh.Triangles = append(mesh.Triangles, tri)
+		}
+	}
+
+	if len(texCoords) > 0 {
+		mesh.CalculateTangents()
+	}
+	if skipped > 0 {
+		Utils.LogWarning(strconv.Itoa(skipped) + " degenerate triangles skipped in " + file)
+	}
+	if len(mesh.Triangles) == 0 {
+		// Point clouds have no faces at all
+		Utils.LogWarning("mesh " + mesh.MeshName + " has no faces, skipping")
+		return nil
+	}
+	Utils.LogSuccess("read " + strconv.Itoa(len(mesh.Triangles)) + " triangles from " + file)
+	return []Structs.Mesh{mesh}
+}
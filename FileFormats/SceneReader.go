@@ -0,0 +1,107 @@
+package FileFormats
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// JSON scene description
+// Model and environment paths are relative to the scene file. Texture color space overrides are keyed by the texture
+// path as written in the MTL file, or by its file name. Instances place loaded meshes again (rotation is in degrees),
+// hidden meshes are only used through their instances. The optional medium fills the whole scene (coefficients are per
+// unit length):
+//
+//	{
+//		"models": ["room.obj", "chair.obj"],
+//		"environment": "sky.hdr",
+//		"textures": {"wood_albedo.png": "linear", "terrain_height.png": "srgb"},
+//		"instances": [{"name": "Chair.001", "mesh": "Chair", "position": [1, 0, 0], "rotation": [0, 0, 90]}],
+//		"hidden": ["Chair"],
+//		"medium": {"absorption": [0.01, 0.01, 0.01], "scattering": [0.1, 0.1, 0.1], "g": 0.3}
+//	}
+
+type SceneInstance struct {
+	Name     string      `json:"name"`
+	Mesh     string      `json:"mesh"`
+	Position [3]float64  `json:"position"`
+	Rotation [3]float64  `json:"rotation"`
+	Scale    *[3]float64 `json:"scale"`
+}
+
+type SceneMedium struct {
+	Absorption [3]float64 `json:"absorption"`
+	Scattering [3]float64 `json:"scattering"`
+	G          float64    `json:"g"`
+}
+
+type SceneFile struct {
+	Models           []string          `json:"models"`
+	Environment      string            `json:"environment"`
+	EnvironmentColor *[3]float64       `json:"environmentColor"`
+	Textures         map[string]string `json:"textures"`
+	Instances        []SceneInstance   `json:"instances"`
+	Hidden           []string          `json:"hidden"`
+	Medium           *SceneMedium      `json:"medium"`
+}
+
+func (instance *SceneInstance) GetTransform() *Math.Transform {
+	scale := Math.Vector3{X: 1, Y: 1, Z: 1}
+	if instance.Scale != nil {
+		scale = Math.Vector3{X: instance.Scale[0], Y: instance.Scale[1], Z: instance.Scale[2]}
+	}
+	return Math.NewTransform(
+		Math.Vector3{X: instance.Position[0], Y: instance.Position[1], Z: instance.Position[2]},
+		Math.Vector3{
+			X: Math.DegToRad(instance.Rotation[0]),
+			Y: Math.DegToRad(instance.Rotation[1]),
+			Z: Math.DegToRad(instance.Rotation[2]),
+		},
+		scale,
+	)
+}
+
+func (medium *SceneMedium) GetMedium() *Structs.Medium {
+	return Structs.NewMedium(
+		Math.Vector3{X: medium.Absorption[0], Y: medium.Absorption[1], Z: medium.Absorption[2]},
+		Math.Vector3{X: medium.Scattering[0], Y: medium.Scattering[1], Z: medium.Scattering[2]},
+		medium.G,
+	)
+}
+
+func ReadSceneFile(file string) *SceneFile {
+	Utils.Log("reading scene file \"" + file + "\"")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	scene := &SceneFile{}
+	if err := json.Unmarshal(data, scene); err != nil {
+		Utils.LogError("could not parse scene file " + file)
+		panic(err)
+	}
+
+	dir := filepath.Dir(file)
+	for i := 0; i < len(scene.Models); i++ {
+		scene.Models[i] = resolveScenePath(dir, scene.Models[i])
+	}
+	if scene.Environment != "" {
+		scene.Environment = resolveScenePath(dir, scene.Environment)
+	}
+	for i := 0; i < len(scene.Instances); i++ {
+		if scene.Instances[i].Mesh == "" {
+			panic("scene instance without a mesh")
+		}
+	}
+	return scene
+}
+
+func resolveScenePath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,190 @@
+package FileFormats
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// STL reader (both ascii and binary)
+// STL has no vertex normals, texture coordinates or materials, so all the triangles are flat shaded and share one
+// default material. STL files usually come from CAD tools, which are Z-up like the renderer, so unlike OBJ and PLY
+// the coordinates are kept as they are
+
+const (
+	stlHeaderSize = 80
+	stlRecordSize = 50
+)
+
+func isBinarySTL(data []byte) bool {
+	if len(data) < stlHeaderSize+4 {
+		return false
+	}
+	// Some exporters write "solid" into the binary header as well, so the size check has the last word
+	count := binary.LittleEndian.Uint32(data[stlHeaderSize : stlHeaderSize+4])
+	if uint64(len(data)) == stlHeaderSize+4+uint64(count)*stlRecordSize {
+		return true
+	}
+	return !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("solid"))
+}
+
+// The facet normal is only used to fix the winding, since a lot of exporters write zero or garbage normals
+
+func stlTriangle(v1, v2, v3, facetNormal Math.Vector3, material *Structs.Material) (Structs.Triangle, bool) {
+	tri := Structs.Triangle{
+		V1Pos:    v1,
+		V2Pos:    v2,
+		V3Pos:    v3,
+		Material: material,
+	}
+	if tri.Edge12().Cross(tri.Edge13()).LenSq() == 0 {
+		return tri, false
+	}
+	tri.RecalcNormal()
+	if tri.TriangleNormal.Dot(facetNormal) < 0 {
+		tri.V2Pos, tri.V3Pos = tri.V3Pos, tri.V2Pos
+		tri.RecalcNormal()
+	}
+	return tri, true
+}
+
+func readBinarySTL(data []byte, name string, material *Structs.Material) []Structs.Mesh {
+	count := int(binary.LittleEndian.Uint32(data[stlHeaderSize : stlHeaderSize+4]))
+	if len(data) < stlHeaderSize+4+count*stlRecordSize {
+		panic("binary STL file is truncated")
+	}
+	readVec := func(offset int) Math.Vector3 {
+		return Math.Vector3{
+			X: float64(math.Float32frombits(binary.LittleEndian.Uint32(data[offset:]))),
+			Y: float64(math.Float32frombits(binary.LittleEndian.Uint32(data[offset+4:]))),
+			Z: float64(math.Float32frombits(binary.LittleEndian.Uint32(data[offset+8:]))),
+		}
+	}
+	mesh := Structs.Mesh{
+		MeshName:  name,
+		Transform: Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}),
+		Triangles: make([]Structs.Triangle, 0, count),
+	}
+	for i := 0; i < count; i++ {
+		offset := stlHeaderSize + 4 + i*stlRecordSize
+		tri, ok := stlTriangle(readVec(offset+12), readVec(offset+24), readVec(offset+36), readVec(offset), material)
+		if ok {
+			mesh.Triangles = append(mesh.Triangles, tri)
+		}
+	}
+	if skipped := count - len(mesh.Triangles); skipped > 0 {
+		Utils.LogWarning(strconv.Itoa(skipped) + " degenerate triangles skipped in " + name)
+	}
+	return []Structs.Mesh{mesh}
+}
+
+func readASCIISTL(data []byte, name string, material *Structs.Material) []Structs.Mesh {
+	var meshes []Structs.Mesh
+	var currentMesh *Structs.Mesh
+	var facetNormal Math.Vector3
+	var vertices []Math.Vector3
+	parseVec := func(line []string) Math.Vector3 {
+		x, err := strconv.ParseFloat(line[0], 64)
+		if err != nil {
+			panic(err)
+		}
+		y, err := strconv.ParseFloat(line[1], 64)
+		if err != nil {
+			panic(err)
+		}
+		z, err := strconv.ParseFloat(line[2], 64)
+		if err != nil {
+			panic(err)
+		}
+		return Math.Vector3{X: x, Y: y, Z: z}
+	}
+	meshName := func(line []string) string {
+		if len(line) > 1 {
+			return strings.Join(line[1:], " ")
+		}
+		return name
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.Fields(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		switch strings.ToLower(line[0]) {
+		case "solid":
+			meshes = append(meshes, Structs.Mesh{
+				MeshName:  meshName(line),
+				Transform: Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}),
+			})
+			currentMesh = &meshes[len(meshes)-1]
+		case "facet":
+			checkLen(line, 5, "facet normal")
+			facetNormal = parseVec(line[2:])
+			vertices = vertices[:0]
+		case "vertex":
+			checkLen(line, 4, "vertex")
+			vertices = append(vertices, parseVec(line[1:]))
+		case "endfacet":
+			if currentMesh == nil {
+				panic("STL facet outside of a solid")
+			}
+			// Facets are supposed to be triangles, but just in case
+			for j := 1; j+1 < len(vertices); j++ {
+				tri, ok := stlTriangle(vertices[0], vertices[j], vertices[j+1], facetNormal, material)
+				if ok {
+					currentMesh.Triangles = append(currentMesh.Triangles, tri)
+				}
+			}
+		}
+	}
+
+	// Multiple solids in one file might share a name, which the scene doesn't allow
+	for i := 1; i < len(meshes); i++ {
+		for j := 0; j < i; j++ {
+			if meshes[i].MeshName == meshes[j].MeshName {
+				meshes[i].MeshName = Utils.IncrementName(meshes[i].MeshName)
+				j = -1
+			}
+		}
+	}
+	return meshes
+}
+
+func ReadSTLFile(file string, brdf Structs.IBRDF) []Structs.Mesh {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+
+	Utils.Log("reading STL file \"" + file + "\"")
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	material := Structs.NewMaterial(brdf)
+	var meshes []Structs.Mesh
+	if isBinarySTL(data) {
+		meshes = readBinarySTL(data, name, material)
+	} else {
+		meshes = readASCIISTL(data, name, material)
+	}
+	if len(meshes) == 0 {
+		panic("no solids found in " + file)
+	}
+	var result []Structs.Mesh
+	for i := 0; i < len(meshes); i++ {
+		if len(meshes[i].Triangles) == 0 {
+			Utils.LogWarning("solid " + meshes[i].MeshName + " has no faces, skipping")
+			continue
+		}
+		result = append(result, meshes[i])
+	}
+	Utils.LogSuccess("read " + strconv.Itoa(len(result)) + " solids from " + file)
+	return result
+}
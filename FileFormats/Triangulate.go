@@ -0,0 +1,132 @@
+package FileFormats
+
+import (
+	"Photon/Math"
+	"math"
+)
+
+// Polygon triangulation shared by the mesh readers
+// Convex polygons are fan-triangulated, concave ones are ear-clipped in the plane of the polygon. Returns triplets of
+// indices into the points array
+
+func triangulatePolygon(points []Math.Vector3) [][3]int {
+	if len(points) < 3 {
+		return nil
+	}
+	if len(points) == 3 {
+		return [][3]int{{0, 1, 2}}
+	}
+
+	// Projecting the polygon onto the plane of its dominant axis (Newell's method for the normal)
+	var normal Math.Vector3
+	for i := 0; i < len(points); i++ {
+		c := points[i]
+		n := points[(i+1)%len(points)]
+		normal.X += (c.Y - n.Y) * (c.Z + n.Z)
+		normal.Y += (c.Z - n.Z) * (c.X + n.X)
+		normal.Z += (c.X - n.X) * (c.Y + n.Y)
+	}
+	// The projection axes are picked in cyclic order, so a polygon that is counter-clockwise around the normal stays
+	// counter-clockwise when projected
+	abs := normal.Abs()
+	projected := make([]Math.Vector2, len(points))
+	var axisNormal float64
+	for i := 0; i < len(points); i++ {
+		switch {
+		case abs.X >= abs.Y && abs.X >= abs.Z:
+			projected[i] = Math.Vector2{U: points[i].Y, V: points[i].Z}
+			axisNormal = normal.X
+		case abs.Y >= abs.Z:
+			projected[i] = Math.Vector2{U: points[i].Z, V: points[i].X}
+			axisNormal = normal.Y
+		default:
+			projected[i] = Math.Vector2{U: points[i].X, V: points[i].Y}
+			axisNormal = normal.Z
+		}
+	}
+	if axisNormal < 0 {
+		for i := 0; i < len(projected); i++ {
+			projected[i].U = -projected[i].U
+		}
+	}
+
+	if isConvex(projected) {
+		return fanTriangulation(len(points))
+	}
+	triangles := earClipping(projected)
+	if triangles == nil {
+		// Self-intersecting or otherwise broken polygon, a fan is the best we can do
+		return fanTriangulation(len(points))
+	}
+	return triangles
+}
+
+func fanTriangulation(n int) [][3]int {
+	triangles := make([][3]int, 0, n-2)
+	for i := 1; i+1 < n; i++ {
+		triangles = append(triangles, [3]int{0, i, i + 1})
+	}
+	return triangles
+}
+
+func cross2(o, a, b Math.Vector2) float64 {
+	return (a.U-o.U)*(b.V-o.V) - (a.V-o.V)*(b.U-o.U)
+}
+
+func isConvex(polygon []Math.Vector2) bool {
+	for i := 0; i < len(polygon); i++ {
+		if cross2(polygon[i], polygon[(i+1)%len(polygon)], polygon[(i+2)%len(polygon)]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func pointInTriangle(p, a, b, c Math.Vector2) bool {
+	return cross2(a, b, p) >= 0 && cross2(b, c, p) >= 0 && cross2(c, a, p) >= 0
+}
+
+func earClipping(polygon []Math.Vector2) [][3]int {
+	remaining := make([]int, len(polygon))
+	for i := 0; i < len(remaining); i++ {
+		remaining[i] = i
+	}
+	var triangles [][3]int
+	for len(remaining) > 3 {
+		earFound := false
+		for i := 0; i < len(remaining); i++ {
+			prev := remaining[(i+len(remaining)-1)%len(remaining)]
+			curr := remaining[i]
+			next := remaining[(i+1)%len(remaining)]
+			a, b, c := polygon[prev], polygon[curr], polygon[next]
+			if cross2(a, b, c) <= 0 {
+				// Reflex (or degenerate) vertex, can't be an ear
+				continue
+			}
+			isEar := true
+			for j := 0; j < len(remaining); j++ {
+				other := remaining[j]
+				if other == prev || other == curr || other == next {
+					continue
+				}
+				if pointInTriangle(polygon[other], a, b, c) {
+					isEar = false
+					break
+				}
+			}
+			if isEar {
+				triangles = append(triangles, [3]int{prev, curr, next})
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				earFound = true
+				break
+			}
+		}
+		if !earFound {
+			return nil
+		}
+	}
+	if math.Abs(cross2(polygon[remaining[0]], polygon[remaining[1]], polygon[remaining[2]])) > 0 {
+		triangles = append(triangles, [3]int{remaining[0], remaining[1], remaining[2]})
+	}
+	return triangles
+}
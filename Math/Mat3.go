@@ -108,3 +108,40 @@ func (m Mat3) VecMul(o Vector3) Vector3 {
 		Z: o.X*m.Matrix[6] + o.Y*m.Matrix[7] + o.Z*m.Matrix[8],
 	}
 }
+
+func (m Mat3) Transposed() Mat3 {
+	return Mat3{[9]float64{
+		m.Matrix[0], m.Matrix[3], m.Matrix[6],
+		m.Matrix[1], m.Matrix[4], m.Matrix[7],
+		m.Matrix[2], m.Matrix[5], m.Matrix[8],
+	},
+	}
+}
+
+func (m Mat3) Determinant() float64 {
+	return m.Matrix[0]*(m.Matrix[4]*m.Matrix[8]-m.Matrix[5]*m.Matrix[7]) -
+		m.Matrix[1]*(m.Matrix[3]*m.Matrix[8]-m.Matrix[5]*m.Matrix[6]) +
+		m.Matrix[2]*(m.Matrix[3]*m.Matrix[7]-m.Matrix[4]*m.Matrix[6])
+}
+
+// Inverse through the adjugate. Singular matrices return a zero matrix
+
+func (m Mat3) Inverse() Mat3 {
+	det := m.Determinant()
+	if det == 0 {
+		return Mat3{}
+	}
+	inv := 1 / det
+	return Mat3{[9]float64{
+		(m.Matrix[4]*m.Matrix[8] - m.Matrix[5]*m.Matrix[7]) * inv,
+		(m.Matrix[2]*m.Matrix[7] - m.Matrix[1]*m.Matrix[8]) * inv,
+		(m.Matrix[1]*m.Matrix[5] - m.Matrix[2]*m.Matrix[4]) * inv,
+		(m.Matrix[5]*m.Matrix[6] - m.Matrix[3]*m.Matrix[8]) * inv,
+		(m.Matrix[0]*m.Matrix[8] - m.Matrix[2]*m.Matrix[6]) * inv,
+		(m.Matrix[2]*m.Matrix[3] - m.Matrix[0]*m.Matrix[5]) * inv,
+		(m.Matrix[3]*m.Matrix[7] - m.Matrix[4]*m.Matrix[6]) * inv,
+		(m.Matrix[1]*m.Matrix[6] - m.Matrix[0]*m.Matrix[7]) * inv,
+		(m.Matrix[0]*m.Matrix[4] - m.Matrix[1]*m.Matrix[3]) * inv,
+	},
+	}
+}
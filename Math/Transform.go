@@ -76,6 +76,17 @@ func (transform *Transform) GetRotationMatrix() Mat3 {
 	return transform.rotation
 }
 
+// Scale, then rotation
+
+func (transform *Transform) GetMatrix() Mat3 {
+	return transform.rotation.MatMul(transform.scaleMatrix)
+}
+
+func (transform *Transform) IsIdentity() bool {
+	return transform.position.Equal(ZeroVector3()) && transform.rotationEuler.Equal(ZeroVector3()) &&
+		transform.scale.Equal(Vector3{1, 1, 1})
+}
+
 func (transform *Transform) Copy() *Transform {
 	return &Transform{
 		position:      transform.position,
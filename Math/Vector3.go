@@ -108,6 +108,15 @@ func (v Vector3) Reflect(n Vector3) Vector3 {
 	return v.Sub(n.FMul(v.Dot(n) * 2))
 }
 
+// Flips the vector so that it faces against the incoming direction i
+
+func (v Vector3) FaceForward(i Vector3) Vector3 {
+	if v.Dot(i) > 0 {
+		return v.Inverse()
+	}
+	return v
+}
+
 func InterpolateVector3(f, s Vector3, t float64) Vector3 {
 	return s.FMul(t).Add(f.FMul(1 - t))
 }
@@ -131,7 +140,7 @@ func (v Vector3) FromBasis(basisX Vector3, basisY Vector3, basisZ Vector3) Vecto
 
 func (v Vector3) FromSingleVectorBasis(basisVec Vector3) Vector3 {
 	var helper Vector3
-	if basisVec.X >= 0.99 {
+	if math.Abs(basisVec.X) >= 0.99 {
 		helper = Vector3{0, 0, 1}
 	} else {
 		helper = Vector3{1, 0, 0}
@@ -80,3 +80,26 @@ func (brdf CookTorranceBRDF) Sample(view, indescent, normal, lightColor, albedo
 
 	return Math.InterpolateVector3(glossy, metal, metallic)
 }
+
+// Share of the samples taken from the specular lobe, the rest are cosine weighted
+
+func (brdf CookTorranceBRDF) specularProbability(roughness, metallic float64) float64 {
+	return math.Min(math.Max(0.5*(1-roughness)+0.5*metallic, 0), 0.9)
+}
+
+func (brdf CookTorranceBRDF) SampleDirection(wo, n Math.Vector3, u Math.Vector2, albedo Math.Vector3, roughness, metallic,
+	ior float64) (Math.Vector3, Math.Vector3, float64) {
+	var wi Math.Vector3
+	if p := brdf.specularProbability(roughness, metallic); u.U < p {
+		wi = beckmannDirection(wo, n, Math.Vector2{U: u.U / p, V: u.V}, math.Max(roughness, 0.01))
+	} else {
+		wi = cosineDirection(n, Math.Vector2{U: (u.U - p) / (1 - p), V: u.V})
+	}
+	pdf := brdf.Pdf(wo, wi, n, albedo, roughness, metallic, ior)
+	return wi, sampleWeight(brdf, wo, wi, n, albedo, roughness, metallic, ior, pdf), pdf
+}
+
+func (brdf CookTorranceBRDF) Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64 {
+	p := brdf.specularProbability(roughness, metallic)
+	return p*beckmannPdf(wo, wi, n, math.Max(roughness, 0.01)) + (1-p)*cosinePdf(wi, n)
+}
@@ -0,0 +1,27 @@
+package BRDFS
+
+import (
+	"Photon/Math"
+	"math"
+)
+
+// Ideal diffuse reflection, albedo / pi
+
+type LambertBRDF struct {
+}
+
+func (brdf LambertBRDF) Sample(view, indescent, normal, lightColor, albedo Math.Vector3, lightIntensity, roughness, metallic, ior float64) Math.Vector3 {
+	cos := math.Max(-indescent.Dot(normal.FaceForward(view)), 0)
+	return albedo.Mul(lightColor).FMul(cos * lightIntensity)
+}
+
+func (brdf LambertBRDF) SampleDirection(wo, n Math.Vector3, u Math.Vector2, albedo Math.Vector3, roughness, metallic,
+	ior float64) (Math.Vector3, Math.Vector3, float64) {
+	wi := cosineDirection(n, u)
+	pdf := cosinePdf(wi, n)
+	return wi, sampleWeight(brdf, wo, wi, n, albedo, roughness, metallic, ior, pdf), pdf
+}
+
+func (brdf LambertBRDF) Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64 {
+	return cosinePdf(wi, n)
+}
@@ -0,0 +1,26 @@
+package BRDFS
+
+import (
+	"Photon/Structs"
+	"strings"
+)
+
+// BRDFs by the names used on the command line and in MTL files
+
+func ByName(name string) (Structs.IBRDF, bool) {
+	switch strings.ToLower(name) {
+	case "cooktorrance":
+		return NewCookTorranceBRDF(), true
+	case "principled":
+		return NewPrincipledBSDF(), true
+	case "lambert":
+		return LambertBRDF{}, true
+	case "orennayar":
+		return OrenNayarBRDF{}, true
+	case "simple":
+		return SimpleBRDF{}, true
+	case "unlit":
+		return UnlitBRDF{}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,51 @@
+package BRDFS
+
+import (
+	"Photon/Math"
+	"math"
+)
+
+// Oren-Nayar diffuse reflection from rough surfaces made of Lambertian microfacets, in its qualitative form. The
+// roughness is the standard deviation of the facet slopes in radians. Zero roughness gives the Lambertian BRDF, rougher
+// surfaces get flatter and reflect more light back towards the light source
+
+type OrenNayarBRDF struct {
+}
+
+func (brdf OrenNayarBRDF) Sample(view, indescent, normal, lightColor, albedo Math.Vector3, lightIntensity, roughness, metallic, ior float64) Math.Vector3 {
+	wo, wi := view.Inverse(), indescent.Inverse()
+	normal = normal.FaceForward(view)
+	cosO, cosI := wo.Dot(normal), wi.Dot(normal)
+	if cosO <= 0 || cosI <= 0 {
+		return Math.Vector3{}
+	}
+	sigmaSq := roughness * roughness
+	a := 1 - sigmaSq/(2*(sigmaSq+0.33))
+	b := 0.45 * sigmaSq / (sigmaSq + 0.09)
+	sinO := math.Sqrt(math.Max(1-cosO*cosO, 0))
+	sinI := math.Sqrt(math.Max(1-cosI*cosI, 0))
+	// Cosine of the azimuth difference, from the directions projected onto the surface
+	var cosPhi float64
+	if sinO > 1e-4 && sinI > 1e-4 {
+		cosPhi = wo.Sub(normal.FMul(cosO)).Dot(wi.Sub(normal.FMul(cosI))) / (sinO * sinI)
+	}
+	// sin(alpha) * tan(beta), alpha being the larger and beta the smaller of the two angles
+	var sinTan float64
+	if cosI > cosO {
+		sinTan = sinO * sinI / cosI
+	} else {
+		sinTan = sinI * sinO / cosO
+	}
+	return albedo.Mul(lightColor).FMul((a + b*math.Max(cosPhi, 0)*sinTan) * cosI * lightIntensity)
+}
+
+func (brdf OrenNayarBRDF) SampleDirection(wo, n Math.Vector3, u Math.Vector2, albedo Math.Vector3, roughness, metallic,
+	ior float64) (Math.Vector3, Math.Vector3, float64) {
+	wi := cosineDirection(n, u)
+	pdf := cosinePdf(wi, n)
+	return wi, sampleWeight(brdf, wo, wi, n, albedo, roughness, metallic, ior, pdf), pdf
+}
+
+func (brdf OrenNayarBRDF) Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64 {
+	return cosinePdf(wi, n)
+}
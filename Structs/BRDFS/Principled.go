@@ -0,0 +1,217 @@
+package BRDFS
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"math"
+)
+
+// Principled BSDF
+// Disney style material model driven by the usual albedo, roughness, metallic and IOR inputs. A GGX specular lobe
+// with Smith masking and Schlick Fresnel sits on top of Burley diffuse with a sheen layer, under a GGX clearcoat.
+// Transmission treats surfaces as thin sheets: light goes through them without bending, blurred by the roughness. The
+// sheen, clearcoat and transmission come from the material, see ForMaterial
+
+type PrincipledBSDF struct {
+	Sheen float64
+	// Tints the sheen towards the hue of the albedo
+	SheenTint          float64
+	Clearcoat          float64
+	ClearcoatRoughness float64
+	Transmission       float64
+}
+
+func NewPrincipledBSDF() *PrincipledBSDF {
+	return &PrincipledBSDF{
+		SheenTint:          0.5,
+		ClearcoatRoughness: 0.03,
+	}
+}
+
+// Copy of the BSDF with the extras of the material
+
+func (bsdf PrincipledBSDF) ForMaterial(material *Structs.Material) Structs.IBRDF {
+	bsdf.Sheen = material.GetSheen()
+	bsdf.Clearcoat, bsdf.ClearcoatRoughness = material.GetClearcoat()
+	bsdf.Transmission = material.GetTransmission()
+	return &bsdf
+}
+
+func (bsdf PrincipledBSDF) Transmits() bool {
+	return bsdf.Transmission > 0
+}
+
+func luminance(color Math.Vector3) float64 {
+	return 0.2126*color.X + 0.7152*color.Y + 0.0722*color.Z
+}
+
+// Hue of the albedo at unit luminance, white for black albedos
+
+func hue(albedo Math.Vector3) Math.Vector3 {
+	l := luminance(albedo)
+	if l <= 0 {
+		return Math.Vector3{X: 1, Y: 1, Z: 1}
+	}
+	return albedo.FDiv(l)
+}
+
+func schlickWeight(cos float64) float64 {
+	m := math.Min(math.Max(1-cos, 0), 1)
+	m2 := m * m
+	return m2 * m2 * m
+}
+
+func schlickFresnel(f0, cos float64) float64 {
+	return f0 + (1-f0)*schlickWeight(cos)
+}
+
+// Reflectance at normal incidence of a dielectric with the given IOR (against air)
+
+func dielectricF0(ior float64) float64 {
+	r := (ior - 1) / (ior + 1)
+	return r * r
+}
+
+// Separable Smith masking for GGX, for one direction
+
+func smithG1(cos, alpha float64) float64 {
+	if cos <= 0 {
+		return 0
+	}
+	cosSq := cos * cos
+	tanSq := (1 - cosSq) / cosSq
+	return 2 / (1 + math.Sqrt(1+alpha*alpha*tanSq))
+}
+
+// GGX alpha from the perceptual roughness, kept away from a delta
+
+func ggxAlpha(roughness float64) float64 {
+	return math.Max(roughness*roughness, 0.001)
+}
+
+// Share of the light the clearcoat lets through to the layers below, for one direction
+
+func (bsdf PrincipledBSDF) clearcoatTransmittance(cos float64) float64 {
+	return 1 - bsdf.Clearcoat*schlickFresnel(0.04, cos)
+}
+
+// BSDF times the absolute cosine at wi. Both directions point away from the surface and the normal faces wo
+
+func (bsdf PrincipledBSDF) eval(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) Math.Vector3 {
+	cosO := wo.Dot(n)
+	cosI := wi.Dot(n)
+	if cosO <= 0 || cosI == 0 {
+		return Math.Vector3{}
+	}
+	alpha := ggxAlpha(roughness)
+	f0 := dielectricF0(ior)
+	coatTransmittance := bsdf.clearcoatTransmittance(cosO) * bsdf.clearcoatTransmittance(math.Abs(cosI))
+
+	if cosI < 0 {
+		// Transmission, the mirror image of the specular lobe on the other side of the sheet
+		if bsdf.Transmission <= 0 {
+			return Math.Vector3{}
+		}
+		wr := wi.Reflect(n)
+		h := wo.Add(wr).Normalized()
+		fresnel := schlickFresnel(f0, wo.Dot(h))
+		d := ggxDistribution(h.Dot(n), alpha)
+		g := smithG1(cosO, alpha) * smithG1(-cosI, alpha)
+		weight := (1 - metallic) * bsdf.Transmission * (1 - fresnel) * d * g / (4 * cosO)
+		return albedo.FMul(weight * coatTransmittance)
+	}
+
+	white := Math.Vector3{X: 1, Y: 1, Z: 1}
+	h := wo.Add(wi).Normalized()
+	cosH := h.Dot(n)
+	cosD := wi.Dot(h)
+	tint := hue(albedo)
+
+	// Specular, dielectric reflectance blending into the albedo for metals
+	specularColor := Math.InterpolateVector3(white.FMul(f0), albedo, metallic)
+	fresnel := Math.InterpolateVector3(specularColor, white, schlickWeight(cosD))
+	d := ggxDistribution(cosH, alpha)
+	g := smithG1(cosO, alpha) * smithG1(cosI, alpha)
+	specular := fresnel.FMul(d * g / (4 * cosO))
+
+	// Burley diffuse with retro-reflection at grazing angles, and sheen
+	fl, fv := schlickWeight(cosI), schlickWeight(cosO)
+	retro := 2 * roughness * cosD * cosD
+	burley := (1-0.5*fl)*(1-0.5*fv) + retro*(fl+fv+fl*fv*(retro-1))
+	diffuse := albedo.FMul(burley / math.Pi)
+	sheen := Math.InterpolateVector3(white, tint, bsdf.SheenTint).FMul(bsdf.Sheen * schlickWeight(cosD))
+	// The diffuse layer only gets the light the dielectric specular lets through. Burley diffuse already falls off at
+	// grazing angles, so it is scaled by the geometric mean of the Fresnel transmittance of both directions
+	layer := math.Sqrt((1 - schlickFresnel(f0, cosO)) * (1 - schlickFresnel(f0, cosI)))
+	base := diffuse.Add(sheen).FMul((1 - metallic) * (1 - bsdf.Transmission) * layer * cosI).Add(specular)
+
+	// Clearcoat, a colorless dielectric layer
+	coatAlpha := ggxAlpha(bsdf.ClearcoatRoughness)
+	coat := bsdf.Clearcoat * schlickFresnel(0.04, cosD) * ggxDistribution(cosH, coatAlpha) *
+		smithG1(cosO, coatAlpha) * smithG1(cosI, coatAlpha) / (4 * cosO)
+
+	return base.FMul(coatTransmittance).Add(white.FMul(coat))
+}
+
+func (bsdf PrincipledBSDF) Sample(view, indescent, normal, lightColor, albedo Math.Vector3, lightIntensity, roughness, metallic, ior float64) Math.Vector3 {
+	wo, wi := view.Inverse(), indescent.Inverse()
+	normal = normal.FaceForward(view)
+	f := bsdf.eval(wo, wi, normal, albedo, roughness, metallic, ior)
+	return f.Mul(lightColor).FMul(lightIntensity * math.Pi)
+}
+
+// Probabilities of sampling the diffuse, specular, transmission and clearcoat lobes, roughly following their share of
+// the reflected light
+
+func (bsdf PrincipledBSDF) lobeProbabilities(wo, n Math.Vector3, metallic, ior float64) (float64, float64, float64, float64) {
+	cosO := math.Max(wo.Dot(n), 0)
+	diffuse := (1 - metallic) * (1 - bsdf.Transmission)
+	specular := metallic + (1-metallic)*math.Max(schlickFresnel(dielectricF0(ior), cosO), 0.1)
+	transmission := (1 - metallic) * bsdf.Transmission
+	clearcoat := bsdf.Clearcoat * math.Max(schlickFresnel(0.04, cosO), 0.1)
+	total := diffuse + specular + transmission + clearcoat
+	return diffuse / total, specular / total, transmission / total, clearcoat / total
+}
+
+func (bsdf PrincipledBSDF) SampleDirection(wo, n Math.Vector3, u Math.Vector2, albedo Math.Vector3, roughness, metallic,
+	ior float64) (Math.Vector3, Math.Vector3, float64) {
+	pDiffuse, pSpecular, pTransmission, pClearcoat := bsdf.lobeProbabilities(wo, n, metallic, ior)
+	alpha := ggxAlpha(roughness)
+	// The lobe is picked with the first random number, the rest of it samples the direction. The specular lobe always
+	// has some share, so it takes the remaining samples
+	lobe := func(start, p float64) Math.Vector2 {
+		return Math.Vector2{U: math.Min(math.Max((u.U-start)/p, 0), 1), V: u.V}
+	}
+	var wi Math.Vector3
+	below := false
+	switch {
+	case u.U < pDiffuse:
+		wi = cosineDirection(n, lobe(0, pDiffuse))
+	case u.U < pDiffuse+pTransmission:
+		wi = ggxDirection(wo, n, lobe(pDiffuse, pTransmission), alpha).Reflect(n)
+		below = true
+	case u.U < pDiffuse+pTransmission+pClearcoat:
+		wi = ggxDirection(wo, n, lobe(pDiffuse+pTransmission, pClearcoat), ggxAlpha(bsdf.ClearcoatRoughness))
+	default:
+		wi = ggxDirection(wo, n, lobe(1-pSpecular, pSpecular), alpha)
+	}
+	// Microfacet samples ending up on the wrong side of the surface are lost
+	if (wi.Dot(n) < 0) != below {
+		return wi, Math.Vector3{}, 0
+	}
+	pdf := bsdf.Pdf(wo, wi, n, albedo, roughness, metallic, ior)
+	if pdf <= 0 {
+		return wi, Math.Vector3{}, 0
+	}
+	return wi, bsdf.eval(wo, wi, n, albedo, roughness, metallic, ior).FDiv(pdf), pdf
+}
+
+func (bsdf PrincipledBSDF) Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64 {
+	pDiffuse, pSpecular, pTransmission, pClearcoat := bsdf.lobeProbabilities(wo, n, metallic, ior)
+	alpha := ggxAlpha(roughness)
+	if wi.Dot(n) < 0 {
+		return pTransmission * ggxPdf(wo, wi.Reflect(n), n, alpha)
+	}
+	return pDiffuse*cosinePdf(wi, n) + pSpecular*ggxPdf(wo, wi, n, alpha) +
+		pClearcoat*ggxPdf(wo, wi, n, ggxAlpha(bsdf.ClearcoatRoughness))
+}
@@ -0,0 +1,110 @@
+package BRDFS
+
+import (
+	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Utils"
+	"math"
+)
+
+// Importance sampling helpers. Directions point away from the surface and the normal faces wo
+
+// BRDF times the cosine at wi, for the Sample convention (which returns pi times that)
+
+func evalCos(brdf Structs.IBRDF, wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) Math.Vector3 {
+	if wo.Dot(n) <= 0 || wi.Dot(n) <= 0 {
+		return Math.Vector3{}
+	}
+	white := Math.Vector3{X: 1, Y: 1, Z: 1}
+	return brdf.Sample(wo.Inverse(), wi.Inverse(), n, white, albedo, 1, roughness, metallic, ior).FDiv(math.Pi)
+}
+
+// Sampling weight f * cos / pdf, zero for directions below the surface
+
+func sampleWeight(brdf Structs.IBRDF, wo, wi, n, albedo Math.Vector3, roughness, metallic, ior, pdf float64) Math.Vector3 {
+	if pdf <= 0 {
+		return Math.Vector3{}
+	}
+	return evalCos(brdf, wo, wi, n, albedo, roughness, metallic, ior).FDiv(pdf)
+}
+
+func cosineDirection(n Math.Vector3, u Math.Vector2) Math.Vector3 {
+	return Utils.CosineSampleHemisphere(u.U, u.V).FromSingleVectorBasis(n)
+}
+
+func cosinePdf(wi, n Math.Vector3) float64 {
+	return math.Max(wi.Dot(n), 0) / math.Pi
+}
+
+func uniformDirection(n Math.Vector3, u Math.Vector2) Math.Vector3 {
+	w := Utils.UniformSampleSphere(u.U, u.V)
+	w.Z = math.Abs(w.Z)
+	return w.FromSingleVectorBasis(n)
+}
+
+func uniformPdf(wi, n Math.Vector3) float64 {
+	if wi.Dot(n) <= 0 {
+		return 0
+	}
+	return 1 / (2 * math.Pi)
+}
+
+// Beckmann distribution of the half vector, D(h) * cos(theta_h), turned into a pdf of wi
+
+func beckmannDirection(wo, n Math.Vector3, u Math.Vector2, alpha float64) Math.Vector3 {
+	tanSq := -alpha * alpha * math.Log(1-u.U)
+	cos := 1 / math.Sqrt(1+tanSq)
+	sin := math.Sqrt(math.Max(1-cos*cos, 0))
+	phi := 2 * math.Pi * u.V
+	h := Math.Vector3{X: sin * math.Cos(phi), Y: sin * math.Sin(phi), Z: cos}.FromSingleVectorBasis(n)
+	return h.FMul(2 * wo.Dot(h)).Sub(wo)
+}
+
+func beckmannPdf(wo, wi, n Math.Vector3, alpha float64) float64 {
+	if wi.Dot(n) <= 0 {
+		return 0
+	}
+	h := wo.Add(wi).Normalized()
+	cos := h.Dot(n)
+	woDotH := wo.Dot(h)
+	if cos <= 0 || woDotH <= 0 {
+		return 0
+	}
+	cosSq := cos * cos
+	tanSq := (1 - cosSq) / cosSq
+	d := math.Exp(-tanSq/(alpha*alpha)) / (math.Pi * alpha * alpha * cosSq * cosSq)
+	return d * cos / (4 * woDotH)
+}
+
+// GGX (Trowbridge-Reitz) distribution of the half vector, sampled and turned into a pdf of wi the same way
+
+func ggxDistribution(cos, alpha float64) float64 {
+	if cos <= 0 {
+		return 0
+	}
+	alphaSq := alpha * alpha
+	denominator := cos*cos*(alphaSq-1) + 1
+	return alphaSq / (math.Pi * denominator * denominator)
+}
+
+func ggxDirection(wo, n Math.Vector3, u Math.Vector2, alpha float64) Math.Vector3 {
+	tanSq := alpha * alpha * u.U / math.Max(1-u.U, 1e-12)
+	cos := 1 / math.Sqrt(1+tanSq)
+	sin := math.Sqrt(math.Max(1-cos*cos, 0))
+	phi := 2 * math.Pi * u.V
+	h := Math.Vector3{X: sin * math.Cos(phi), Y: sin * math.Sin(phi), Z: cos}.FromSingleVectorBasis(n)
+	return h.FMul(2 * wo.Dot(h)).Sub(wo)
+}
+
+func ggxPdf(wo, wi, n Math.Vector3, alpha float64) float64 {
+	if wi.Dot(n) <= 0 {
+		return 0
+	}
+	h := wo.Add(wi).Normalized()
+	cos := h.Dot(n)
+	woDotH := wo.Dot(h)
+	if cos <= 0 || woDotH <= 0 {
+		return 0
+	}
+	return ggxDistribution(cos, alpha) * cos / (4 * woDotH)
+}
@@ -17,3 +17,16 @@ func (s SimpleBRDF) Sample(view, indescent, normal, lightColor, albedo Math.Vect
 	nonMet := albedo.FMul(diffuse).Add(lightColor.FMul(specular * lightIntensity)).FDiv(2)
 	return met.FMul(metallic).Add(nonMet.FMul(1 - metallic))
 }
+
+// The diffuse term dominates, so the samples are cosine weighted
+
+func (s SimpleBRDF) SampleDirection(wo, n Math.Vector3, u Math.Vector2, albedo Math.Vector3, roughness, metallic,
+	ior float64) (Math.Vector3, Math.Vector3, float64) {
+	wi := cosineDirection(n, u)
+	pdf := cosinePdf(wi, n)
+	return wi, sampleWeight(s, wo, wi, n, albedo, roughness, metallic, ior, pdf), pdf
+}
+
+func (s SimpleBRDF) Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64 {
+	return cosinePdf(wi, n)
+}
@@ -8,3 +8,16 @@ type UnlitBRDF struct {
 func (u UnlitBRDF) Sample(view, indescent, normal, lightColor, albedo Math.Vector3, lightIntensity, roughness, metallic, ior float64) Math.Vector3 {
 	return albedo
 }
+
+// The albedo is returned for every direction, without the cosine, so the samples are uniform
+
+func (u UnlitBRDF) SampleDirection(wo, n Math.Vector3, random Math.Vector2, albedo Math.Vector3, roughness, metallic,
+	ior float64) (Math.Vector3, Math.Vector3, float64) {
+	wi := uniformDirection(n, random)
+	pdf := uniformPdf(wi, n)
+	return wi, sampleWeight(u, wo, wi, n, albedo, roughness, metallic, ior, pdf), pdf
+}
+
+func (u UnlitBRDF) Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64 {
+	return uniformPdf(wi, n)
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"math/rand"
 	"strconv"
+	"sync"
 )
 
 type AABoundingBox struct {
@@ -29,6 +30,7 @@ type BVHNode struct {
 	Child1           *BVHNode
 	Child2           *BVHNode
 	Mesh             *Mesh
+	Instance         *Instance
 	TriangleClusters []TriangleCluster
 	NodeID           int
 }
@@ -58,7 +60,7 @@ func JoinedNode(node1, node2 *BVHNode) BVHNode {
 
 // The hardest part, BVH node from a mesh
 
-func BVHFromMesh(mesh *Mesh, pointRatio float64) *BVHNode {
+func BVHFromMesh(mesh *Mesh, pointRatio float64, pool *Utils.WorkerPool) *BVHNode {
 	Utils.Log("Creating acceleration structures for mesh " + mesh.MeshName)
 	clusterCount := max(int(float64(len(mesh.Triangles))*pointRatio), 1)
 	Utils.Log(strconv.Itoa(len(mesh.Triangles)) + " triangles in the mesh " + mesh.MeshName)
@@ -85,20 +87,38 @@ func BVHFromMesh(mesh *Mesh, pointRatio float64) *BVHNode {
 	}
 
 	Utils.Log("Assigning triangles to clusters")
-	// Iterating through all the triangles and assigning them to clusters
+	// Finding the closest cluster of every triangle, in chunks spread over the pool
+	assignments := make([]int, len(mesh.Triangles))
+	centers := make([]Math.Vector3, clusterCount)
+	for k := 0; k < clusterCount; k++ {
+		centers[k] = clusters[k].AABB.MiddlePoint()
+	}
+	var wg sync.WaitGroup
+	chunkSize := 4096
+	for chunkStart := 0; chunkStart < len(mesh.Triangles); chunkStart += chunkSize {
+		chunkEnd := min(chunkStart+chunkSize, len(mesh.Triangles))
+		pool.Go(&wg, func() {
+			for j := chunkStart; j < chunkEnd; j++ {
+				midPoint := mesh.Triangles[j].Middle()
+				closest := 0
+				closestDist := centers[0].Sub(midPoint).LenSq()
+				for k := 1; k < clusterCount; k++ {
+					d := centers[k].Sub(midPoint).LenSq()
+					if d < closestDist {
+						closest = k
+						closestDist = d
+					}
+				}
+				assignments[j] = closest
+			}
+		})
+	}
+	wg.Wait()
+
+	// Then filling the clusters in order
 	for j := 0; j < len(mesh.Triangles); j++ {
 		tri := &mesh.Triangles[j]
-		midPoint := tri.Middle()
-		// Finding the closest cluster
-		closestCluster := &clusters[0]
-		closestDist := closestCluster.AABB.MiddlePoint().Sub(midPoint).LenSq()
-		for k := 1; k < len(clusters); k++ {
-			d := clusters[k].AABB.MiddlePoint().Sub(midPoint).LenSq()
-			if d < closestDist {
-				closestCluster = &clusters[k]
-				closestDist = d
-			}
-		}
+		closestCluster := &clusters[assignments[j]]
 		closestCluster.Triangles = append(closestCluster.Triangles, *tri)
 		closestCluster.AABB.Point1 = Math.Vector3{
 			X: min(tri.V1Pos.X, tri.V2Pos.X, tri.V3Pos.X, closestCluster.AABB.Point1.X),
@@ -0,0 +1,229 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"Photon/Utils"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// On-disk cache of the mesh BVHs (SAH builder only)
+// Files are named after a hash of the triangle positions and the build settings, so editing the source model or the
+// builder produces a new key and the stale file is simply never read again. The file holds a header with the key, then
+// the nodes and the primitive order as they are in memory
+// Stale files are pruned instead: every file written pushes the least recently used ones out once the cache grows
+// over bvhCacheMaxSize (loading a file counts as a use)
+
+const bvhCacheVersion = 1
+
+const bvhCacheMaxSize = 1 << 30
+
+var bvhCacheMagic = [4]byte{'P', 'B', 'V', 'H'}
+
+type bvhCacheHeader struct {
+	Magic     [4]byte
+	Version   uint32
+	Key       [sha256.Size]byte
+	NodeCount uint32
+	PrimCount uint32
+}
+
+// Builder settings that change the resulting BVH, and thus the key
+
+type bvhCacheSettings struct {
+	bins          uint32
+	maxLeafSize   uint32
+	traversalCost float64
+}
+
+var sahCacheSettings = bvhCacheSettings{bins: sahBins, maxLeafSize: sahMaxLeafSize, traversalCost: sahTraversalCost}
+
+func bvhCacheKey(mesh *Mesh, settings bvhCacheSettings) [sha256.Size]byte {
+	hash := sha256.New()
+	buf := make([]byte, 0, 9*8)
+	buf = binary.LittleEndian.AppendUint32(buf, bvhCacheVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, settings.bins)
+	buf = binary.LittleEndian.AppendUint32(buf, settings.maxLeafSize)
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(settings.traversalCost))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(mesh.Triangles)))
+	hash.Write(buf)
+	for i := 0; i < len(mesh.Triangles); i++ {
+		tri := &mesh.Triangles[i]
+		buf = buf[:0]
+		for _, v := range [3]Math.Vector3{tri.V1Pos, tri.V2Pos, tri.V3Pos} {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.X))
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Y))
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Z))
+		}
+		hash.Write(buf)
+	}
+	var key [sha256.Size]byte
+	hash.Sum(key[:0])
+	return key
+}
+
+// Returns the cached BVH of the mesh, building and storing it if there is no valid one. Cache errors are not fatal,
+// the BVH is rebuilt instead
+
+func CachedBVHFromMeshSAH(mesh *Mesh, dir string, pool *Utils.WorkerPool) *FlatBVH {
+	key := bvhCacheKey(mesh, sahCacheSettings)
+	file := filepath.Join(dir, hex.EncodeToString(key[:])+".bvh")
+	bvh, err := readBVHCache(file, key, len(mesh.Triangles))
+	if err == nil {
+		Utils.Log("loaded BVH of mesh " + mesh.MeshName + " from cache")
+		// Loading counts as a use, so the file is kept over older ones when the cache is pruned
+		now := time.Now()
+		os.Chtimes(file, now, now)
+		return bvh
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		Utils.LogWarning("ignoring BVH cache file " + file + ": " + err.Error())
+	}
+
+	bvh = BVHFromMeshSAH(mesh, pool)
+	if err := writeBVHCache(file, key, bvh); err != nil {
+		Utils.LogWarning("could not write BVH cache file " + file + ": " + err.Error())
+	} else if err := pruneBVHCache(dir, bvhCacheMaxSize); err != nil {
+		Utils.LogWarning("could not prune BVH cache " + dir + ": " + err.Error())
+	}
+	return bvh
+}
+
+// Removes the least recently used cache files until the rest fits into maxSize bytes
+
+func pruneBVHCache(dir string, maxSize int64) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".bvh" {
+			continue
+		}
+		// Another render might prune the same directory, files that are already gone are skipped
+		if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	// The newest file is the one just written, it stays even if it doesn't fit on its own
+	var size int64
+	for i, info := range files {
+		size += info.Size()
+		if size <= maxSize || i == 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, info.Name())); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		Utils.Log("removed BVH cache file " + info.Name())
+	}
+	return nil
+}
+
+func readBVHCache(file string, key [sha256.Size]byte, primCount int) (*FlatBVH, error) {
+	fl, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fl.Close()
+	reader := bufio.NewReader(fl)
+
+	var header bvhCacheHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != bvhCacheMagic || header.Version != bvhCacheVersion {
+		return nil, errors.New("unknown format")
+	}
+	if header.Key != key || int(header.PrimCount) != primCount || header.NodeCount == 0 {
+		return nil, errors.New("key mismatch")
+	}
+	bvh := &FlatBVH{
+		Nodes: make([]FlatBVHNode, header.NodeCount),
+		Order: make([]int32, header.PrimCount),
+	}
+	if err := binary.Read(reader, binary.LittleEndian, bvh.Nodes); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(reader, binary.LittleEndian, bvh.Order); err != nil {
+		return nil, err
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		return nil, errors.New("trailing data")
+	}
+
+	// A damaged file must not send the traversal out of bounds
+	for i := 0; i < len(bvh.Order); i++ {
+		if bvh.Order[i] < 0 || int(bvh.Order[i]) >= primCount {
+			return nil, errors.New("corrupted primitive order")
+		}
+	}
+	for i := 0; i < len(bvh.Nodes); i++ {
+		node := &bvh.Nodes[i]
+		if node.Count > 0 {
+			if node.First < 0 || int(node.First)+int(node.Count) > primCount {
+				return nil, errors.New("corrupted leaf")
+			}
+		} else if primCount > 0 && (int(node.SecondChild) <= i+1 || int(node.SecondChild) >= len(bvh.Nodes) || node.Axis > 2) {
+			return nil, errors.New("corrupted inner node")
+		}
+	}
+	return bvh, nil
+}
+
+// Written to a temporary file first, so that concurrent renders never read a half-written cache
+
+func writeBVHCache(file string, key [sha256.Size]byte, bvh *FlatBVH) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	fl, err := os.CreateTemp(filepath.Dir(file), "bvh-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fl.Name())
+
+	writer := bufio.NewWriter(fl)
+	header := bvhCacheHeader{
+		Magic:     bvhCacheMagic,
+		Version:   bvhCacheVersion,
+		Key:       key,
+		NodeCount: uint32(len(bvh.Nodes)),
+		PrimCount: uint32(len(bvh.Order)),
+	}
+	err = binary.Write(writer, binary.LittleEndian, &header)
+	if err == nil {
+		err = binary.Write(writer, binary.LittleEndian, bvh.Nodes)
+	}
+	if err == nil {
+		err = binary.Write(writer, binary.LittleEndian, bvh.Order)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = fl.Chmod(0644)
+	}
+	if closeErr := fl.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(fl.Name(), file)
+}
@@ -0,0 +1,166 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"Photon/Utils"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The least recently used files go first, files that aren't BVHs are left alone
+
+func TestPruneBVHCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	names := []string{"a.bvh", "b.bvh", "c.bvh", "d.bvh"}
+	for i, name := range names {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := now.Add(time.Duration(i-len(names)) * time.Minute)
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pruneBVHCache(dir, 250); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.bvh", "b.bvh"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s was kept", name)
+		}
+	}
+	for _, name := range []string{"c.bvh", "d.bvh", "notes.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s was removed: %v", name, err)
+		}
+	}
+
+	// The newest file stays even if it doesn't fit
+	if err := pruneBVHCache(dir, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "d.bvh")); err != nil {
+		t.Fatalf("d.bvh was removed: %v", err)
+	}
+}
+
+func testCacheMesh() *Mesh {
+	return testSphereMesh("sphere", Math.Vector3{}, 1, 16, NewMaterial(nil))
+}
+
+// A cached BVH loads back exactly as it was built
+
+func TestBVHCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	mesh := testCacheMesh()
+	pool := Utils.NewWorkerPool(4)
+	built := CachedBVHFromMeshSAH(mesh, dir, pool)
+	key := bvhCacheKey(mesh, sahCacheSettings)
+	loaded, err := readBVHCache(filepath.Join(dir, hex.EncodeToString(key[:])+".bvh"), key, len(mesh.Triangles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(built, loaded) {
+		t.Fatal("the loaded BVH differs from the built one")
+	}
+	if cached := CachedBVHFromMeshSAH(mesh, dir, pool); !reflect.DeepEqual(built, cached) {
+		t.Fatal("the cached BVH differs from the built one")
+	}
+}
+
+// Any change to the triangle positions or to the builder settings gives a new key
+
+func TestBVHCacheKey(t *testing.T) {
+	mesh := testCacheMesh()
+	key := bvhCacheKey(mesh, sahCacheSettings)
+	if bvhCacheKey(testCacheMesh(), sahCacheSettings) != key {
+		t.Fatal("the same mesh got a different key")
+	}
+
+	moved := testCacheMesh()
+	moved.Triangles[3].V2Pos.X += 1e-9
+	if bvhCacheKey(moved, sahCacheSettings) == key {
+		t.Fatal("moving a vertex kept the key")
+	}
+	shortened := testCacheMesh()
+	shortened.Triangles = shortened.Triangles[:len(shortened.Triangles)-1]
+	if bvhCacheKey(shortened, sahCacheSettings) == key {
+		t.Fatal("removing a triangle kept the key")
+	}
+
+	for _, settings := range []bvhCacheSettings{
+		{bins: sahBins * 2, maxLeafSize: sahMaxLeafSize, traversalCost: sahTraversalCost},
+		{bins: sahBins, maxLeafSize: sahMaxLeafSize + 1, traversalCost: sahTraversalCost},
+		{bins: sahBins, maxLeafSize: sahMaxLeafSize, traversalCost: sahTraversalCost * 2},
+	} {
+		if bvhCacheKey(mesh, settings) == key {
+			t.Fatalf("settings %+v kept the key", settings)
+		}
+	}
+}
+
+// Damaged files and files of another format or mesh are rejected instead of being loaded
+
+func TestBVHCacheRejectsDamagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	mesh := testCacheMesh()
+	key := bvhCacheKey(mesh, sahCacheSettings)
+	file := filepath.Join(dir, "mesh.bvh")
+	if err := writeBVHCache(file, key, BVHFromMeshSAH(mesh, Utils.NewWorkerPool(4))); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := binary.Size(bvhCacheHeader{})
+	nodeSize := binary.Size(FlatBVHNode{})
+	aabbSize := binary.Size(AABoundingBox{})
+
+	damaged := map[string]func([]byte) []byte{
+		"empty":            func(d []byte) []byte { return d[:0] },
+		"truncated header": func(d []byte) []byte { return d[:headerSize/2] },
+		"truncated nodes":  func(d []byte) []byte { return d[:headerSize+nodeSize/2] },
+		"truncated order":  func(d []byte) []byte { return d[:len(d)-1] },
+		"trailing data":    func(d []byte) []byte { return append(d, 0) },
+		"bad magic": func(d []byte) []byte {
+			d[0] = 'X'
+			return d
+		},
+		"bad version": func(d []byte) []byte {
+			binary.LittleEndian.PutUint32(d[4:], bvhCacheVersion+1)
+			return d
+		},
+		"other key": func(d []byte) []byte {
+			d[8] ^= 1
+			return d
+		},
+		"corrupted child": func(d []byte) []byte {
+			binary.LittleEndian.PutUint32(d[headerSize+aabbSize:], 0)
+			return d
+		},
+		"corrupted order": func(d []byte) []byte {
+			binary.LittleEndian.PutUint32(d[len(d)-4:], uint32(len(mesh.Triangles)))
+			return d
+		},
+	}
+	for name, damage := range damaged {
+		if err := os.WriteFile(file, damage(append([]byte(nil), data...)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readBVHCache(file, key, len(mesh.Triangles)); err == nil {
+			t.Fatalf("%s: the file was loaded", name)
+		}
+	}
+}
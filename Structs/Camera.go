@@ -50,6 +50,48 @@ func (c *Camera) GetCameraGrid(uv Math.Vector2) (pointPos Math.Vector3, directio
 	return c.transform.GetRotationMatrix().VecMul(point).Add(c.transform.GetPosition()), c.transform.GetRotationMatrix().VecMul(d)
 }
 
+// The camera is a pinhole at the focal point: every camera ray passes through it
+
+func (c *Camera) GetFocalPoint() Math.Vector3 {
+	return c.transform.GetRotationMatrix().VecMul(Math.Vector3{Z: -c.focalLength}).Add(c.transform.GetPosition())
+}
+
+func (c *Camera) ViewDirection() Math.Vector3 {
+	return c.transform.GetRotationMatrix().VecMul(Math.Vector3{Z: -1})
+}
+
+// Distance from the focal point to the image plane, in pixels
+
+func (c *Camera) GetImagePlaneDistance() float64 {
+	return c.focalLength * c.resolution.U / c.lensSize.U
+}
+
+// Pixel coordinates a point is seen at (the inverse of GetCameraGrid). Returns false for points behind the camera or
+// outside the image
+
+func (c *Camera) Project(point Math.Vector3) (Math.Vector2, bool) {
+	local := c.transform.GetRotationMatrix().Transposed().VecMul(point.Sub(c.GetFocalPoint()))
+	if local.Z >= 0 {
+		return Math.Vector2{}, false
+	}
+	pX := c.focalLength * local.X / local.Z
+	pY := c.focalLength * local.Y / local.Z
+	uv := Math.Vector2{
+		U: (pX/c.lensSize.U + 0.5) * c.resolution.U,
+		V: (pY/c.lensSize.V + 0.5) * c.resolution.V,
+	}
+	if uv.U < 0 || uv.V < 0 || uv.U >= c.resolution.U || uv.V >= c.resolution.V {
+		return Math.Vector2{}, false
+	}
+	return uv, true
+}
+
+// Angle between the rays of two neighboring pixels
+
+func (c *Camera) GetPixelSpreadAngle() float64 {
+	return c.lensSize.U / c.resolution.U / math.Abs(c.focalLength)
+}
+
 func (c *Camera) MoveTo(position Math.Vector3) {
 	c.transform.SetPosition(position)
 }
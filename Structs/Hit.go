@@ -0,0 +1,77 @@
+package Structs
+
+import "Photon/Math"
+
+// Ray hit record
+// T is the ray parameter of the hit (the distance, for normalized directions). Normals are in world space and point
+// out of the front side of the triangle, FrontFace tells whether the ray came from that side. The triangle is the one
+// stored in the mesh (in object space for transformed instances), so it should only be used for material sampling
+
+type Hit struct {
+	T               float64
+	Position        Math.Vector3
+	GeometricNormal Math.Vector3
+	ShadingNormal   Math.Vector3
+	UV              Math.Vector2
+	Barycentric     Math.Vector2
+	Triangle        *Triangle
+	Mesh            *Mesh
+	Instance        *Instance
+	FrontFace       bool
+}
+
+func newHit(ray Ray, t float64, tri *Triangle, instance *Instance, bary Math.Vector2) Hit {
+	geometricNormal := instance.NormalToWorld(tri.TriangleNormal)
+	return Hit{
+		T:               t,
+		Position:        ray.Origin.Add(ray.Direction.FMul(t)),
+		GeometricNormal: geometricNormal,
+		ShadingNormal:   instance.NormalToWorld(tri.InterpolateNormals(bary)),
+		UV:              tri.InterpolateTexcoords(bary),
+		Barycentric:     bary,
+		Triangle:        tri,
+		Mesh:            instance.Mesh,
+		Instance:        instance,
+		FrontFace:       ray.Direction.Dot(geometricNormal) < 0,
+	}
+}
+
+// Shading normal with the normal and bump maps of the material applied, filtered over the ray footprint
+
+func (hit *Hit) PerturbedNormal(footprint float64) Math.Vector3 {
+	if !hit.Triangle.Material.HasNormalPerturbation() {
+		return hit.ShadingNormal
+	}
+	return hit.Instance.NormalToWorld(hit.Triangle.ShadingNormal(hit.Barycentric, footprint/hit.Instance.scale))
+}
+
+// Closest hit with the ray parameter in (tMin, tMax)
+
+func (scene *Scene) Intersect(ray Ray, tMin, tMax float64) (Hit, bool) {
+	t, tri, instance, bary := scene.traverse(ray.Direction, ray.Origin, tMin, tMax, false, scene.alphaSeed(ray))
+	if tri == nil {
+		return Hit{}, false
+	}
+	return newHit(ray, t, tri, instance, bary), true
+}
+
+// Whether anything is hit with the ray parameter in (tMin, tMax). Stops at the first hit, so it is cheaper than
+// Intersect
+
+func (scene *Scene) IntersectsAny(ray Ray, tMin, tMax float64) bool {
+	_, tri, _, _ := scene.traverse(ray.Direction, ray.Origin, tMin, tMax, true, scene.alphaSeed(ray))
+	return tri != nil
+}
+
+// Whether the segment between two points is blocked. Surfaces closer than MinHitDistance to either end are ignored,
+// so that the points can lie on surfaces themselves
+
+func (scene *Scene) Occluded(from, to Math.Vector3) bool {
+	direction := to.Sub(from)
+	length := direction.Len()
+	if length <= 2*MinHitDistance {
+		return false
+	}
+	epsilon := MinHitDistance / length
+	return scene.IntersectsAny(Ray{Origin: from, Direction: direction}, epsilon, 1-epsilon)
+}
@@ -0,0 +1,86 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"math"
+)
+
+// Mesh instance
+// Instances place a shared mesh into the scene with their own transform. All the instances of a mesh share one
+// object-space BVH (the bottom level of the acceleration structure), rays are moved into object space instead
+
+type Instance struct {
+	Name      string
+	Mesh      *Mesh
+	Transform *Math.Transform
+	// Cached matrices, updated on BVH rebuilds
+	identity     bool
+	matrix       Math.Mat3
+	inverse      Math.Mat3
+	normalMatrix Math.Mat3
+	scale        float64
+	// Bottom level acceleration structure (one of the two, depending on the builder) and its object space bounds
+	blas   *BVHNode
+	bvh    *FlatBVH
+	bounds AABoundingBox
+}
+
+func NewInstance(name string, mesh *Mesh, transform *Math.Transform) *Instance {
+	instance := &Instance{
+		Name:      name,
+		Mesh:      mesh,
+		Transform: transform,
+	}
+	instance.updateMatrices()
+	return instance
+}
+
+func (instance *Instance) updateMatrices() {
+	instance.identity = instance.Transform.IsIdentity()
+	instance.matrix = instance.Transform.GetMatrix()
+	instance.inverse = instance.matrix.Inverse()
+	instance.normalMatrix = instance.inverse.Transposed()
+	determinant := instance.matrix.Determinant()
+	// Average scale factor, for turning world space lengths into object space ones
+	instance.scale = math.Cbrt(math.Abs(determinant))
+}
+
+func (instance *Instance) PointToWorld(p Math.Vector3) Math.Vector3 {
+	return instance.matrix.VecMul(p).Add(instance.Transform.GetPosition())
+}
+
+func (instance *Instance) NormalToWorld(n Math.Vector3) Math.Vector3 {
+	if instance.identity {
+		return n
+	}
+	return instance.normalMatrix.VecMul(n).Normalized()
+}
+
+// Object space ray. The direction is not normalized, so that hit distances stay the same in both spaces
+
+func (instance *Instance) RayToObject(rDirection, rOrigin Math.Vector3) (Math.Vector3, Math.Vector3) {
+	return instance.inverse.VecMul(rDirection), instance.inverse.VecMul(rOrigin.Sub(instance.Transform.GetPosition()))
+}
+
+// World space bounding box of the instance
+
+func (instance *Instance) worldAABB() *AABoundingBox {
+	box := &instance.bounds
+	aabb := NewAABB(Math.InfiniteVector3(), Math.NegativeInfiniteVector3())
+	for i := 0; i < 8; i++ {
+		corner := box.Point1
+		if i&1 != 0 {
+			corner.X = box.Point2.X
+		}
+		if i&2 != 0 {
+			corner.Y = box.Point2.Y
+		}
+		if i&4 != 0 {
+			corner.Z = box.Point2.Z
+		}
+		p := instance.PointToWorld(corner)
+		aabb.Point1 = Math.Vector3{X: math.Min(aabb.Point1.X, p.X), Y: math.Min(aabb.Point1.Y, p.Y), Z: math.Min(aabb.Point1.Z, p.Z)}
+		aabb.Point2 = Math.Vector3{X: math.Max(aabb.Point2.X, p.X), Y: math.Max(aabb.Point2.Y, p.Y), Z: math.Max(aabb.Point2.Z, p.Z)}
+	}
+	return aabb
+}
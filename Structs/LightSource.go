@@ -17,6 +17,9 @@ type LightSource interface {
 	GetPosition() Math.Vector3
 	GetID() int
 	GetRandomPoint(gen *rand.Rand) Math.Vector3
+	// Random photon leaving the light, towards the scene bounding sphere. The power is the flux of the whole light as
+	// estimated from this one photon, so it has to be divided by the photon count
+	EmitPhoton(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (origin, direction, power Math.Vector3)
 }
 
 // Point Light
@@ -42,6 +45,11 @@ func (p *PointLight) GetRandomPoint(gen *rand.Rand) Math.Vector3 {
 	return Utils.RandomPointOnSphere(gen)
 }
 
+func (p *PointLight) EmitPhoton(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (Math.Vector3, Math.Vector3, Math.Vector3) {
+	direction := Utils.UniformSampleSphere(gen.Float64(), gen.Float64())
+	return p.Position, direction, p.Color.FMul(p.Intensity * 4 * math.Pi)
+}
+
 func (p *PointLight) GetPosition() Math.Vector3 {
 	return p.Position
 }
@@ -90,6 +98,15 @@ func (s *SunLight) GetRandomPoint(gen *rand.Rand) Math.Vector3 {
 	return s.Direction
 }
 
+// Sun photons start on a disk covering the whole scene
+
+func (s *SunLight) EmitPhoton(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (Math.Vector3, Math.Vector3, Math.Vector3) {
+	direction := s.Direction.Normalized()
+	offset := Utils.UniformSampleDisk(gen.Float64(), gen.Float64()).FMul(sceneRadius).FromSingleVectorBasis(direction)
+	origin := sceneCenter.Add(offset).Sub(direction.FMul(sceneRadius))
+	return origin, direction, s.Color.FMul(s.Intensity * math.Pi * sceneRadius * sceneRadius)
+}
+
 func (s *SunLight) GetPosition() Math.Vector3 {
 	return s.Direction.Inverse().FMul(AnArbitrarilyBigNumber)
 }
@@ -142,6 +159,13 @@ func (c *ConeLight) GetRandomPoint(gen *rand.Rand) Math.Vector3 {
 	return p
 }
 
+func (c *ConeLight) EmitPhoton(gen *rand.Rand, sceneCenter Math.Vector3, sceneRadius float64) (Math.Vector3, Math.Vector3, Math.Vector3) {
+	cosMax := math.Max(math.Min(c.Falloff, 1), -1)
+	direction := Utils.UniformSampleCone(gen.Float64(), gen.Float64(), cosMax).FromSingleVectorBasis(c.Direction.Normalized())
+	solidAngle := 2 * math.Pi * (1 - cosMax)
+	return c.Position, direction, c.Color.FMul(c.GetLightIntensityInDirection(direction) * solidAngle)
+}
+
 func (c *ConeLight) GetPosition() Math.Vector3 {
 	return c.Position
 }
@@ -151,9 +175,8 @@ func (c *ConeLight) GetLightDirectionTo(point Math.Vector3) Math.Vector3 {
 }
 
 func (c *ConeLight) GetLightIntensityTo(point Math.Vector3) float64 {
-	d := c.Position.Sub(point).LenSq()
-	falloff := math.Max((c.Direction.Dot(c.GetLightDirectionTo(point))-c.Falloff)*(1-c.Falloff), 0)
-	return d * falloff
+	toPoint := point.Sub(c.Position)
+	return c.GetLightIntensityInDirection(toPoint.Normalized()) / toPoint.LenSq()
 }
 
 func (c *ConeLight) GetLightIntensityInDirection(dir Math.Vector3) float64 {
@@ -2,6 +2,7 @@ package Structs
 
 import (
 	"Photon/Math"
+	"math"
 )
 
 // BRDF function interface
@@ -10,65 +11,140 @@ import (
 type IBRDF interface {
 	Sample(view, indescent, normal, lightColor, albedo Math.Vector3, lightIntensity, roughness, metallic, ior float64) Math.Vector3
 	// View, Light, Normal, light color, light intensity, albedo, roughness, metallic, ior -> color
+	SampleDirection(wo, n Math.Vector3, u Math.Vector2, albedo Math.Vector3, roughness, metallic, ior float64) (Math.Vector3,
+		Math.Vector3, float64)
+	// Importance sampling. Both directions point away from the surface and the normal faces wo, u holds two uniform
+	// random numbers. Returns wi, the weight f(wo, wi) * cos(wi) / pdf and the pdf (zero weight if wi is below the
+	// surface)
+	Pdf(wo, wi, n, albedo Math.Vector3, roughness, metallic, ior float64) float64
+	// Solid angle pdf of SampleDirection returning wi
+}
+
+// BRDFs depending on the material extras (sheen, clearcoat, transmission). Every material keeps its own copy, set up again
+// whenever the extras change
+
+type IMaterialBRDF interface {
+	ForMaterial(material *Material) IBRDF
+}
+
+// BRDFs letting light through the surface (BSDFs). Their Sample also handles light arriving from below the surface
+
+type ITransmittingBRDF interface {
+	Transmits() bool
 }
 
 type Material struct {
 	// Albedo
 	albedoTexture     *TextureRGB
 	albedoTextureUsed bool
+	albedoSampler     Sampler
 	albedoColor       Math.Vector3
 	// Roughness
 	roughnessTexture     *TextureGrayscale
 	roughnessTextureUsed bool
+	roughnessSampler     Sampler
 	roughness            float64
 	// Metallic
 	metallicTexture     *TextureGrayscale
 	metallicTextureUsed bool
+	metallicSampler     Sampler
 	metallic            float64
+	// Emission
+	emissionTexture     *TextureRGB
+	emissionTextureUsed bool
+	emissionSampler     Sampler
+	emission            Math.Vector3
+	// Normal and bump maps
+	normalTexture *TextureRGB
+	normalSampler Sampler
+	bumpTexture   *TextureGrayscale
+	bumpSampler   Sampler
+	// PBR extras
+	sheen              float64
+	clearcoat          float64
+	clearcoatRoughness float64
+	// Share of the light going through the surface, for BSDFs that transmit
+	transmission float64
+	// Dissolve (1 - transparency)
+	opacity float64
+	// Alpha cutout (map_d, scaled by the dissolve). Hits where the alpha is below the cutoff are ignored. Without map_d
+	// the dissolve alone only cuts with stochastic alpha, a fixed cutoff would remove partly dissolved surfaces whole
+	opacityTexture *TextureGrayscale
+	opacitySampler Sampler
+	alphaCutoff    float64
 	// IOR
 	ior float64
+	// Per-vertex colors (PLY scans and such) multiply the albedo
+	vertexColorsUsed bool
+	// Medium inside the mesh. Surfaces with a medium are not shaded, they only mark the medium boundary
+	medium *Medium
+	// Subsurface scattering: the share of the light going under the surface, its mean free path (in world units) and
+	// the color of the surface after multiple scattering (the albedo if not set)
+	subsurface       float64
+	subsurfaceRadius Math.Vector3
+	subsurfaceColor  Math.Vector3
 	// BRDF function
 	BRDF IBRDF
 }
 
-func (material *Material) sampleTextures(uv Math.Vector2) (Math.Vector3, float64, float64) {
-	var albedo Math.Vector3
-	if material.albedoTextureUsed {
-		albedo = material.albedoTexture.At(uv)
-	} else {
-		albedo = material.albedoColor
-	}
-	var roughness float64
-	if material.roughnessTextureUsed {
-		roughness = material.roughnessTexture.At(uv)
-	} else {
-		roughness = material.roughness
+// Default material for the formats that don't carry any material data (PLY, STL)
+
+func NewMaterial(brdf IBRDF) *Material {
+	material := &Material{
+		albedoColor:      Math.Vector3{X: 0.8, Y: 0.8, Z: 0.8},
+		roughness:        0.5,
+		metallic:         0,
+		ior:              1.45,
+		opacity:          1,
+		alphaCutoff:      0.5,
+		subsurfaceRadius: Math.Vector3{X: 0.1, Y: 0.1, Z: 0.1},
+		BRDF:             brdf,
 	}
-	var metallic float64
-	if material.metallicTextureUsed {
-		metallic = material.metallicTexture.At(uv)
-	} else {
-		metallic = material.metallic
+	material.updateBRDF()
+	return material
+}
+
+func (material *Material) updateBRDF() {
+	if brdf, ok := material.BRDF.(IMaterialBRDF); ok {
+		material.BRDF = brdf.ForMaterial(material)
 	}
-	return albedo, roughness, metallic
 }
 
-func (material *Material) SampleAlbedo(uv Math.Vector2) Math.Vector3 {
+// All the sampling functions take the texture footprint in UV units (0 samples the full resolution textures)
+
+func (material *Material) sampleTextures(uv Math.Vector2, uvFootprint float64) (Math.Vector3, float64, float64) {
+	return material.SampleAlbedo(uv, uvFootprint), material.GetRoughness(uv, uvFootprint), material.GetMetallic(uv, uvFootprint)
+}
+
+func (material *Material) SampleAlbedo(uv Math.Vector2, uvFootprint float64) Math.Vector3 {
 	if material.albedoTextureUsed {
-		return material.albedoTexture.At(uv)
+		return material.albedoSampler.SampleRGB(material.albedoTexture, uv, uvFootprint)
 	} else {
 		return material.albedoColor
 	}
 }
 
-func (material *Material) SampleLight(uv Math.Vector2, v, l, n Math.Vector3, li float64, lc Math.Vector3) Math.Vector3 {
-	albedo, roughness, metallic := material.sampleTextures(uv)
+func (material *Material) SampleEmission(uv Math.Vector2, uvFootprint float64) Math.Vector3 {
+	if material.emissionTextureUsed {
+		return material.emissionSampler.SampleRGB(material.emissionTexture, uv, uvFootprint).Mul(material.emission)
+	} else {
+		return material.emission
+	}
+}
+
+func (material *Material) SampleLight(uv Math.Vector2, uvFootprint float64, v, l, n Math.Vector3, li float64, lc Math.Vector3) Math.Vector3 {
+	albedo, roughness, metallic := material.sampleTextures(uv, uvFootprint)
 	return material.BRDF.Sample(v, l, n, lc, albedo, li, roughness, metallic, material.ior)
 }
 
+func (material *Material) sampleTintedLight(uv Math.Vector2, uvFootprint float64, tint, v, l, n Math.Vector3, li float64, lc Math.Vector3) Math.Vector3 {
+	albedo, roughness, metallic := material.sampleTextures(uv, uvFootprint)
+	return material.BRDF.Sample(v, l, n, lc, albedo.Mul(tint), li, roughness, metallic, material.ior)
+}
+
 func (material *Material) SampleSimplifiedLight(uv Math.Vector2, l, n Math.Vector3, li float64, lc Math.Vector3) Math.Vector3 {
 	lnDot := ((l.Dot(n)+1)/2 + 0.2) / 1.2
-	albedo, _, _ := material.sampleTextures(uv)
+	albedo := material.SampleAlbedo(uv, 0)
 	return albedo.Mul(lc.FMul(lnDot * li))
 }
 
@@ -79,8 +155,13 @@ func (material *Material) SetMetallic(ka float64) {
 	material.metallicTextureUsed = false
 }
 
-func (material *Material) SetMetallicTexture(mapKa *TextureGrayscale) {
-	material.metallicTexture = mapKa
+func (material *Material) SetMetallicTexture(mapPm *TextureGrayscale) {
+	material.SetMetallicTextureWithOptions(mapPm, DefaultTextureOptions())
+}
+
+func (material *Material) SetMetallicTextureWithOptions(mapPm *TextureGrayscale, options TextureOptions) {
+	material.metallicTexture = mapPm
+	material.metallicSampler = NewSampler(options)
 	material.metallicTextureUsed = true
 }
 
@@ -90,7 +171,12 @@ func (material *Material) SetAlbedo(kd Math.Vector3) {
 }
 
 func (material *Material) SetAlbedoTexture(mapKd *TextureRGB) {
+	material.SetAlbedoTextureWithOptions(mapKd, DefaultTextureOptions())
+}
+
+func (material *Material) SetAlbedoTextureWithOptions(mapKd *TextureRGB, options TextureOptions) {
 	material.albedoTexture = mapKd
+	material.albedoSampler = NewSampler(options)
 	material.albedoTextureUsed = true
 }
 
@@ -99,19 +185,197 @@ func (material *Material) SetRoughness(ks float64) {
 	material.roughnessTextureUsed = false
 }
 
-func (material *Material) SetRoughnessTexture(mapKs *TextureGrayscale) {
-	material.roughnessTexture = mapKs
+func (material *Material) SetRoughnessTexture(mapPr *TextureGrayscale) {
+	material.SetRoughnessTextureWithOptions(mapPr, DefaultTextureOptions())
+}
+
+func (material *Material) SetRoughnessTextureWithOptions(mapPr *TextureGrayscale, options TextureOptions) {
+	material.roughnessTexture = mapPr
+	material.roughnessSampler = NewSampler(options)
 	material.roughnessTextureUsed = true
 }
 
+func (material *Material) SetEmission(ke Math.Vector3) {
+	material.emission = ke
+}
+
+func (material *Material) SetEmissionTextureWithOptions(mapKe *TextureRGB, options TextureOptions) {
+	material.emissionTexture = mapKe
+	material.emissionSampler = NewSampler(options)
+	material.emissionTextureUsed = true
+	// Ke scales the texture, so it has to be white unless specified otherwise
+	if material.emission.Equal(Math.ZeroVector3()) {
+		material.emission = Math.Vector3{X: 1, Y: 1, Z: 1}
+	}
+}
+
+func (material *Material) SetNormalTextureWithOptions(norm *TextureRGB, options TextureOptions) {
+	material.normalTexture = norm
+	material.normalSampler = NewSampler(options)
+}
+
+func (material *Material) SetBumpTextureWithOptions(bump *TextureGrayscale, options TextureOptions) {
+	material.bumpTexture = bump
+	material.bumpSampler = NewSampler(options)
+}
+
+func (material *Material) HasNormalPerturbation() bool {
+	return material.normalTexture != nil || material.bumpTexture != nil
+}
+
+// Normal mapping. The tangent frame follows the UV directions, the uvScale (UV units per world unit) turns bump map
+// heights into world space slopes
+
+func (material *Material) PerturbNormal(uv Math.Vector2, uvFootprint, uvScale float64, normal, tangent, bitangent Math.Vector3) Math.Vector3 {
+	if material.normalTexture != nil {
+		c := material.normalSampler.SampleRGB(material.normalTexture, uv, uvFootprint)
+		bm := material.normalSampler.Options.BumpMultiplier
+		n := Math.Vector3{X: (c.X*2 - 1) * bm, Y: (c.Y*2 - 1) * bm, Z: c.Z*2 - 1}
+		normal = tangent.FMul(n.X).Add(bitangent.FMul(n.Y)).Add(normal.FMul(n.Z)).Normalized()
+		if material.bumpTexture != nil {
+			// Both maps are applied, the bump map on top of the normal map
+			tangent = tangent.Sub(normal.FMul(normal.Dot(tangent))).Normalized()
+			bitangent = bitangent.Sub(normal.FMul(normal.Dot(bitangent))).Normalized()
+		}
+	}
+	if material.bumpTexture != nil {
+		// Finite differences, at least a texel apart
+		delta := math.Max(uvFootprint, 1/float64(max(material.bumpTexture.Width, material.bumpTexture.Height)))
+		h := material.bumpSampler.SampleGrayscale(material.bumpTexture, uv, uvFootprint)
+		hu := material.bumpSampler.SampleGrayscale(material.bumpTexture, Math.Vector2{U: uv.U + delta, V: uv.V}, uvFootprint)
+		hv := material.bumpSampler.SampleGrayscale(material.bumpTexture, Math.Vector2{U: uv.U, V: uv.V + delta}, uvFootprint)
+		scale := material.bumpSampler.Options.BumpMultiplier * uvScale / delta
+		normal = normal.Sub(tangent.FMul((hu - h) * scale)).Sub(bitangent.FMul((hv - h) * scale)).Normalized()
+	}
+	return normal
+}
+
+func (material *Material) SetSheen(ps float64) {
+	material.sheen = ps
+	material.updateBRDF()
+}
+
+func (material *Material) SetClearcoat(pc float64) {
+	material.clearcoat = pc
+	material.updateBRDF()
+}
+
+func (material *Material) SetClearcoatRoughness(pcr float64) {
+	material.clearcoatRoughness = pcr
+	material.updateBRDF()
+}
+
+func (material *Material) SetOpacity(d float64) {
+	material.opacity = d
+}
+
+func (material *Material) SetTransmission(transmission float64) {
+	material.transmission = math.Min(math.Max(transmission, 0), 1)
+	material.updateBRDF()
+}
+
+func (material *Material) SetOpacityTextureWithOptions(mapD *TextureGrayscale, options TextureOptions) {
+	material.opacityTexture = mapD
+	material.opacitySampler = NewSampler(options)
+}
+
+func (material *Material) SetAlphaCutoff(cutoff float64) {
+	material.alphaCutoff = cutoff
+}
+
+func (material *Material) SetVertexColorsUsed(used bool) {
+	material.vertexColorsUsed = used
+}
+
 func (material *Material) SetIOR(ior float64) {
 	material.ior = ior
 }
 
-func (material *Material) GetRoughness(uv Math.Vector2) float64 {
+func (material *Material) SetBRDF(brdf IBRDF) {
+	material.BRDF = brdf
+	material.updateBRDF()
+}
+
+func (material *Material) SetMedium(medium *Medium) {
+	material.medium = medium
+}
+
+func (material *Material) GetRoughness(uv Math.Vector2, uvFootprint float64) float64 {
 	if material.roughnessTextureUsed {
-		return material.roughnessTexture.At(uv)
+		return material.roughnessSampler.SampleGrayscale(material.roughnessTexture, uv, uvFootprint)
 	} else {
 		return material.roughness
 	}
 }
+
+func (material *Material) GetMetallic(uv Math.Vector2, uvFootprint float64) float64 {
+	if material.metallicTextureUsed {
+		return material.metallicSampler.SampleGrayscale(material.metallicTexture, uv, uvFootprint)
+	} else {
+		return material.metallic
+	}
+}
+
+func (material *Material) GetIOR() float64 {
+	return material.ior
+}
+
+func (material *Material) GetSheen() float64 {
+	return material.sheen
+}
+
+func (material *Material) GetClearcoat() (float64, float64) {
+	return material.clearcoat, material.clearcoatRoughness
+}
+
+func (material *Material) GetTransmission() float64 {
+	return material.transmission
+}
+
+func (material *Material) Transmits() bool {
+	brdf, ok := material.BRDF.(ITransmittingBRDF)
+	return ok && brdf.Transmits()
+}
+
+func (material *Material) HasAlphaCutout(stochastic bool) bool {
+	return material.opacityTexture != nil || (stochastic && material.opacity < 1)
+}
+
+func (material *Material) GetAlphaCutoff() float64 {
+	return material.alphaCutoff
+}
+
+func (material *Material) SampleAlpha(uv Math.Vector2, uvFootprint float64) float64 {
+	if material.opacityTexture == nil {
+		return material.opacity
+	}
+	return material.opacity * material.opacitySampler.SampleGrayscale(material.opacityTexture, uv, uvFootprint)
+}
+
+func (material *Material) SetSubsurface(sss float64) {
+	material.subsurface = math.Min(math.Max(sss, 0), 1)
+}
+
+func (material *Material) SetSubsurfaceRadius(radius Math.Vector3) {
+	material.subsurfaceRadius = radius
+}
+
+func (material *Material) SetSubsurfaceColor(color Math.Vector3) {
+	material.subsurfaceColor = color
+}
+
+func (material *Material) GetSubsurface() float64 {
+	return material.subsurface
+}
+
+func (material *Material) GetMedium() *Medium {
+	return material.medium
+}
+
+func (material *Material) IsMediumBoundary() bool {
+	return material.medium != nil
+}
+
+func (material *Material) IsEmissive() bool {
+	return !material.emission.Equal(Math.ZeroVector3())
+}
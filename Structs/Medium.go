@@ -0,0 +1,119 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"math"
+)
+
+// Participating media
+// Homogeneous media, with absorption and scattering coefficients per unit length (per color channel) and a
+// Henyey-Greenstein phase function. A medium fills either the whole scene (the scene medium, bounded by the scene
+// bounding sphere so that rays can still escape to the environment) or the inside of closed meshes whose material
+// carries it. The surfaces of such meshes only mark the medium boundary, rays go straight through them
+
+type Medium struct {
+	Absorption Math.Vector3
+	Scattering Math.Vector3
+	// Henyey-Greenstein asymmetry, from -1 (back scattering) to 1 (forward scattering)
+	G float64
+}
+
+func NewMedium(absorption, scattering Math.Vector3, g float64) *Medium {
+	medium := &Medium{
+		Absorption: absorption,
+		Scattering: scattering,
+	}
+	medium.SetAsymmetry(g)
+	return medium
+}
+
+// The phase function turns into a delta at -1 and 1, so the asymmetry is kept a bit away from them
+
+func (medium *Medium) SetAsymmetry(g float64) {
+	medium.G = math.Min(math.Max(g, -0.99), 0.99)
+}
+
+func (medium *Medium) Extinction() Math.Vector3 {
+	return medium.Absorption.Add(medium.Scattering)
+}
+
+func (medium *Medium) Transmittance(distance float64) Math.Vector3 {
+	extinction := medium.Extinction()
+	return Math.Vector3{
+		X: math.Exp(-extinction.X * distance),
+		Y: math.Exp(-extinction.Y * distance),
+		Z: math.Exp(-extinction.Z * distance),
+	}
+}
+
+// Phase function for the cosine of the angle between the travel directions before and after scattering
+
+func (medium *Medium) Phase(cos float64) float64 {
+	g := medium.G
+	denominator := 1 + g*g - 2*g*cos
+	return (1 - g*g) / (4 * math.Pi * denominator * math.Sqrt(denominator))
+}
+
+// Samples the travel direction after scattering proportionally to the phase function, so the sample weight is 1
+
+func (medium *Medium) SamplePhase(direction Math.Vector3, u1, u2 float64) Math.Vector3 {
+	g := medium.G
+	var cos float64
+	if math.Abs(g) < 1e-3 {
+		cos = 1 - 2*u1
+	} else {
+		s := (1 - g*g) / (1 - g + 2*g*u1)
+		cos = (1 + g*g - s*s) / (2 * g)
+	}
+	cos = math.Min(math.Max(cos, -1), 1)
+	sin := math.Sqrt(1 - cos*cos)
+	phi := 2 * math.Pi * u2
+	local := Math.Vector3{X: sin * math.Cos(phi), Y: sin * math.Sin(phi), Z: cos}
+	return local.FromSingleVectorBasis(direction)
+}
+
+// Samples a free flight distance with the extinction of a random color channel, weighted with the pdfs of all of
+// them (one-sample MIS), so that the weights stay bounded even when the channels differ a lot. If the interaction
+// happens before maxDistance, returns its distance and the scattering coefficient times the transmittance over the
+// pdf. Otherwise returns maxDistance and the transmittance over the probability of getting that far
+
+func (medium *Medium) SampleDistance(u, maxDistance float64) (float64, Math.Vector3, bool) {
+	extinction := medium.Extinction()
+	if extinction.X <= 0 && extinction.Y <= 0 && extinction.Z <= 0 {
+		return maxDistance, Math.Vector3{X: 1, Y: 1, Z: 1}, false
+	}
+	// The channel is picked with the first digit of u, the rest of it samples the distance
+	channel := min(int(u*3), 2)
+	u = u*3 - float64(channel)
+	channelExtinction := [3]float64{extinction.X, extinction.Y, extinction.Z}[channel]
+	distance := math.Inf(1)
+	if channelExtinction > 0 {
+		distance = -math.Log(1-u) / channelExtinction
+	}
+	if distance < maxDistance {
+		transmittance := medium.Transmittance(distance)
+		pdf := extinction.Mul(transmittance)
+		return distance, medium.Scattering.Mul(transmittance).FDiv((pdf.X + pdf.Y + pdf.Z) / 3), true
+	}
+	transmittance := medium.Transmittance(maxDistance)
+	return maxDistance, transmittance.FDiv((transmittance.X + transmittance.Y + transmittance.Z) / 3), false
+}
+
+// Medium inside subsurface scattering materials, from the mean free path and the color the surface should have after
+// multiple scattering (both per color channel). The single scattering albedo comes from the van de Hulst inversion of
+// the multiple scattering albedo, as in the random walk of Cycles. Scattering is isotropic
+
+func NewSubsurfaceMedium(color, radius Math.Vector3) *Medium {
+	albedo := func(c float64) float64 {
+		c = math.Min(math.Max(c, 0), 0.999)
+		s := 4.09712 + 4.20863*c - math.Sqrt(9.59217+41.6808*c+17.7126*c*c)
+		return 1 - s*s
+	}
+	extinction := Math.Vector3{
+		X: 1 / math.Max(radius.X, 1e-4),
+		Y: 1 / math.Max(radius.Y, 1e-4),
+		Z: 1 / math.Max(radius.Z, 1e-4),
+	}
+	scattering := extinction.Mul(Math.Vector3{X: albedo(color.X), Y: albedo(color.Y), Z: albedo(color.Z)})
+	return NewMedium(extinction.Sub(scattering), scattering, 0)
+}
@@ -3,6 +3,7 @@ package Structs
 import (
 	"Photon/Math"
 	"Photon/Utils"
+	"math"
 )
 
 type Mesh struct {
@@ -57,3 +58,96 @@ func (mesh *Mesh) Copy() *Mesh {
 		middle:    mesh.middle,
 	}
 }
+
+// Tangent generation, following MikkTSpace: per-face tangents are projected onto the vertex normals and averaged with
+// angle weights over the corners sharing a position, normal, UV and UV orientation. Triangles without a UV mapping are
+// left with zero tangents
+
+type tangentKey struct {
+	position Math.Vector3
+	normal   Math.Vector3
+	texcoord Math.Vector2
+	flipped  bool
+}
+
+type tangentSum struct {
+	tangent   Math.Vector3
+	bitangent Math.Vector3
+}
+
+func (mesh *Mesh) CalculateTangents() {
+	sums := make(map[tangentKey]*tangentSum)
+	keys := make([][3]tangentKey, len(mesh.Triangles))
+	valid := make([]bool, len(mesh.Triangles))
+
+	for i := 0; i < len(mesh.Triangles); i++ {
+		tri := &mesh.Triangles[i]
+		positions := [3]Math.Vector3{tri.V1Pos, tri.V2Pos, tri.V3Pos}
+		texcoords := [3]Math.Vector2{tri.V1Tex, tri.V2Tex, tri.V3Tex}
+		normals := [3]Math.Vector3{tri.TriangleNormal, tri.TriangleNormal, tri.TriangleNormal}
+		if tri.Smooth {
+			normals = [3]Math.Vector3{tri.V1Normal, tri.V2Normal, tri.V3Normal}
+		}
+
+		duv1 := texcoords[1].Sub(texcoords[0])
+		duv2 := texcoords[2].Sub(texcoords[0])
+		det := duv1.U*duv2.V - duv2.U*duv1.V
+		if math.Abs(det) < 1e-12 {
+			continue
+		}
+		dp1 := tri.Edge12()
+		dp2 := tri.Edge13()
+		faceTangent := dp1.FMul(duv2.V).Sub(dp2.FMul(duv1.V)).FDiv(det)
+		faceBitangent := dp2.FMul(duv1.U).Sub(dp1.FMul(duv2.U)).FDiv(det)
+		valid[i] = true
+
+		for c := 0; c < 3; c++ {
+			n := normals[c]
+			// Corner angle weight
+			e1 := positions[(c+1)%3].Sub(positions[c]).Normalized()
+			e2 := positions[(c+2)%3].Sub(positions[c]).Normalized()
+			angle := math.Acos(math.Min(math.Max(e1.Dot(e2), -1), 1))
+			t := faceTangent.Sub(n.FMul(n.Dot(faceTangent)))
+			b := faceBitangent.Sub(n.FMul(n.Dot(faceBitangent)))
+			if t.LenSq() > 0 {
+				t = t.Normalized()
+			}
+			if b.LenSq() > 0 {
+				b = b.Normalized()
+			}
+
+			key := tangentKey{positions[c], n, texcoords[c], det < 0}
+			keys[i][c] = key
+			sum := sums[key]
+			if sum == nil {
+				sum = &tangentSum{}
+				sums[key] = sum
+			}
+			sum.tangent = sum.tangent.Add(t.FMul(angle))
+			sum.bitangent = sum.bitangent.Add(b.FMul(angle))
+		}
+	}
+
+	for i := 0; i < len(mesh.Triangles); i++ {
+		if !valid[i] {
+			continue
+		}
+		var tangents [3]Math.Vector4
+		for c := 0; c < 3; c++ {
+			key := keys[i][c]
+			sum := sums[key]
+			t := sum.tangent.Sub(key.normal.FMul(key.normal.Dot(sum.tangent)))
+			if t.LenSq() == 0 {
+				continue
+			}
+			t = t.Normalized()
+			sign := 1.0
+			if key.normal.Cross(t).Dot(sum.bitangent) < 0 {
+				sign = -1
+			}
+			tangents[c] = Math.Vector4{X: t.X, Y: t.Y, Z: t.Z, W: sign}
+		}
+		tri := &mesh.Triangles[i]
+		tri.V1Tangent, tri.V2Tangent, tri.V3Tangent = tangents[0], tangents[1], tangents[2]
+	}
+}
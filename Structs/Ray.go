@@ -7,7 +7,31 @@ import (
 
 const epsilon = 0.00001
 
+type Ray struct {
+	Origin    Math.Vector3
+	Direction Math.Vector3
+	// Random bits for the stochastic alpha test, so that repeated samples along the same ray don't always hit the same
+	// surfaces. Optional, rays without one are still told apart by their origin and direction
+	Seed uint64
+}
+
+// Smallest ray parameter that isn't a self-intersection, for rays leaving a surface
+
+func (ray Ray) MinT() float64 {
+	return MinHitDistance / ray.Direction.Len()
+}
+
 func IntersectRayTriangle(rDirection, rOrigin Math.Vector3, tri *Triangle) (hit bool, intersectionPoint Math.Vector3, barycentricIntersection Math.Vector2) {
+	hit, t, barycentricIntersection := IntersectRayTriangleDistance(rDirection, rOrigin, tri)
+	if !hit {
+		return false, Math.ZeroVector3(), Math.ZeroVector2()
+	}
+	return true, rOrigin.Add(rDirection.FMul(t)), barycentricIntersection
+}
+
+// Same as IntersectRayTriangle, but returns the ray parameter of the hit instead of the point
+
+func IntersectRayTriangleDistance(rDirection, rOrigin Math.Vector3, tri *Triangle) (hit bool, t float64, barycentricIntersection Math.Vector2) {
 	var h, s, q Math.Vector3
 	e1 := tri.Edge12()
 	e2 := tri.Edge13()
@@ -16,7 +40,7 @@ func IntersectRayTriangle(rDirection, rOrigin Math.Vector3, tri *Triangle) (hit
 	a = e1.Dot(h)
 
 	if a > -epsilon && a < epsilon {
-		return false, Math.ZeroVector3(), Math.ZeroVector2()
+		return false, 0, Math.ZeroVector2()
 	}
 
 	f = 1 / a
@@ -24,23 +48,22 @@ func IntersectRayTriangle(rDirection, rOrigin Math.Vector3, tri *Triangle) (hit
 	u = f * s.Dot(h)
 
 	if u < 0 || u > 1 { // U + V must be less than 1
-		return false, Math.ZeroVector3(), Math.ZeroVector2()
+		return false, 0, Math.ZeroVector2()
 	}
 
 	q = s.Cross(e1)
 	v = f * rDirection.Dot(q)
 
 	if v < 0 || u+v > 1 {
-		return false, Math.ZeroVector3(), Math.ZeroVector2()
+		return false, 0, Math.ZeroVector2()
 	}
 
-	t := f * e2.Dot(q)
+	t = f * e2.Dot(q)
 
 	if t <= epsilon {
-		return false, Math.ZeroVector3(), Math.ZeroVector2()
+		return false, 0, Math.ZeroVector2()
 	}
-	p := rOrigin.Add(rDirection.FMul(t))
-	return true, p, Math.Vector2{u, v}
+	return true, t, Math.Vector2{u, v}
 }
 
 func IntersectRayAABB(rDirection, rOrigin Math.Vector3, aabb *AABoundingBox) bool {
@@ -65,3 +88,72 @@ func IntersectRayAABB(rDirection, rOrigin Math.Vector3, aabb *AABoundingBox) boo
 
 	return true
 }
+
+// Same as IntersectRayAABB, but also returns the entry distance (0 when the origin is inside the box)
+
+func IntersectRayAABBDistance(rDirection, rOrigin Math.Vector3, aabb *AABoundingBox) (bool, float64) {
+	dirFrac := Math.Vector3{
+		X: 1.0 / rDirection.X,
+		Y: 1.0 / rDirection.Y,
+		Z: 1.0 / rDirection.Z,
+	}
+	t1 := (aabb.Point1.X - rOrigin.X) * dirFrac.X
+	t2 := (aabb.Point2.X - rOrigin.X) * dirFrac.X
+	t3 := (aabb.Point1.Y - rOrigin.Y) * dirFrac.Y
+	t4 := (aabb.Point2.Y - rOrigin.Y) * dirFrac.Y
+	t5 := (aabb.Point1.Z - rOrigin.Z) * dirFrac.Z
+	t6 := (aabb.Point2.Z - rOrigin.Z) * dirFrac.Z
+
+	tmin := math.Max(math.Max(math.Min(t1, t2), math.Min(t3, t4)), math.Min(t5, t6))
+	tmax := math.Min(math.Min(math.Max(t1, t2), math.Max(t3, t4)), math.Max(t5, t6))
+
+	if tmax < 0 || tmax < tmin {
+		return false, 0
+	}
+	return true, math.Max(tmin, 0)
+}
+
+// Slab test with a precomputed inverse ray direction, clipped to the [tMin, tMax] ray interval. Returns the distance at
+// which the ray enters the box (tMin when the interval starts inside of it). NaNs from axis-parallel rays are ignored,
+// so such rays are treated conservatively
+
+func IntersectRayAABBInterval(invDirection, rOrigin Math.Vector3, aabb *AABoundingBox, tMin, tMax float64) (bool, float64) {
+	t1 := (aabb.Point1.X - rOrigin.X) * invDirection.X
+	t2 := (aabb.Point2.X - rOrigin.X) * invDirection.X
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t1 > tMin {
+		tMin = t1
+	}
+	if t2 < tMax {
+		tMax = t2
+	}
+	t1 = (aabb.Point1.Y - rOrigin.Y) * invDirection.Y
+	t2 = (aabb.Point2.Y - rOrigin.Y) * invDirection.Y
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t1 > tMin {
+		tMin = t1
+	}
+	if t2 < tMax {
+		tMax = t2
+	}
+	t1 = (aabb.Point1.Z - rOrigin.Z) * invDirection.Z
+	t2 = (aabb.Point2.Z - rOrigin.Z) * invDirection.Z
+	if t1 > t2 {
+		t1, t2 = t2, t1
+	}
+	if t1 > tMin {
+		tMin = t1
+	}
+	if t2 < tMax {
+		tMax = t2
+	}
+	return tMin <= tMax, tMin
+}
+
+func inverseDirection(rDirection Math.Vector3) Math.Vector3 {
+	return Math.Vector3{X: 1 / rDirection.X, Y: 1 / rDirection.Y, Z: 1 / rDirection.Z}
+}
@@ -2,63 +2,231 @@ package Structs
 
 import (
 	"Photon/Math"
+	"math"
 )
 
-func RayCast(rDirection, rOrigin Math.Vector3, scene *Scene) (bool, Math.Vector3, Math.Vector2, *Triangle) {
-	// First, we iterate through the BVH tree to find possible intersections (there might be more than one)
-	leftoverNodes := []BVHNode{*scene.baseNode}
-	var BVHIntersections []BVHNode
-	for len(leftoverNodes) > 0 {
-		node := leftoverNodes[0]
-		leftoverNodes = leftoverNodes[1:]
-		if IntersectRayAABB(rDirection, rOrigin, node.AABB) {
-			// If the intersected node is a mesh
-			if node.Mesh != nil {
-				BVHIntersections = append(BVHIntersections, node)
-			} else {
-				if node.Child1 != nil && node.Child2 != nil {
-					leftoverNodes = append(leftoverNodes, *node.Child1)
-					leftoverNodes = append(leftoverNodes, *node.Child2)
+// MurmurHash3 finalizer
+
+func mixBits(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xFF51AFD7ED558CCD
+	h ^= h >> 33
+	h *= 0xC4CEB9FE1A85EC53
+	h ^= h >> 33
+	return h
+}
+
+func hashVector(v Math.Vector3) uint64 {
+	return math.Float64bits(v.X)*0x9E3779B97F4A7C15 ^ math.Float64bits(v.Y)*0xC2B2AE3D27D4EB4F ^
+		math.Float64bits(v.Z)*0x165667B19E3779F9
+}
+
+// Stochastic alpha thresholds are hashed from the ray (along with its Seed, which the integrators draw from their
+// random generators) and the hit distance, so that every sample gets its own thresholds, while the traversal stays
+// free of random generator state
+
+func (scene *Scene) alphaSeed(ray Ray) uint64 {
+	if !scene.sceneSettings.StochasticAlpha {
+		return 0
+	}
+	return mixBits(ray.Seed ^ mixBits(hashVector(ray.Origin)^mixBits(hashVector(ray.Direction))))
+}
+
+// Alpha cutout threshold of a hit at the ray parameter t
+
+func alphaThreshold(scene *Scene, tri *Triangle, seed uint64, t float64) float64 {
+	if !scene.sceneSettings.StochasticAlpha {
+		return tri.Material.GetAlphaCutoff()
+	}
+	return float64(mixBits(seed^math.Float64bits(t)*0x9E3779B97F4A7C15)>>11) / (1 << 53)
+}
+
+// Hits closer than that to the ray origin are probably hits of the triangle the ray starts from
+
+const MinHitDistance = 0.01
+
+// Traversal stack. Its buffer lives on the goroutine stack, so a ray cast doesn't allocate unless the tree is deeper
+// than traversalStackSize (the stack then just grows like any slice)
+
+const traversalStackSize = 64
+
+type traversalEntry struct {
+	node   int32
+	tEntry float64
+}
+
+// Pushes the children of an inner node that overlap the ray interval, the nearest one last so that it is popped first
+
+func (bvh *FlatBVH) pushChildren(stack []traversalEntry, nodeIndex int32, invDirection, rOrigin Math.Vector3,
+	tMin, tMax float64) []traversalEntry {
+	first, second := nodeIndex+1, bvh.Nodes[nodeIndex].SecondChild
+	hitFirst, tFirst := IntersectRayAABBInterval(invDirection, rOrigin, &bvh.Nodes[first].AABB, tMin, tMax)
+	hitSecond, tSecond := IntersectRayAABBInterval(invDirection, rOrigin, &bvh.Nodes[second].AABB, tMin, tMax)
+	switch {
+	case hitFirst && hitSecond:
+		if tFirst <= tSecond {
+			return append(stack, traversalEntry{node: second, tEntry: tSecond}, traversalEntry{node: first, tEntry: tFirst})
+		}
+		return append(stack, traversalEntry{node: first, tEntry: tFirst}, traversalEntry{node: second, tEntry: tSecond})
+	case hitFirst:
+		return append(stack, traversalEntry{node: first, tEntry: tFirst})
+	case hitSecond:
+		return append(stack, traversalEntry{node: second, tEntry: tSecond})
+	}
+	return stack
+}
+
+// Finds the closest hit with the ray parameter in (tMin, tMax), or any hit at all. Returns the object space triangle
+// (nil on a miss) along with its instance
+
+func (scene *Scene) traverse(rDirection, rOrigin Math.Vector3, tMin, tMax float64, anyHit bool, seed uint64) (float64,
+	*Triangle, *Instance, Math.Vector2) {
+	if scene.topLevel == nil {
+		return scene.traverseClusters(rDirection, rOrigin, tMin, tMax, anyHit, seed)
+	}
+	if len(scene.topLevel.Order) == 0 {
+		return 0, nil, nil, Math.ZeroVector2()
+	}
+
+	closest := tMax
+	invDirection := inverseDirection(rDirection)
+	var nearestTriangle *Triangle
+	var nearestInstance *Instance
+	var nearestBarycentric Math.Vector2
+
+	// Top level traversal. The nearest child is visited first, and nodes behind the closest hit are skipped
+	top := scene.topLevel
+	var stackBuffer [traversalStackSize]traversalEntry
+	stack := stackBuffer[:0]
+	if hit, tEntry := IntersectRayAABBInterval(invDirection, rOrigin, &top.Nodes[0].AABB, tMin, closest); hit {
+		stack = append(stack, traversalEntry{node: 0, tEntry: tEntry})
+	}
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if entry.tEntry > closest {
+			continue
+		}
+		node := &top.Nodes[entry.node]
+		if node.Count > 0 {
+			for i := node.First; i < node.First+node.Count; i++ {
+				instance := scene.instances[top.Order[i]]
+				oDirection, oOrigin := instance.RayToObject(rDirection, rOrigin)
+				// Ray parameters are the same in both spaces, since the object space direction isn't normalized
+				if tri, bary, ok := instance.intersect(oDirection, oOrigin, tMin, &closest, anyHit, scene, seed); ok {
+					if anyHit {
+						return closest, tri, instance, bary
+					}
+					nearestTriangle = tri
+					nearestInstance = instance
+					nearestBarycentric = bary
 				}
 			}
+			continue
 		}
+		stack = top.pushChildren(stack, entry.node, invDirection, rOrigin, tMin, closest)
 	}
+	return closest, nearestTriangle, nearestInstance, nearestBarycentric
+}
+
+// Bottom level traversal, shrinking closest on every accepted hit
 
-	if len(BVHIntersections) == 0 {
-		// There are no BVH intersections, we can just bail early
-		return false, Math.ZeroVector3(), Math.ZeroVector2(), nil
+func (instance *Instance) intersect(oDirection, oOrigin Math.Vector3, tMin float64, closest *float64, anyHit bool,
+	scene *Scene, seed uint64) (*Triangle, Math.Vector2, bool) {
+	var nearestTriangle *Triangle
+	var nearestBarycentric Math.Vector2
+	bvh := instance.bvh
+	invDirection := inverseDirection(oDirection)
+	var stackBuffer [traversalStackSize]traversalEntry
+	stack := stackBuffer[:0]
+	if hit, tEntry := IntersectRayAABBInterval(invDirection, oOrigin, &bvh.Nodes[0].AABB, tMin, *closest); hit {
+		stack = append(stack, traversalEntry{node: 0, tEntry: tEntry})
+	}
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if entry.tEntry > *closest {
+			continue
+		}
+		node := &bvh.Nodes[entry.node]
+		if node.Count > 0 {
+			for i := node.First; i < node.First+node.Count; i++ {
+				tri := &instance.Mesh.Triangles[bvh.Order[i]]
+				hit, t, bary := IntersectRayTriangleDistance(oDirection, oOrigin, tri)
+				if !hit || t <= tMin || t >= *closest {
+					continue
+				}
+				if !tri.PassesAlphaTest(bary, alphaThreshold(scene, tri, seed, t), scene.sceneSettings.StochasticAlpha) {
+					continue
+				}
+				*closest = t
+				if anyHit {
+					return tri, bary, true
+				}
+				nearestTriangle = tri
+				nearestBarycentric = bary
+			}
+			continue
+		}
+		stack = bvh.pushChildren(stack, entry.node, invDirection, oOrigin, tMin, *closest)
 	}
+	return nearestTriangle, nearestBarycentric, nearestTriangle != nil
+}
+
+// Traversal of the old cluster BVH. Instances are intersected as soon as the top level traversal reaches them
 
-	// Now we iterate through all the intersected nodes and intersect triangles
-	// We can just sort the K-Nearest points by distance. Then finding the first intersection would be enough
-	// It's already guaranteed to be the closest one
+func (scene *Scene) traverseClusters(rDirection, rOrigin Math.Vector3, tMin, tMax float64, anyHit bool,
+	seed uint64) (float64, *Triangle, *Instance, Math.Vector2) {
+	invDirection := inverseDirection(rDirection)
+	closest := tMax
 	var nearestTriangle *Triangle = nil
-	var closestIntersectionPoint Math.Vector3
-	var closestIntersectionBarycentricPoint Math.Vector2
-	for i := 0; i < len(BVHIntersections); i++ {
-		node := BVHIntersections[i]
-		// We iterate through all the clusters in a node and for ones that intersect the ray we intersect triangles
-		// Then we compare the resulting intersected triangles to nearestTriangle
-		for j := 0; j < len(node.TriangleClusters); j++ {
-			if IntersectRayAABB(rDirection, rOrigin, node.TriangleClusters[j].AABB) {
-				// The ray does intersect the cluster AABB, so we iterate through all the triangles and intersect them
-				for k := 0; k < len(node.TriangleClusters[j].Triangles); k++ {
-					tri := &node.TriangleClusters[j].Triangles[k]
-					doesIntersect, intersectionPoint, intersectionBarycentricPoint := IntersectRayTriangle(rDirection, rOrigin, tri)
-					if intersectionPoint.Sub(rOrigin).LenSq() <= 0.0001 { // The intersection point is too close and
-						// is probably an intersection of the triangle the point lies on
-						continue
-					}
-					if doesIntersect && (nearestTriangle == nil || closestIntersectionPoint.Sub(rOrigin).LenSq() > intersectionPoint.Sub(rOrigin).LenSq()) {
-						nearestTriangle = tri
-						closestIntersectionPoint = intersectionPoint
-						closestIntersectionBarycentricPoint = intersectionBarycentricPoint
-					}
+	var nearestInstance *Instance
+	var nearestBarycentric Math.Vector2
+
+	var stackBuffer [traversalStackSize]*BVHNode
+	stack := append(stackBuffer[:0], scene.baseNode)
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hit, _ := IntersectRayAABBInterval(invDirection, rOrigin, node.AABB, tMin, closest); !hit {
+			continue
+		}
+		if node.Instance == nil {
+			if node.Child1 != nil && node.Child2 != nil {
+				stack = append(stack, node.Child2, node.Child1)
+			}
+			continue
+		}
+
+		// The intersected node is an instance, so we intersect the triangles of its clusters in its object space
+		instance := node.Instance
+		blas := instance.blas
+		oDirection, oOrigin := instance.RayToObject(rDirection, rOrigin)
+		oInvDirection := inverseDirection(oDirection)
+		for j := 0; j < len(blas.TriangleClusters); j++ {
+			cluster := &blas.TriangleClusters[j]
+			if hit, _ := IntersectRayAABBInterval(oInvDirection, oOrigin, cluster.AABB, tMin, closest); !hit {
+				continue
+			}
+			// The ray does intersect the cluster AABB, so we iterate through all the triangles and intersect them
+			for k := 0; k < len(cluster.Triangles); k++ {
+				tri := &cluster.Triangles[k]
+				hit, t, bary := IntersectRayTriangleDistance(oDirection, oOrigin, tri)
+				if !hit || t <= tMin || t >= closest {
+					continue
+				}
+				if !tri.PassesAlphaTest(bary, alphaThreshold(scene, tri, seed, t), scene.sceneSettings.StochasticAlpha) {
+					continue
+				}
+				closest = t
+				nearestTriangle = tri
+				nearestInstance = instance
+				nearestBarycentric = bary
+				if anyHit {
+					return closest, nearestTriangle, nearestInstance, nearestBarycentric
 				}
 			}
 		}
 	}
-
-	// Done! Now we can return the intersection point (or lack thereof)
-	return nearestTriangle != nil, closestIntersectionPoint, closestIntersectionBarycentricPoint, nearestTriangle
+	return closest, nearestTriangle, nearestInstance, nearestBarycentric
 }
@@ -0,0 +1,176 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// UV sphere with 2 * segments * segments triangles
+
+func testSphereMesh(name string, center Math.Vector3, radius float64, segments int, material *Material) *Mesh {
+	vertex := func(i, j int) Math.Vector3 {
+		theta := math.Pi * float64(i) / float64(segments)
+		phi := 2 * math.Pi * float64(j) / float64(segments)
+		return center.Add(Math.Vector3{
+			X: math.Sin(theta) * math.Cos(phi),
+			Y: math.Sin(theta) * math.Sin(phi),
+			Z: math.Cos(theta),
+		}.FMul(radius))
+	}
+	mesh := &Mesh{
+		Transform: Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}),
+		MeshName:  name,
+	}
+	for i := 0; i < segments; i++ {
+		for j := 0; j < segments; j++ {
+			quad := [4]Math.Vector3{vertex(i, j), vertex(i+1, j), vertex(i+1, j+1), vertex(i, j+1)}
+			for _, corners := range [][3]int{{0, 1, 2}, {0, 2, 3}} {
+				tri := Triangle{
+					V1Pos:    quad[corners[0]],
+					V2Pos:    quad[corners[1]],
+					V3Pos:    quad[corners[2]],
+					Material: material,
+				}
+				if tri.Edge12().Cross(tri.Edge13()).LenSq() == 0 {
+					continue
+				}
+				tri.RecalcNormal()
+				mesh.Triangles = append(mesh.Triangles, tri)
+			}
+		}
+	}
+	return mesh
+}
+
+// A grid of spheres (about 73k triangles), and rays from around it towards random points inside it
+
+func testTraversalScene(builder int) (*Scene, []Ray) {
+	settings := NewSceneSettings(4, 4, 1, 0.01)
+	settings.BVHBuilder = builder
+	settings.AsyncThreads = 4
+	scene := NewScene(64, 64, 40, settings)
+	material := NewMaterial(nil)
+	for x := 0; x < 3; x++ {
+		for y := 0; y < 3; y++ {
+			center := Math.Vector3{X: float64(x) * 2.5, Y: float64(y) * 2.5}
+			scene.AddObject(testSphereMesh("sphere"+strconv.Itoa(x*3+y), center, 1, 64, material))
+		}
+	}
+	scene.RebuildBVH()
+
+	gen := rand.New(rand.NewSource(1))
+	rays := make([]Ray, 4096)
+	for i := range rays {
+		origin := Math.Vector3{X: gen.NormFloat64(), Y: gen.NormFloat64(), Z: gen.NormFloat64()}.Normalized().FMul(12)
+		target := Math.Vector3{X: gen.Float64() * 5, Y: gen.Float64() * 5, Z: gen.Float64()*2 - 1}
+		rays[i] = Ray{Origin: origin, Direction: target.Sub(origin).Normalized()}
+	}
+	return scene, rays
+}
+
+var testBuilders = []struct {
+	name    string
+	builder int
+}{
+	{name: "sah", builder: BVHBuilderSAH},
+	{name: "clusters", builder: BVHBuilderClusters},
+}
+
+func BenchmarkIntersect(b *testing.B) {
+	for _, builder := range testBuilders {
+		scene, rays := testTraversalScene(builder.builder)
+		b.Run(builder.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ray := rays[i%len(rays)]
+				scene.Intersect(ray, MinHitDistance, math.Inf(1))
+			}
+		})
+	}
+}
+
+func BenchmarkIntersectsAny(b *testing.B) {
+	scene, rays := testTraversalScene(BVHBuilderSAH)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ray := rays[i%len(rays)]
+		scene.IntersectsAny(ray, MinHitDistance, math.Inf(1))
+	}
+}
+
+// Ray casts must not allocate, the photon threads cast millions of them
+
+func TestIntersectAllocations(t *testing.T) {
+	scene, rays := testTraversalScene(BVHBuilderSAH)
+	i := 0
+	allocations := testing.AllocsPerRun(1000, func() {
+		scene.Intersect(rays[i%len(rays)], MinHitDistance, math.Inf(1))
+		scene.IntersectsAny(rays[i%len(rays)], MinHitDistance, math.Inf(1))
+		i++
+	})
+	if allocations != 0 {
+		t.Fatalf("%g allocations per ray cast", allocations)
+	}
+}
+
+// The traversal finds the same closest hits as testing every triangle
+
+func TestIntersectBruteForce(t *testing.T) {
+	for _, builder := range testBuilders {
+		scene, rays := testTraversalScene(builder.builder)
+		for _, ray := range rays[:256] {
+			closest := math.Inf(1)
+			for _, mesh := range scene.objects {
+				for j := range mesh.Triangles {
+					tri := &mesh.Triangles[j]
+					if hit, tHit, _ := IntersectRayTriangleDistance(ray.Direction, ray.Origin, tri); hit && tHit > MinHitDistance &&
+						tHit < closest {
+						closest = tHit
+					}
+				}
+			}
+			hit, ok := scene.Intersect(ray, MinHitDistance, math.Inf(1))
+			if ok != !math.IsInf(closest, 1) || (ok && math.Abs(hit.T-closest) > 1e-9) {
+				t.Fatalf("%s: hit at %g (%v), expected %g", builder.name, hit.T, ok, closest)
+			}
+		}
+	}
+}
+
+// Meshes without triangles are left out of the BVH instead of breaking the build
+
+func TestRebuildBVHEmptyMesh(t *testing.T) {
+	for _, builder := range testBuilders {
+		settings := NewSceneSettings(4, 4, 1, 0.01)
+		settings.BVHBuilder = builder.builder
+		settings.AsyncThreads = 4
+		scene := NewScene(64, 64, 40, settings)
+		material := NewMaterial(nil)
+		for i := 0; i < 4; i++ {
+			center := Math.Vector3{X: float64(i) * 2.5}
+			scene.AddObject(testSphereMesh("sphere"+strconv.Itoa(i), center, 1, 16, material))
+			if i == 1 {
+				scene.AddObject(&Mesh{
+					MeshName:  "empty",
+					Transform: Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1}),
+				})
+			}
+		}
+		scene.RebuildBVH()
+
+		for i := 0; i < 4; i++ {
+			ray := Ray{Origin: Math.Vector3{X: float64(i) * 2.5, Z: 10}, Direction: Math.Vector3{Z: -1}}
+			hit, ok := scene.Intersect(ray, MinHitDistance, math.Inf(1))
+			if !ok || math.Abs(hit.T-9) > 0.05 {
+				t.Fatalf("%s: sphere %d hit at %g (%v), expected 9", builder.name, i, hit.T, ok)
+			}
+		}
+		if bounds := scene.GetBounds(); bounds.Point1.X < -1.01 || bounds.Point2.X > 8.51 {
+			t.Fatalf("%s: scene bounds %v include the empty mesh", builder.name, bounds)
+		}
+	}
+}
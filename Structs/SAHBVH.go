@@ -0,0 +1,257 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"Photon/Utils"
+	"math"
+	"sync"
+)
+
+// Surface area heuristic BVH
+// Nodes are stored depth-first in a flat array: the first child of an inner node is the next node, the second one is
+// at SecondChild. Leaves reference a range of the primitive order array, which maps to triangles (for meshes) or
+// instances (for the scene level)
+
+const (
+	sahBins          = 16
+	sahMaxLeafSize   = 8
+	sahTraversalCost = 1.0
+	// Subtrees smaller than that are not worth a goroutine
+	sahParallelThreshold = 16384
+)
+
+type FlatBVHNode struct {
+	AABB AABoundingBox
+	// Inner nodes
+	SecondChild int32
+	Axis        uint8
+	// Leaves (Count > 0)
+	First int32
+	Count int32
+}
+
+type FlatBVH struct {
+	Nodes []FlatBVHNode
+	Order []int32
+}
+
+type sahBin struct {
+	bounds AABoundingBox
+	count  int
+}
+
+func emptyAABB() AABoundingBox {
+	return AABoundingBox{Point1: Math.InfiniteVector3(), Point2: Math.NegativeInfiniteVector3()}
+}
+
+func (aabb *AABoundingBox) growPoint(p Math.Vector3) {
+	aabb.Point1 = Math.Vector3{X: math.Min(aabb.Point1.X, p.X), Y: math.Min(aabb.Point1.Y, p.Y), Z: math.Min(aabb.Point1.Z, p.Z)}
+	aabb.Point2 = Math.Vector3{X: math.Max(aabb.Point2.X, p.X), Y: math.Max(aabb.Point2.Y, p.Y), Z: math.Max(aabb.Point2.Z, p.Z)}
+}
+
+func (aabb *AABoundingBox) grow(other *AABoundingBox) {
+	aabb.growPoint(other.Point1)
+	aabb.growPoint(other.Point2)
+}
+
+func (aabb *AABoundingBox) SurfaceArea() float64 {
+	d := aabb.Point2.Sub(aabb.Point1)
+	if d.X < 0 || d.Y < 0 || d.Z < 0 {
+		return 0
+	}
+	return 2 * (d.X*d.Y + d.Y*d.Z + d.Z*d.X)
+}
+
+func vectorAxis(v Math.Vector3, axis int) float64 {
+	switch axis {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
+
+func triangleAABB(tri *Triangle) AABoundingBox {
+	aabb := emptyAABB()
+	aabb.growPoint(tri.V1Pos)
+	aabb.growPoint(tri.V2Pos)
+	aabb.growPoint(tri.V3Pos)
+	return aabb
+}
+
+// Builds the hierarchy over primitives given by their bounds. Subtrees above sahParallelThreshold primitives are built
+// in their own goroutines, as long as the pool has free slots
+
+type sahBuilder struct {
+	bounds    []AABoundingBox
+	centroids []Math.Vector3
+	order     []int32
+	pool      *Utils.WorkerPool
+}
+
+func BuildSAHBVH(bounds []AABoundingBox, pool *Utils.WorkerPool) *FlatBVH {
+	builder := &sahBuilder{
+		bounds:    bounds,
+		centroids: make([]Math.Vector3, len(bounds)),
+		order:     make([]int32, len(bounds)),
+		pool:      pool,
+	}
+	for i := 0; i < len(bounds); i++ {
+		builder.order[i] = int32(i)
+		builder.centroids[i] = bounds[i].MiddlePoint()
+	}
+	bvh := &FlatBVH{
+		Nodes: make([]FlatBVHNode, 0, max(2*len(bounds)/sahMaxLeafSize, 1)),
+		Order: builder.order,
+	}
+	if len(bounds) == 0 {
+		bvh.Nodes = append(bvh.Nodes, FlatBVHNode{AABB: emptyAABB()})
+		return bvh
+	}
+	builder.build(&bvh.Nodes, 0, len(bounds))
+	return bvh
+}
+
+func BVHFromMeshSAH(mesh *Mesh, pool *Utils.WorkerPool) *FlatBVH {
+	bounds := make([]AABoundingBox, len(mesh.Triangles))
+	for i := 0; i < len(mesh.Triangles); i++ {
+		bounds[i] = triangleAABB(&mesh.Triangles[i])
+	}
+	return BuildSAHBVH(bounds, pool)
+}
+
+// Appends the subtree over order[start:end] to nodes, returns the index of its root
+
+func (builder *sahBuilder) build(nodes *[]FlatBVHNode, start, end int) int {
+	nodeIndex := len(*nodes)
+	nodeBounds, axis, mid := builder.split(start, end)
+	*nodes = append(*nodes, FlatBVHNode{AABB: nodeBounds})
+	if axis == -1 {
+		(*nodes)[nodeIndex].First = int32(start)
+		(*nodes)[nodeIndex].Count = int32(end - start)
+		return nodeIndex
+	}
+	(*nodes)[nodeIndex].Axis = uint8(axis)
+
+	if end-start > sahParallelThreshold {
+		// Both halves are built into their own arrays, then moved behind the parent
+		var left, right []FlatBVHNode
+		var wg sync.WaitGroup
+		if !builder.pool.TryGo(&wg, func() { builder.build(&left, start, mid) }) {
+			builder.build(&left, start, mid)
+		}
+		builder.build(&right, mid, end)
+		wg.Wait()
+		appendSubtree(nodes, left)
+		(*nodes)[nodeIndex].SecondChild = int32(len(*nodes))
+		appendSubtree(nodes, right)
+		return nodeIndex
+	}
+
+	builder.build(nodes, start, mid)
+	(*nodes)[nodeIndex].SecondChild = int32(builder.build(nodes, mid, end))
+	return nodeIndex
+}
+
+func appendSubtree(nodes *[]FlatBVHNode, subtree []FlatBVHNode) {
+	offset := int32(len(*nodes))
+	for i := 0; i < len(subtree); i++ {
+		node := subtree[i]
+		if node.Count == 0 {
+			node.SecondChild += offset
+		}
+		*nodes = append(*nodes, node)
+	}
+}
+
+// Picks the split of order[start:end] and partitions it. Returns the node bounds, the split axis (-1 for leaves) and the
+// first primitive of the second child
+
+func (builder *sahBuilder) split(start, end int) (AABoundingBox, int, int) {
+	bounds, centroids, order := builder.bounds, builder.centroids, builder.order
+	nodeBounds := emptyAABB()
+	centroidBounds := emptyAABB()
+	for i := start; i < end; i++ {
+		nodeBounds.grow(&bounds[order[i]])
+		centroidBounds.growPoint(centroids[order[i]])
+	}
+	count := end - start
+	if count <= 2 {
+		return nodeBounds, -1, 0
+	}
+
+	// Binning along every axis, keeping the cheapest split
+	bestCost := math.Inf(1)
+	bestAxis, bestSplit := -1, 0
+	for axis := 0; axis < 3; axis++ {
+		cMin := vectorAxis(centroidBounds.Point1, axis)
+		cMax := vectorAxis(centroidBounds.Point2, axis)
+		if cMax-cMin <= 0 {
+			continue
+		}
+		var bins [sahBins]sahBin
+		for b := 0; b < sahBins; b++ {
+			bins[b].bounds = emptyAABB()
+		}
+		scale := sahBins / (cMax - cMin)
+		for i := start; i < end; i++ {
+			b := min(max(int((vectorAxis(centroids[order[i]], axis)-cMin)*scale), 0), sahBins-1)
+			bins[b].count++
+			bins[b].bounds.grow(&bounds[order[i]])
+		}
+		// Sweeping from the right to get the right side areas, then from the left
+		var rightArea [sahBins]float64
+		var rightCount [sahBins]int
+		right := emptyAABB()
+		n := 0
+		for b := sahBins - 1; b > 0; b-- {
+			right.grow(&bins[b].bounds)
+			n += bins[b].count
+			rightArea[b] = right.SurfaceArea()
+			rightCount[b] = n
+		}
+		left := emptyAABB()
+		n = 0
+		for b := 0; b < sahBins-1; b++ {
+			left.grow(&bins[b].bounds)
+			n += bins[b].count
+			if n == 0 || rightCount[b+1] == 0 {
+				continue
+			}
+			cost := left.SurfaceArea()*float64(n) + rightArea[b+1]*float64(rightCount[b+1])
+			if cost < bestCost {
+				bestCost = cost
+				bestAxis = axis
+				bestSplit = b
+			}
+		}
+	}
+
+	area := nodeBounds.SurfaceArea()
+	if bestAxis == -1 {
+		// All the centroids are in the same spot
+		if count <= sahMaxLeafSize {
+			return nodeBounds, -1, 0
+		}
+		return nodeBounds, 0, (start + end) / 2
+	}
+	if area > 0 && sahTraversalCost+bestCost/area >= float64(count) && count <= sahMaxLeafSize {
+		return nodeBounds, -1, 0
+	}
+
+	// Partitioning the primitives by bin
+	cMin := vectorAxis(centroidBounds.Point1, bestAxis)
+	scale := sahBins / (vectorAxis(centroidBounds.Point2, bestAxis) - cMin)
+	i, j := start, end-1
+	for i <= j {
+		b := min(max(int((vectorAxis(centroids[order[i]], bestAxis)-cMin)*scale), 0), sahBins-1)
+		if b <= bestSplit {
+			i++
+		} else {
+			order[i], order[j] = order[j], order[i]
+			j--
+		}
+	}
+	return nodeBounds, bestAxis, i
+}
@@ -0,0 +1,193 @@
+package Structs
+
+import (
+	"Photon/Math"
+	"math"
+	"strings"
+)
+
+// Texture sampler, shared by all the material maps
+// UVs follow the OBJ convention ({0;0} is the bottom left corner of the image). The footprint is the width of the
+// sampled area in UV units, which selects the mip level
+
+type WrapMode int
+
+const (
+	WrapRepeat WrapMode = iota
+	WrapMirror
+	WrapClamp
+)
+
+func ParseWrapMode(name string) (WrapMode, bool) {
+	switch strings.ToLower(name) {
+	case "repeat":
+		return WrapRepeat, true
+	case "mirror":
+		return WrapMirror, true
+	case "clamp":
+		return WrapClamp, true
+	}
+	return WrapRepeat, false
+}
+
+type FilterMode int
+
+const (
+	FilterNearest FilterMode = iota
+	FilterBilinear
+	FilterTrilinear
+)
+
+func ParseFilterMode(name string) (FilterMode, bool) {
+	switch strings.ToLower(name) {
+	case "nearest":
+		return FilterNearest, true
+	case "bilinear":
+		return FilterBilinear, true
+	case "trilinear":
+		return FilterTrilinear, true
+	}
+	return FilterTrilinear, false
+}
+
+type Sampler struct {
+	Wrap    WrapMode
+	Filter  FilterMode
+	Options TextureOptions
+}
+
+func NewSampler(options TextureOptions) Sampler {
+	return Sampler{
+		Wrap:    options.Wrap,
+		Filter:  options.Filter,
+		Options: options,
+	}
+}
+
+func DefaultSampler() Sampler {
+	return NewSampler(DefaultTextureOptions())
+}
+
+func (sampler *Sampler) wrap(i, size int) int {
+	switch sampler.Wrap {
+	case WrapClamp:
+		return min(max(i, 0), size-1)
+	case WrapMirror:
+		period := 2 * size
+		i = ((i % period) + period) % period
+		if i >= size {
+			return period - 1 - i
+		}
+		return i
+	default:
+		return ((i % size) + size) % size
+	}
+}
+
+type texelWeights struct {
+	indices [4]int
+	weights [4]float64
+	count   int
+}
+
+func (sampler *Sampler) texels(width, height int, uv Math.Vector2) texelWeights {
+	// Texel space, with the V axis flipped into image rows
+	x := uv.U * float64(width)
+	y := (1 - uv.V) * float64(height)
+	var t texelWeights
+	if sampler.Filter == FilterNearest {
+		t.indices[0] = sampler.wrap(int(math.Floor(y)), height)*width + sampler.wrap(int(math.Floor(x)), width)
+		t.weights[0] = 1
+		t.count = 1
+		return t
+	}
+	// Bilinear, relative to texel centers
+	x -= 0.5
+	y -= 0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix0, iy0 := sampler.wrap(int(x0), width), sampler.wrap(int(y0), height)
+	ix1, iy1 := sampler.wrap(int(x0)+1, width), sampler.wrap(int(y0)+1, height)
+	t.indices = [4]int{iy0*width + ix0, iy0*width + ix1, iy1*width + ix0, iy1*width + ix1}
+	t.weights = [4]float64{(1 - fx) * (1 - fy), fx * (1 - fy), (1 - fx) * fy, fx * fy}
+	t.count = 4
+	return t
+}
+
+// Fractional mip level for a footprint, 0 being the full resolution texture
+
+func (sampler *Sampler) lod(uvFootprint float64, width, height int) float64 {
+	if sampler.Filter != FilterTrilinear || uvFootprint <= 0 {
+		return 0
+	}
+	texels := uvFootprint * float64(max(width, height)) * math.Max(math.Abs(sampler.Options.Scale.U), math.Abs(sampler.Options.Scale.V))
+	if texels <= 1 {
+		return 0
+	}
+	return math.Log2(texels)
+}
+
+func (sampler *Sampler) sampleRGBLevel(texture *TextureRGB, uv Math.Vector2) Math.Vector3 {
+	t := sampler.texels(texture.Width, texture.Height, uv)
+	var c Math.Vector3
+	for i := 0; i < t.count; i++ {
+		c = c.Add(texture.data[t.indices[i]].FMul(t.weights[i]))
+	}
+	return c
+}
+
+func (sampler *Sampler) sampleAlphaLevel(texture *TextureRGB, uv Math.Vector2) float64 {
+	t := sampler.texels(texture.Width, texture.Height, uv)
+	var c float64
+	for i := 0; i < t.count; i++ {
+		c += texture.alpha[t.indices[i]] * t.weights[i]
+	}
+	return c
+}
+
+func (sampler *Sampler) sampleGrayscaleLevel(texture *TextureGrayscale, uv Math.Vector2) float64 {
+	t := sampler.texels(texture.Width, texture.Height, uv)
+	var c float64
+	for i := 0; i < t.count; i++ {
+		c += texture.data[t.indices[i]] * t.weights[i]
+	}
+	return c
+}
+
+func (sampler *Sampler) SampleRGB(texture *TextureRGB, uv Math.Vector2, uvFootprint float64) Math.Vector3 {
+	uv = sampler.Options.TransformUV(uv)
+	lod := sampler.lod(uvFootprint, texture.Width, texture.Height)
+	level := int(lod)
+	c := sampler.sampleRGBLevel(texture.level(level), uv)
+	if f := lod - float64(level); f > 0 {
+		c = Math.InterpolateVector3(c, sampler.sampleRGBLevel(texture.level(level+1), uv), f)
+	}
+	return sampler.Options.RemapColor(c)
+}
+
+// Alpha channel of an RGB texture, 1 for opaque textures. The -mm remap is not applied to alpha
+
+func (sampler *Sampler) SampleAlpha(texture *TextureRGB, uv Math.Vector2, uvFootprint float64) float64 {
+	if !texture.HasAlpha() {
+		return 1
+	}
+	uv = sampler.Options.TransformUV(uv)
+	lod := sampler.lod(uvFootprint, texture.Width, texture.Height)
+	level := int(lod)
+	c := sampler.sampleAlphaLevel(texture.level(level), uv)
+	if f := lod - float64(level); f > 0 {
+		c += (sampler.sampleAlphaLevel(texture.level(level+1), uv) - c) * f
+	}
+	return c
+}
+
+func (sampler *Sampler) SampleGrayscale(texture *TextureGrayscale, uv Math.Vector2, uvFootprint float64) float64 {
+	uv = sampler.Options.TransformUV(uv)
+	lod := sampler.lod(uvFootprint, texture.Width, texture.Height)
+	level := int(lod)
+	c := sampler.sampleGrayscaleLevel(texture.level(level), uv)
+	if f := lod - float64(level); f > 0 {
+		c += (sampler.sampleGrayscaleLevel(texture.level(level+1), uv) - c) * f
+	}
+	return sampler.Options.Remap(c)
+}
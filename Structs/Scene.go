@@ -4,7 +4,10 @@ import (
 	"Photon/Math"
 	"Photon/Utils"
 	"fmt"
+	"math/rand"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // TODO: Remove me
@@ -23,32 +26,40 @@ func Debug_TraverseBVHTree(tree *BVHNode) {
 		if !node.IsALeaf() {
 			i++
 			fmt.Print("Node(" + strconv.Itoa(node.NodeID) + "): ")
-			if node.Child1.Mesh != nil {
-				fmt.Print(" Child1: " + node.Child1.Mesh.MeshName + "(" + strconv.Itoa(node.Child1.NodeID) + ")")
+			if node.Child1.Instance != nil {
+				fmt.Print(" Child1: " + node.Child1.Instance.Name + "(" + strconv.Itoa(node.Child1.NodeID) + ")")
 			} else {
 				fmt.Print(" Child1: NO_MESH" + "(" + strconv.Itoa(node.Child1.NodeID) + ")")
 			}
 
-			if node.Child2.Mesh != nil {
-				fmt.Print(" Child2: " + node.Child2.Mesh.MeshName + "(" + strconv.Itoa(node.Child2.NodeID) + ")")
+			if node.Child2.Instance != nil {
+				fmt.Print(" Child2: " + node.Child2.Instance.Name + "(" + strconv.Itoa(node.Child2.NodeID) + ")")
 			} else {
 				fmt.Print(" Child2: NO_MESH" + "(" + strconv.Itoa(node.Child2.NodeID) + ")")
 			}
 			fmt.Println()
 			nodes_to_traverse = append(nodes_to_traverse, *node.Child1, *node.Child2)
 		} else {
-			fmt.Println("Node: Leaf (" + node.Mesh.MeshName + ")" + " (" + strconv.Itoa(node.NodeID) + ")")
+			fmt.Println("Node: Leaf (" + node.Instance.Name + ")" + " (" + strconv.Itoa(node.NodeID) + ")")
 		}
 	}
 	Utils.LogSuccess("Done DEBUG_BVH_TRAVERSAL")
 }
 
 type Scene struct {
-	objects       []Mesh
+	objects       []*Mesh
+	instances     []*Instance
 	lightSources  []LightSource
 	camera        *Camera
 	sceneSettings *SceneSettings
 	baseNode      *BVHNode
+	// Top level of the SAH acceleration structure, over the instances
+	topLevel *FlatBVH
+	// Medium filling the scene, nil for vacuum
+	medium *Medium
+	// Whether any instanced mesh has a medium inside or a subsurface scattering material, updated by RebuildBVH
+	mediumBoundaries bool
+	subsurface       bool
 }
 
 func NewScene(resolutionX, resolutionY int, FOV float64, settings *SceneSettings) *Scene {
@@ -79,6 +90,15 @@ func (scene *Scene) containsSameObject(name string) bool {
 	return false
 }
 
+func (scene *Scene) containsSameInstance(name string) bool {
+	for i := 0; i < len(scene.instances); i++ {
+		if scene.instances[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (scene *Scene) containsSameLight(lightID int) bool {
 	for i := 0; i < len(scene.lightSources); i++ {
 		if scene.lightSources[i].GetID() == lightID {
@@ -89,31 +109,81 @@ func (scene *Scene) containsSameLight(lightID int) bool {
 }
 
 // Adding objects
+// Every object gets an untransformed instance with the same name, further instances can be added with AddInstance
+
+func (scene *Scene) addObjectWithInstance(object *Mesh) {
+	scene.objects = append(scene.objects, object)
+	scene.instances = append(scene.instances, NewInstance(object.MeshName, object,
+		Math.NewTransform(Math.Vector3{}, Math.Vector3{}, Math.Vector3{X: 1, Y: 1, Z: 1})))
+}
 
 func (scene *Scene) AddObject(object *Mesh) {
 	if scene.containsSameObject(object.MeshName) {
 		Utils.LogError("trying to add duplicate mesh")
 		panic("there is already an object with the same name")
 	}
-	scene.objects = append(scene.objects, *object)
+	scene.addObjectWithInstance(object)
 }
 
 func (scene *Scene) AddObjectOrCopy(object *Mesh) {
 	if scene.containsSameObject(object.MeshName) {
 		Utils.LogWarning("mesh with the same name found, the mesh was copied")
-		scene.objects = append(scene.objects, *object.Copy())
+		scene.addObjectWithInstance(object.Copy())
 		return
 	}
-	scene.objects = append(scene.objects, *object)
+	scene.addObjectWithInstance(object)
 }
 
+// Linked copies are instances of the mesh that is already in the scene, so they don't take any extra memory
+
 func (scene *Scene) AddObjectOrLinkedCopy(object *Mesh) {
-	if scene.containsSameObject(object.MeshName) {
+	if existing := scene.findObject(object.MeshName); existing != nil {
 		Utils.LogWarning("mesh with the same name found, the mesh was linked")
-		scene.objects = append(scene.objects, *object.LinkedCopy())
+		scene.instances = append(scene.instances, NewInstance(scene.uniqueInstanceName(object.MeshName), existing,
+			object.Transform.Copy()))
 		return
 	}
-	scene.objects = append(scene.objects, *object)
+	scene.addObjectWithInstance(object)
+}
+
+func (scene *Scene) uniqueInstanceName(name string) string {
+	name = Utils.IncrementName(name)
+	for scene.containsSameInstance(name) {
+		name = Utils.IncrementName(name)
+	}
+	return name
+}
+
+// Instances without a name are named after their mesh
+
+func (scene *Scene) AddInstance(meshName, instanceName string, transform *Math.Transform) *Instance {
+	mesh := scene.findObject(meshName)
+	if mesh == nil {
+		Utils.LogError("trying to instance a missing mesh " + meshName)
+		panic("there is no object with name " + meshName)
+	}
+	if instanceName == "" {
+		instanceName = scene.uniqueInstanceName(meshName)
+	}
+	if scene.containsSameInstance(instanceName) {
+		Utils.LogError("trying to add duplicate instance")
+		panic("there is already an instance with the same name")
+	}
+	instance := NewInstance(instanceName, mesh, transform)
+	scene.instances = append(scene.instances, instance)
+	return instance
+}
+
+// Removing an instance keeps the mesh, so that it can still be instanced elsewhere
+
+func (scene *Scene) RemoveInstance(name string) {
+	for i := 0; i < len(scene.instances); i++ {
+		if scene.instances[i].Name == name {
+			scene.instances = append(scene.instances[:i], scene.instances[i+1:]...)
+			return
+		}
+	}
+	Utils.LogWarning(fmt.Sprintf("no instance with name \"%s\" found", name))
 }
 
 // Adding Lights
@@ -135,16 +205,39 @@ func (scene *Scene) GetCamera() *Camera {
 	return scene.camera
 }
 
-func (scene *Scene) GetObject(name string) *Mesh {
+func (scene *Scene) findObject(name string) *Mesh {
 	for i := 0; i < len(scene.objects); i++ {
 		if scene.objects[i].MeshName == name {
-			return &scene.objects[i]
+			return scene.objects[i]
 		}
 	}
-	Utils.LogWarning(fmt.Sprintf("no object with name \"%s\" found", name))
 	return nil
 }
 
+func (scene *Scene) GetObject(name string) *Mesh {
+	object := scene.findObject(name)
+	if object == nil {
+		Utils.LogWarning(fmt.Sprintf("no object with name \"%s\" found", name))
+	}
+	return object
+}
+
+func (scene *Scene) GetInstances() []*Instance {
+	return scene.instances
+}
+
+// World space bounds of all the instances. Only valid after RebuildBVH
+
+func (scene *Scene) GetBounds() AABoundingBox {
+	bounds := emptyAABB()
+	for j := 0; j < len(scene.instances); j++ {
+		if len(scene.instances[j].Mesh.Triangles) > 0 {
+			bounds.grow(scene.instances[j].worldAABB())
+		}
+	}
+	return bounds
+}
+
 func (scene *Scene) GetLight(id int) LightSource {
 	for i := 0; i < len(scene.lightSources); i++ {
 		if scene.lightSources[i].GetID() == id {
@@ -156,11 +249,115 @@ func (scene *Scene) GetLight(id int) LightSource {
 }
 
 func (scene *Scene) RebuildBVH() {
+	scene.mediumBoundaries, scene.subsurface = false, false
+	meshes := scene.instancedMeshes()
+	for i := 0; i < len(meshes) && !(scene.mediumBoundaries && scene.subsurface); i++ {
+		for j := 0; j < len(meshes[i].Triangles); j++ {
+			material := meshes[i].Triangles[j].Material
+			scene.mediumBoundaries = scene.mediumBoundaries || material.IsMediumBoundary()
+			scene.subsurface = scene.subsurface || material.GetSubsurface() > 0
+		}
+	}
+	if scene.sceneSettings.BVHBuilder == BVHBuilderClusters {
+		scene.rebuildClusterBVH()
+		return
+	}
+	Utils.Log("rebuilding scene BVH (SAH)...")
+	start := time.Now()
+	scene.baseNode = nil
+	pool := Utils.NewWorkerPool(scene.sceneSettings.AsyncThreads)
+	meshBVHs := make([]*FlatBVH, len(meshes))
+	var wg sync.WaitGroup
+	for i := 0; i < len(meshes); i++ {
+		pool.Go(&wg, func() {
+			meshStart := time.Now()
+			if scene.sceneSettings.BVHCacheDir != "" {
+				meshBVHs[i] = CachedBVHFromMeshSAH(meshes[i], scene.sceneSettings.BVHCacheDir, pool)
+			} else {
+				meshBVHs[i] = BVHFromMeshSAH(meshes[i], pool)
+			}
+			Utils.LogTiming("BVH for mesh "+meshes[i].MeshName+" ("+strconv.Itoa(len(meshBVHs[i].Nodes))+" nodes, "+
+				strconv.Itoa(len(meshes[i].Triangles))+" triangles)", meshStart)
+		})
+	}
+	wg.Wait()
+
+	bvhByMesh := make(map[*Mesh]*FlatBVH, len(meshes))
+	for i := 0; i < len(meshes); i++ {
+		bvhByMesh[meshes[i]] = meshBVHs[i]
+	}
+	// Instances of empty meshes are left out of the top level, so its order has to be mapped back to scene.instances
+	var instanceBounds []AABoundingBox
+	var instanceIndices []int32
+	for j := 0; j < len(scene.instances); j++ {
+		instance := scene.instances[j]
+		instance.blas = nil
+		instance.bvh = bvhByMesh[instance.Mesh]
+		if instance.bvh == nil {
+			continue
+		}
+		instance.bounds = instance.bvh.Nodes[0].AABB
+		instance.updateMatrices()
+		instanceBounds = append(instanceBounds, *instance.worldAABB())
+		instanceIndices = append(instanceIndices, int32(j))
+	}
+	Utils.Log(strconv.Itoa(len(meshes)) + " meshes shared by " + strconv.Itoa(len(instanceBounds)) + " instances")
+	scene.topLevel = BuildSAHBVH(instanceBounds, pool)
+	for i := 0; i < len(scene.topLevel.Order); i++ {
+		scene.topLevel.Order[i] = instanceIndices[scene.topLevel.Order[i]]
+	}
+	Utils.LogTiming("rebuilding BVH", start)
+}
+
+// Meshes referenced by the instances, each one once. Meshes without triangles have nothing to build a BVH from
+
+func (scene *Scene) instancedMeshes() []*Mesh {
+	var meshes []*Mesh
+	seen := make(map[*Mesh]bool)
+	for j := 0; j < len(scene.instances); j++ {
+		if len(scene.instances[j].Mesh.Triangles) == 0 {
+			continue
+		}
+		if !seen[scene.instances[j].Mesh] {
+			seen[scene.instances[j].Mesh] = true
+			meshes = append(meshes, scene.instances[j].Mesh)
+		}
+	}
+	return meshes
+}
+
+// The old builder: random triangle clusters per mesh, and greedy nearest-center merging of the meshes
+
+func (scene *Scene) rebuildClusterBVH() {
 	Utils.Log("rebuilding scene BVH...")
+	start := time.Now()
+	scene.topLevel = nil
+	pool := Utils.NewWorkerPool(scene.sceneSettings.AsyncThreads)
+	// Bottom level: one object space BVH per instanced mesh
+	meshNodes := make(map[*Mesh]*BVHNode)
 	var nodeLayer []BVHNode
-	for j := 0; j < len(scene.objects); j++ {
-		nodeLayer = append(nodeLayer, *BVHFromMesh(&scene.objects[j], scene.sceneSettings.KNearestPointRatio))
+	for j := 0; j < len(scene.instances); j++ {
+		instance := scene.instances[j]
+		if len(instance.Mesh.Triangles) == 0 {
+			instance.bvh, instance.blas = nil, nil
+			continue
+		}
+		if meshNodes[instance.Mesh] == nil {
+			meshNodes[instance.Mesh] = BVHFromMesh(instance.Mesh, scene.sceneSettings.KNearestPointRatio, pool)
+		}
+		instance.bvh = nil
+		instance.blas = meshNodes[instance.Mesh]
+		instance.bounds = *instance.blas.AABB
+		instance.updateMatrices()
+		// Top level: instance leaves in world space
+		nodeLayer = append(nodeLayer, BVHNode{
+			AABB:     instance.worldAABB(),
+			Mesh:     instance.Mesh,
+			Instance: instance,
+			NodeID:   rand.Intn(256),
+		})
 	}
+	Utils.Log(strconv.Itoa(len(meshNodes)) + " meshes shared by " + strconv.Itoa(len(scene.instances)) + " instances")
 	// Iterate through nodes until there is but one left
 	for len(nodeLayer) > 1 {
 		// Take the first node. We don't really care about which node that is
@@ -188,7 +385,7 @@ func (scene *Scene) RebuildBVH() {
 		nodeLayer = append(nodeLayer, jNode)
 	}
 	// When len(nodeLayer) reaches zero, we are done and can save the resulting root node to the scene object
-	Utils.LogSuccess("done rebuilding BVH!")
+	Utils.LogTiming("rebuilding BVH", start)
 	scene.baseNode = &nodeLayer[0]
 }
 
@@ -196,6 +393,28 @@ func (scene *Scene) GetSceneSettings() SceneSettings {
 	return *scene.sceneSettings
 }
 
+func (scene *Scene) SetSceneSettings(settings SceneSettings) {
+	*scene.sceneSettings = settings
+}
+
 func (scene *Scene) GetLightSources() []LightSource {
 	return scene.lightSources
 }
+
+func (scene *Scene) SetMedium(medium *Medium) {
+	scene.medium = medium
+}
+
+func (scene *Scene) GetMedium() *Medium {
+	return scene.medium
+}
+
+// Whether rays have to care about media at all
+
+func (scene *Scene) HasMedia() bool {
+	return scene.medium != nil || scene.mediumBoundaries
+}
+
+func (scene *Scene) HasSubsurface() bool {
+	return scene.subsurface
+}
@@ -1,5 +1,19 @@
 package Structs
 
+// Acceleration structure builders. The triangle cluster builder is the old one, kept for comparison
+
+const (
+	BVHBuilderSAH = iota
+	BVHBuilderClusters
+)
+
+// Camera point lookup structures
+
+const (
+	PointLookupKDTree = iota
+	PointLookupHashGrid
+)
+
 type SceneSettings struct {
 	MaxInitialRayDepth int
 	MaxMapperRayDepth  int
@@ -8,6 +22,18 @@ type SceneSettings struct {
 	KNearestPointRatio float64
 	PhotonRadius       float64
 	MaxPointsPerDomain int
+	BVHBuilder         int
+	// Directory of the on-disk BVH cache, empty to always rebuild
+	BVHCacheDir string
+	PointLookup int
+	// Two-pass photon mapping: final gather rays per camera sample, and photons per radiance estimate
+	GatherRays        int
+	PhotonLookupCount int
+	// Path tracer bounce limit
+	MaxPathDepth int
+	// Alpha cutout. Stochastic mode compares the alpha to a random threshold instead of the material cutoff, so that
+	// semi-transparent texels let through a matching share of rays
+	StochasticAlpha bool
 	// Misc
 	MinLightEnergy   float64
 	AsyncThreads     int
@@ -23,6 +49,11 @@ func NewSceneSettings(iRayDepth, mRayDepth, phCount int, phR float64) *SceneSett
 		KNearestPointRatio: 0.03,
 		PhotonRadius:       phR,
 		MaxPointsPerDomain: 64,
+		BVHBuilder:         BVHBuilderSAH,
+		PointLookup:        PointLookupKDTree,
+		GatherRays:         16,
+		PhotonLookupCount:  64,
+		MaxPathDepth:       16,
 		AsyncThreads:       16,
 		MinLightEnergy:     0.01,
 		ViewerUpdateTime:   1,
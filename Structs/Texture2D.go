@@ -2,20 +2,96 @@ package Structs
 
 import (
 	"Photon/Math"
+	"Photon/Utils"
 	"github.com/mdouchement/hdr"
+	_ "github.com/mdouchement/hdr/codec/pfm"
+	_ "github.com/mdouchement/hdr/codec/rgbe"
 	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
 	"os"
+	"strings"
+	"sync"
 )
 
-// RGB texture
+// Texture statement options (MTL -s, -o, -clamp, -bm and -mm, along with the -wrap and -filter extensions)
 
-type TextureRGB struct {
-	data   []Math.Vector3
-	Width  int
-	Height int
+type TextureOptions struct {
+	Scale          Math.Vector2
+	Offset         Math.Vector2
+	Wrap           WrapMode
+	Filter         FilterMode
+	BumpMultiplier float64
+	Base           float64
+	Gain           float64
 }
 
-func ReadTextureRGB(img string) *TextureRGB {
+func DefaultTextureOptions() TextureOptions {
+	return TextureOptions{
+		Scale:          Math.Vector2{U: 1, V: 1},
+		Offset:         Math.Vector2{},
+		Wrap:           WrapRepeat,
+		Filter:         FilterTrilinear,
+		BumpMultiplier: 1,
+		Base:           0,
+		Gain:           1,
+	}
+}
+
+func (options *TextureOptions) TransformUV(uv Math.Vector2) Math.Vector2 {
+	return Math.Vector2{U: uv.U*options.Scale.U + options.Offset.U, V: uv.V*options.Scale.V + options.Offset.V}
+}
+
+func (options *TextureOptions) Remap(value float64) float64 {
+	return options.Base + options.Gain*value
+}
+
+func (options *TextureOptions) RemapColor(value Math.Vector3) Math.Vector3 {
+	return Math.Vector3{X: options.Remap(value.X), Y: options.Remap(value.Y), Z: options.Remap(value.Z)}
+}
+
+// Texture color spaces. Texel values are always converted to linear ones on load
+
+type ColorSpace int
+
+const (
+	ColorSpaceSRGB ColorSpace = iota
+	ColorSpaceLinear
+)
+
+func ParseColorSpace(name string) (ColorSpace, bool) {
+	switch strings.ToLower(name) {
+	case "srgb":
+		return ColorSpaceSRGB, true
+	case "linear", "raw", "non-color":
+		return ColorSpaceLinear, true
+	}
+	return ColorSpaceSRGB, false
+}
+
+// sRGB EOTF lookup table over the 16-bit values returned by image.Image
+
+var srgbTable []float64
+var srgbTableOnce sync.Once
+
+func srgbToLinear(v uint32) float64 {
+	srgbTableOnce.Do(func() {
+		srgbTable = make([]float64, 65536)
+		for i := 0; i < len(srgbTable); i++ {
+			c := float64(i) / 65535
+			if c <= 0.04045 {
+				srgbTable[i] = c / 12.92
+			} else {
+				srgbTable[i] = math.Pow((c+0.055)/1.055, 2.4)
+			}
+		}
+	})
+	return srgbTable[v]
+}
+
+func decodeTextureImage(img string) image.Image {
 	imgf, err := os.Open(img)
 	if err != nil {
 		panic(err)
@@ -23,24 +99,77 @@ func ReadTextureRGB(img string) *TextureRGB {
 	defer imgf.Close()
 	imageData, _, err := image.Decode(imgf)
 	if err != nil {
+		Utils.LogError("could not decode texture " + img)
 		panic(err)
 	}
-	texture := &TextureRGB{
-		Width:  imageData.Bounds().Max.X,
-		Height: imageData.Bounds().Max.Y,
-		data:   make([]Math.Vector3, imageData.Bounds().Max.X*imageData.Bounds().Max.Y),
+	return imageData
+}
+
+// Linear color and alpha of a texel. Colors are un-premultiplied, 8 and 16-bit images both end up in [0;1], while
+// float images (.hdr, .pfm) are used as is
+
+func readTexel(img image.Image, x, y int, space ColorSpace) (Math.Vector3, float64) {
+	if hdrImage, ok := img.(hdr.Image); ok {
+		r, g, b, a := hdrImage.HDRAt(x, y).HDRRGBA()
+		return Math.Vector3{X: r, Y: g, Z: b}, math.Min(math.Max(a, 0), 1)
+	}
+	c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+	alpha := float64(c.A) / 65535
+	if space == ColorSpaceSRGB {
+		return Math.Vector3{X: srgbToLinear(uint32(c.R)), Y: srgbToLinear(uint32(c.G)), Z: srgbToLinear(uint32(c.B))}, alpha
 	}
-	for y := 0; y < texture.Width; y++ {
-		for x := 0; x < texture.Height; x++ {
-			arrIdx := y*texture.Width + x
-			r, g, b, _ := imageData.At(x, y).RGBA()
-			texture.data[arrIdx] = Math.Vector3{
-				X: float64(r) / 255,
-				Y: float64(g) / 255,
-				Z: float64(b) / 255,
+	return Math.Vector3{X: float64(c.R) / 65535, Y: float64(c.G) / 65535, Z: float64(c.B) / 65535}, alpha
+}
+
+func imageOpaque(img image.Image) bool {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, a := readTexel(img, x, y, ColorSpaceLinear); a < 1 {
+				return false
 			}
 		}
 	}
+	return true
+}
+
+// RGB texture
+
+type TextureRGB struct {
+	data []Math.Vector3
+	// Alpha channel, nil for opaque images
+	alpha  []float64
+	Width  int
+	Height int
+	// Mip levels, starting from the half-sized one
+	mips []*TextureRGB
+}
+
+func ReadTextureRGB(img string) *TextureRGB {
+	return ReadTextureRGBWithColorSpace(img, ColorSpaceSRGB)
+}
+
+// Color maps (albedo, emission) are sRGB encoded, data maps (normals) are linear. HDR images are always linear
+
+func ReadTextureRGBWithColorSpace(img string, space ColorSpace) *TextureRGB {
+	imageData := decodeTextureImage(img)
+	bounds := imageData.Bounds()
+	texture := EmptyTextureRGB(bounds.Dx(), bounds.Dy())
+	alpha := make([]float64, len(texture.data))
+	opaque := true
+	for y := 0; y < texture.Height; y++ {
+		for x := 0; x < texture.Width; x++ {
+			arrIdx := y*texture.Width + x
+			c, a := readTexel(imageData, bounds.Min.X+x, bounds.Min.Y+y, space)
+			texture.data[arrIdx] = c
+			alpha[arrIdx] = a
+			opaque = opaque && a == 1
+		}
+	}
+	if !opaque {
+		texture.alpha = alpha
+	}
+	texture.BuildMipmaps()
 	return texture
 }
 
@@ -63,19 +192,61 @@ func TextureRGBFromHDR(hdrIm hdr.Image) *TextureRGB {
 	for y := 0; y < tex.Height; y++ {
 		for x := 0; x < tex.Width; x++ {
 			r, g, b, _ := hdrIm.HDRAt(x, y).HDRRGBA()
-			tex.data[y*tex.Height+x] = Math.Vector3{r, g, b}
+			tex.data[y*tex.Width+x] = Math.Vector3{X: r, Y: g, Z: b}
 		}
 	}
+	tex.BuildMipmaps()
 	return tex
 }
 
+// Nearest texel in image coordinates ({0;0} is the top left corner). Use a Sampler for filtered lookups
+
 func (texture *TextureRGB) At(uv Math.Vector2) Math.Vector3 {
-	if uv.U > 1 || uv.V > 1 || uv.U < 0 || uv.V < 0 {
-		panic("invalid UV coordinates")
+	x := min(max(int(uv.U*float64(texture.Width)), 0), texture.Width-1)
+	y := min(max(int(uv.V*float64(texture.Height)), 0), texture.Height-1)
+	return texture.data[y*texture.Width+x]
+}
+
+func (texture *TextureRGB) HasAlpha() bool {
+	return texture.alpha != nil
+}
+
+func (texture *TextureRGB) level(lod int) *TextureRGB {
+	if lod <= 0 || len(texture.mips) == 0 {
+		return texture
+	}
+	return texture.mips[min(lod, len(texture.mips))-1]
+}
+
+// Box-filtered mip chain, down to 1x1
+
+func (texture *TextureRGB) BuildMipmaps() {
+	texture.mips = nil
+	src := texture
+	for src.Width > 1 || src.Height > 1 {
+		dst := EmptyTextureRGB(max(src.Width/2, 1), max(src.Height/2, 1))
+		if src.alpha != nil {
+			dst.alpha = make([]float64, len(dst.data))
+		}
+		for y := 0; y < dst.Height; y++ {
+			for x := 0; x < dst.Width; x++ {
+				var sum Math.Vector3
+				var alphaSum float64
+				for _, t := range downsampleTexels(src.Width, src.Height, x, y) {
+					sum = sum.Add(src.data[t])
+					if src.alpha != nil {
+						alphaSum += src.alpha[t]
+					}
+				}
+				dst.data[y*dst.Width+x] = sum.FDiv(4)
+				if dst.alpha != nil {
+					dst.alpha[y*dst.Width+x] = alphaSum / 4
+				}
+			}
+		}
+		texture.mips = append(texture.mips, dst)
+		src = dst
 	}
-	x := int(uv.U * float64(texture.Width))
-	y := int(uv.V * float64(texture.Height))
-	return texture.data[y*texture.Height+x]
 }
 
 // Grayscale texture
@@ -84,38 +255,109 @@ type TextureGrayscale struct {
 	data   []float64
 	Width  int
 	Height int
+	// Mip levels, starting from the half-sized one
+	mips []*TextureGrayscale
 }
 
+// Texture channels for grayscale textures (MTL -imfchan). Packed textures (e.g. occlusion/roughness/metallic) keep
+// each map in its own channel
+
+const (
+	ChannelLuminance = iota
+	ChannelRed
+	ChannelGreen
+	ChannelBlue
+	ChannelAlpha
+	// The alpha channel of images that have one, the luminance of the others
+	ChannelOpacity
+)
+
 func ReadTextureGrayscale(img string) *TextureGrayscale {
-	imgf, err := os.Open(img)
-	if err != nil {
-		panic(err)
-	}
-	defer imgf.Close()
-	imageData, _, err := image.Decode(imgf)
-	if err != nil {
-		panic(err)
+	return ReadTextureGrayscaleChannel(img, ChannelLuminance)
+}
+
+func ReadTextureGrayscaleChannel(img string, channel int) *TextureGrayscale {
+	return ReadTextureGrayscaleWithColorSpace(img, channel, ColorSpaceLinear)
+}
+
+// Grayscale textures hold data (roughness, metallic, heights), so they are usually linear
+
+func ReadTextureGrayscaleWithColorSpace(img string, channel int, space ColorSpace) *TextureGrayscale {
+	imageData := decodeTextureImage(img)
+	bounds := imageData.Bounds()
+	if channel == ChannelOpacity {
+		channel = ChannelLuminance
+		if !imageOpaque(imageData) {
+			channel = ChannelAlpha
+		}
 	}
 	texture := &TextureGrayscale{
-		Width:  imageData.Bounds().Max.X,
-		Height: imageData.Bounds().Max.Y,
-		data:   make([]float64, imageData.Bounds().Max.X*imageData.Bounds().Max.Y),
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		data:   make([]float64, bounds.Dx()*bounds.Dy()),
 	}
-	for y := 0; y < texture.Width; y++ {
-		for x := 0; x < texture.Height; x++ {
+	for y := 0; y < texture.Height; y++ {
+		for x := 0; x < texture.Width; x++ {
 			arrIdx := y*texture.Width + x
-			r, g, b, _ := imageData.At(x, y).RGBA()
-			texture.data[arrIdx] = (float64(r) + float64(g) + float64(b)) / 765
+			c, a := readTexel(imageData, bounds.Min.X+x, bounds.Min.Y+y, space)
+			switch channel {
+			case ChannelRed:
+				texture.data[arrIdx] = c.X
+			case ChannelGreen:
+				texture.data[arrIdx] = c.Y
+			case ChannelBlue:
+				texture.data[arrIdx] = c.Z
+			case ChannelAlpha:
+				texture.data[arrIdx] = a
+			default:
+				texture.data[arrIdx] = (c.X + c.Y + c.Z) / 3
+			}
 		}
 	}
+	texture.BuildMipmaps()
 	return texture
 }
 
 func (texture *TextureGrayscale) At(uv Math.Vector2) float64 {
-	if uv.U > 1 || uv.V > 1 || uv.U < 0 || uv.V < 0 {
-		panic("invalid UV coordinates")
+	x := min(max(int(uv.U*float64(texture.Width)), 0), texture.Width-1)
+	y := min(max(int(uv.V*float64(texture.Height)), 0), texture.Height-1)
+	return texture.data[y*texture.Width+x]
+}
+
+func (texture *TextureGrayscale) level(lod int) *TextureGrayscale {
+	if lod <= 0 || len(texture.mips) == 0 {
+		return texture
 	}
-	x := int(uv.U * float64(texture.Width))
-	y := int(uv.V * float64(texture.Height))
-	return texture.data[y*texture.Height+x]
+	return texture.mips[min(lod, len(texture.mips))-1]
+}
+
+func (texture *TextureGrayscale) BuildMipmaps() {
+	texture.mips = nil
+	src := texture
+	for src.Width > 1 || src.Height > 1 {
+		dst := &TextureGrayscale{
+			data:   make([]float64, max(src.Width/2, 1)*max(src.Height/2, 1)),
+			Width:  max(src.Width/2, 1),
+			Height: max(src.Height/2, 1),
+		}
+		for y := 0; y < dst.Height; y++ {
+			for x := 0; x < dst.Width; x++ {
+				var sum float64
+				for _, t := range downsampleTexels(src.Width, src.Height, x, y) {
+					sum += src.data[t]
+				}
+				dst.data[y*dst.Width+x] = sum / 4
+			}
+		}
+		texture.mips = append(texture.mips, dst)
+		src = dst
+	}
+}
+
+// Indices of the 2x2 source texels of the downsampled texel {x;y}. Odd sizes repeat the last row or column
+
+func downsampleTexels(width, height, x, y int) [4]int {
+	x0, y0 := min(2*x, width-1), min(2*y, height-1)
+	x1, y1 := min(2*x+1, width-1), min(2*y+1, height-1)
+	return [4]int{y0*width + x0, y0*width + x1, y1*width + x0, y1*width + x1}
 }
@@ -2,18 +2,26 @@ package Structs
 
 import (
 	"Photon/Math"
+	"math"
 )
 
 type Triangle struct {
-	V1Pos          Math.Vector3
-	V2Pos          Math.Vector3
-	V3Pos          Math.Vector3
-	V1Normal       Math.Vector3
-	V2Normal       Math.Vector3
-	V3Normal       Math.Vector3
-	V1Tex          Math.Vector2
-	V2Tex          Math.Vector2
-	V3Tex          Math.Vector2
+	V1Pos    Math.Vector3
+	V2Pos    Math.Vector3
+	V3Pos    Math.Vector3
+	V1Normal Math.Vector3
+	V2Normal Math.Vector3
+	V3Normal Math.Vector3
+	V1Tex    Math.Vector2
+	V2Tex    Math.Vector2
+	V3Tex    Math.Vector2
+	V1Color  Math.Vector3
+	V2Color  Math.Vector3
+	V3Color  Math.Vector3
+	// Tangents, with the bitangent sign stored in W (same layout as MikkTSpace)
+	V1Tangent      Math.Vector4
+	V2Tangent      Math.Vector4
+	V3Tangent      Math.Vector4
 	Smooth         bool
 	Material       *Material
 	TriangleNormal Math.Vector3
@@ -45,15 +53,151 @@ func (triangle *Triangle) RecalcNormal() {
 	triangle.TriangleNormal = triangle.Edge12().Normalized().Cross(triangle.Edge23().Normalized()).Normalized()
 }
 
+// Barycentric coordinates returned by IntersectRayTriangle weight the vertices as (1-u-v, u, v)
+
 func (triangle *Triangle) InterpolateTexcoords(uv Math.Vector2) Math.Vector2 {
-	x, y, z := uv.U, uv.V, 1-uv.U-uv.V
-	return triangle.V2Tex.FMul(x).Add(triangle.V3Tex.FMul(y)).Add(triangle.V3Tex.FMul(z))
+	x, y, z := 1-uv.U-uv.V, uv.U, uv.V
+	return triangle.V1Tex.FMul(x).Add(triangle.V2Tex.FMul(y)).Add(triangle.V3Tex.FMul(z))
 }
 
 func (triangle *Triangle) InterpolateNormals(uv Math.Vector2) Math.Vector3 {
 	if !triangle.Smooth {
 		return triangle.TriangleNormal
 	}
-	x, y, z := uv.U, uv.V, 1-uv.U-uv.V
-	return triangle.V1Normal.FMul(x).Add(triangle.V2Normal.FMul(y)).Add(triangle.V3Normal.FMul(z))
+	x, y, z := 1-uv.U-uv.V, uv.U, uv.V
+	return triangle.V1Normal.FMul(x).Add(triangle.V2Normal.FMul(y)).Add(triangle.V3Normal.FMul(z)).Normalized()
+}
+
+// Tangent frame at a barycentric point, orthogonal to the interpolated normal. Triangles without tangents (no UVs)
+// get an arbitrary frame
+
+func (triangle *Triangle) InterpolateTangents(uv Math.Vector2, normal Math.Vector3) (tangent, bitangent Math.Vector3) {
+	x, y, z := 1-uv.U-uv.V, uv.U, uv.V
+	t := Math.Vector3{
+		X: triangle.V1Tangent.X*x + triangle.V2Tangent.X*y + triangle.V3Tangent.X*z,
+		Y: triangle.V1Tangent.Y*x + triangle.V2Tangent.Y*y + triangle.V3Tangent.Y*z,
+		Z: triangle.V1Tangent.Z*x + triangle.V2Tangent.Z*y + triangle.V3Tangent.Z*z,
+	}
+	sign := triangle.V1Tangent.W*x + triangle.V2Tangent.W*y + triangle.V3Tangent.W*z
+	tangent = t.Sub(normal.FMul(normal.Dot(t)))
+	if tangent.LenSq() < 1e-12 {
+		tangent = Math.Vector3{X: 1}.FromSingleVectorBasis(normal)
+		sign = 1
+	}
+	tangent = tangent.Normalized()
+	bitangent = normal.Cross(tangent)
+	if sign < 0 {
+		bitangent = bitangent.Inverse()
+	}
+	return tangent, bitangent
+}
+
+func (triangle *Triangle) InterpolateColors(uv Math.Vector2) Math.Vector3 {
+	x, y, z := 1-uv.U-uv.V, uv.U, uv.V
+	return triangle.V1Color.FMul(x).Add(triangle.V2Color.FMul(y)).Add(triangle.V3Color.FMul(z))
+}
+
+// Ratio between UV and world space lengths on the triangle. Converts world space ray footprints into UV units
+
+func (triangle *Triangle) UVScale() float64 {
+	worldArea := triangle.Edge12().Cross(triangle.Edge13()).Len()
+	if worldArea == 0 {
+		return 0
+	}
+	t1 := triangle.V2Tex.Sub(triangle.V1Tex)
+	t2 := triangle.V3Tex.Sub(triangle.V1Tex)
+	uvArea := math.Abs(t1.U*t2.V - t1.V*t2.U)
+	return math.Sqrt(uvArea / worldArea)
+}
+
+// Interpolated normal, perturbed by the normal or bump map of the material
+
+func (triangle *Triangle) ShadingNormal(bary Math.Vector2, footprint float64) Math.Vector3 {
+	normal := triangle.InterpolateNormals(bary)
+	if !triangle.Material.HasNormalPerturbation() {
+		return normal
+	}
+	tangent, bitangent := triangle.InterpolateTangents(bary, normal)
+	uvScale := triangle.UVScale()
+	return triangle.Material.PerturbNormal(triangle.InterpolateTexcoords(bary), footprint*uvScale, uvScale, normal,
+		tangent, bitangent)
+}
+
+// Material sampling at a barycentric point. Resolves the texture coordinates and vertex colors of the triangle
+// The footprint is the world space width of the area seen by the ray (or covered by the photon), used for filtering
+
+func (triangle *Triangle) SampleLight(bary Math.Vector2, footprint float64, v, l, n Math.Vector3, li float64, lc Math.Vector3) Math.Vector3 {
+	uv := triangle.InterpolateTexcoords(bary)
+	uvFootprint := footprint * triangle.UVScale()
+	if triangle.Material.vertexColorsUsed {
+		return triangle.Material.sampleTintedLight(uv, uvFootprint, triangle.InterpolateColors(bary), v, l, n, li, lc)
+	}
+	return triangle.Material.SampleLight(uv, uvFootprint, v, l, n, li, lc)
+}
+
+// Radiance reflected towards wo for unit radiance arriving from wi, that is f(wo, wi) * cos(wi). Unlike SampleLight,
+// both directions point away from the surface, and the normal must face wo. The BRDFs return the light reflected for
+// light hitting the surface head-on (albedo for a white Lambertian surface), which is pi times that. wi can only be
+// below the surface for transmitting BRDFs
+
+func (triangle *Triangle) EvalBRDF(bary Math.Vector2, footprint float64, wo, wi, n Math.Vector3) Math.Vector3 {
+	if wo.Dot(n) <= 0 || (wi.Dot(n) <= 0 && !triangle.Material.Transmits()) {
+		return Math.Vector3{}
+	}
+	return triangle.SampleLight(bary, footprint, wo.Inverse(), wi.Inverse(), n, 1, Math.Vector3{X: 1, Y: 1, Z: 1}).FDiv(math.Pi)
+}
+
+// Importance sampling of the BRDF, see IBRDF.SampleDirection. u holds two uniform random numbers
+
+func (triangle *Triangle) SampleBRDF(bary Math.Vector2, footprint float64, wo, n Math.Vector3, u Math.Vector2) (Math.Vector3,
+	Math.Vector3, float64) {
+	uv := triangle.InterpolateTexcoords(bary)
+	uvFootprint := footprint * triangle.UVScale()
+	material := triangle.Material
+	return material.BRDF.SampleDirection(wo, n, u, triangle.SampleAlbedo(bary, footprint), material.GetRoughness(uv, uvFootprint),
+		material.GetMetallic(uv, uvFootprint), material.ior)
+}
+
+func (triangle *Triangle) BRDFPdf(bary Math.Vector2, footprint float64, wo, wi, n Math.Vector3) float64 {
+	uv := triangle.InterpolateTexcoords(bary)
+	uvFootprint := footprint * triangle.UVScale()
+	material := triangle.Material
+	return material.BRDF.Pdf(wo, wi, n, triangle.SampleAlbedo(bary, footprint), material.GetRoughness(uv, uvFootprint),
+		material.GetMetallic(uv, uvFootprint), material.ior)
+}
+
+func (triangle *Triangle) SampleAlbedo(bary Math.Vector2, footprint float64) Math.Vector3 {
+	albedo := triangle.Material.SampleAlbedo(triangle.InterpolateTexcoords(bary), footprint*triangle.UVScale())
+	if triangle.Material.vertexColorsUsed {
+		return albedo.Mul(triangle.InterpolateColors(bary))
+	}
+	return albedo
+}
+
+// Medium under the surface of subsurface scattering materials
+
+func (triangle *Triangle) SubsurfaceMedium(bary Math.Vector2, footprint float64) *Medium {
+	color := triangle.Material.subsurfaceColor
+	if color.Equal(Math.ZeroVector3()) {
+		color = triangle.SampleAlbedo(bary, footprint)
+	}
+	return NewSubsurfaceMedium(color, triangle.Material.subsurfaceRadius)
+}
+
+func (triangle *Triangle) SampleRoughness(bary Math.Vector2, footprint float64) float64 {
+	return triangle.Material.GetRoughness(triangle.InterpolateTexcoords(bary), footprint*triangle.UVScale())
+}
+
+// Alpha test for cutout materials. The threshold is either the cutoff of the material, or a random number for
+// stochastic transparency
+
+func (triangle *Triangle) PassesAlphaTest(bary Math.Vector2, threshold float64, stochastic bool) bool {
+	if !triangle.Material.HasAlphaCutout(stochastic) {
+		return true
+	}
+	return triangle.Material.SampleAlpha(triangle.InterpolateTexcoords(bary), 0) >= threshold
+}
+
+func (triangle *Triangle) SampleEmission(bary Math.Vector2, footprint float64) Math.Vector3 {
+	return triangle.Material.SampleEmission(triangle.InterpolateTexcoords(bary), footprint*triangle.UVScale())
 }
@@ -0,0 +1,47 @@
+package Utils
+
+import (
+	"Photon/Math"
+	"math"
+)
+
+// Warping of uniform random numbers in [0, 1) into directions. Directions are around +Z, use
+// Math.Vector3.FromSingleVectorBasis to orient them
+
+// Cosine weighted hemisphere direction, pdf = cos(theta) / pi
+
+func CosineSampleHemisphere(u1, u2 float64) Math.Vector3 {
+	r := math.Sqrt(u1)
+	phi := 2 * math.Pi * u2
+	return Math.Vector3{
+		X: r * math.Cos(phi),
+		Y: r * math.Sin(phi),
+		Z: math.Sqrt(math.Max(1-u1, 0)),
+	}
+}
+
+// Uniform sphere direction, pdf = 1 / (4 * pi)
+
+func UniformSampleSphere(u1, u2 float64) Math.Vector3 {
+	z := 1 - 2*u1
+	r := math.Sqrt(math.Max(1-z*z, 0))
+	phi := 2 * math.Pi * u2
+	return Math.Vector3{X: r * math.Cos(phi), Y: r * math.Sin(phi), Z: z}
+}
+
+// Uniform direction in the cone around +Z with cos(theta) >= cosMax, pdf = 1 / (2 * pi * (1 - cosMax))
+
+func UniformSampleCone(u1, u2, cosMax float64) Math.Vector3 {
+	z := 1 - u1*(1-cosMax)
+	r := math.Sqrt(math.Max(1-z*z, 0))
+	phi := 2 * math.Pi * u2
+	return Math.Vector3{X: r * math.Cos(phi), Y: r * math.Sin(phi), Z: z}
+}
+
+// Uniform point on the unit disk in the XY plane
+
+func UniformSampleDisk(u1, u2 float64) Math.Vector3 {
+	r := math.Sqrt(u1)
+	phi := 2 * math.Pi * u2
+	return Math.Vector3{X: r * math.Cos(phi), Y: r * math.Sin(phi)}
+}
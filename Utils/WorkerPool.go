@@ -0,0 +1,51 @@
+package Utils
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits the number of goroutines doing work at the same time. Used for the acceleration structure builds, which
+// spawn goroutines recursively
+
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+func NewWorkerPool(threads int) *WorkerPool {
+	return &WorkerPool{slots: make(chan struct{}, max(threads, 1))}
+}
+
+// Runs the job in a new goroutine if there is a free slot, otherwise returns false and the caller does the job itself
+
+func (pool *WorkerPool) TryGo(wg *sync.WaitGroup, job func()) bool {
+	select {
+	case pool.slots <- struct{}{}:
+	default:
+		return false
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() { <-pool.slots }()
+		job()
+	}()
+	return true
+}
+
+// Runs the job in a new goroutine, waiting for a free slot first
+
+func (pool *WorkerPool) Go(wg *sync.WaitGroup, job func()) {
+	pool.slots <- struct{}{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() { <-pool.slots }()
+		job()
+	}()
+}
+
+func LogTiming(what string, start time.Time) {
+	LogSuccess(what + " done in " + strconv.FormatFloat(time.Since(start).Seconds(), 'f', 2, 64) + " seconds")
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"Photon/App/PhotonMapping"
 	"Photon/Math"
+	"Photon/Structs"
+	"Photon/Structs/BRDFS"
 	"Photon/Utils"
 	"flag"
 	"strconv"
@@ -32,7 +34,8 @@ func (r *ResolutionFlag) Set(s string) error {
 
 func main() {
 	Utils.Log("Starting...")
-	modelFile := flag.String("model", "", "model allows you to specify a path to an .obj file (all .mtl files must be in the same directory!)")
+	sceneFile := flag.String("scene", "", "scene allows you to specify a .json scene file with models, environment and texture settings")
+	modelFile := flag.String("model", "", "model allows you to specify a path to an .obj, .ply or .stl file (all .mtl files must be in the same directory as the .obj!)")
 	envImage := flag.String("env", "", "env allows you to specify an .hdr image to use as environment texture")
 	var resolution *ResolutionFlag = &ResolutionFlag{0, 0}
 	flag.Var(resolution, "res", "res allows you to specify the image (and window) resolution")
@@ -41,16 +44,63 @@ func main() {
 	rad := flag.Float64("rad", 1, "rad allows you to specify the distance of the camera from the {0;0;0}")
 	fov := flag.Float64("fov", 39.6, "fov allows you to specify the camera's FOV in degrees")
 	phRad := flag.Float64("phrad", 0.01, "phrad allows you to specify the photon radius in units")
+	stochasticAlpha := flag.Bool("stochastic-alpha", false, "stochastic-alpha makes alpha cutouts (map_d textures and the dissolve) let through rays randomly, according to their alpha, instead of using a fixed cutoff")
+	bvhBuilder := flag.String("bvh", "sah", "bvh allows you to choose the acceleration structure builder (sah or clusters)")
+	pointLookup := flag.String("lookup", "kdtree", "lookup allows you to choose the camera point lookup structure (kdtree or grid)")
+	integrator := flag.String("integrator", "progressive", "integrator allows you to choose the rendering algorithm (progressive photon mapping, jensen for two-pass photon mapping with final gathering, path for a reference path tracer, or vcm for vertex connection and merging)")
+	bvhCache := flag.String("bvh-cache", "", "bvh-cache allows you to specify a directory to store built BVHs in, so that unchanged models load faster next time. The least recently used BVHs are removed once the directory grows over 1 GiB")
+	brdf := flag.String("brdf", "cooktorrance", "brdf allows you to choose the material model (cooktorrance, principled for a Disney style BSDF with sheen, clearcoat and transmission, lambert, orennayar, simple or unlit). MTL files can override it per material with the brdf statement")
 	flag.Parse()
 
 	if resolution.Width == 0 || resolution.Height == 0 {
 		panic("invalid resolution")
 	}
 	app := PhotonMapping.NewApp(resolution.Width, resolution.Height, *fov, *phRad)
-	if *modelFile == "" {
-		panic("no model file specified")
+	if *modelFile == "" && *sceneFile == "" {
+		panic("no model or scene file specified")
+	}
+	// The BRDF is given to the materials as they are loaded
+	materialBRDF, ok := BRDFS.ByName(*brdf)
+	if !ok {
+		panic("unknown BRDF " + *brdf)
+	}
+	app.ChangeBRDF(materialBRDF)
+	if *sceneFile != "" {
+		app.LoadSceneFile(*sceneFile)
+	}
+	if *modelFile != "" {
+		app.AddMeshesFromFile(*modelFile)
+	}
+	app.SetStochasticAlpha(*stochasticAlpha)
+	switch *bvhBuilder {
+	case "sah":
+		app.SetBVHBuilder(Structs.BVHBuilderSAH)
+	case "clusters":
+		app.SetBVHBuilder(Structs.BVHBuilderClusters)
+	default:
+		panic("unknown BVH builder " + *bvhBuilder)
+	}
+	app.SetBVHCacheDir(*bvhCache)
+	switch *pointLookup {
+	case "kdtree":
+		app.SetPointLookup(Structs.PointLookupKDTree)
+	case "grid":
+		app.SetPointLookup(Structs.PointLookupHashGrid)
+	default:
+		panic("unknown point lookup structure " + *pointLookup)
+	}
+	switch *integrator {
+	case "progressive":
+		app.SetIntegrator(PhotonMapping.IntegratorProgressive)
+	case "jensen":
+		app.SetIntegrator(PhotonMapping.IntegratorJensen)
+	case "path":
+		app.SetIntegrator(PhotonMapping.IntegratorPathTracer)
+	case "vcm":
+		app.SetIntegrator(PhotonMapping.IntegratorVCM)
+	default:
+		panic("unknown integrator " + *integrator)
 	}
-	app.AddMeshesFromFile(*modelFile)
 	cam := app.Scene.GetCamera()
 	cam.Move(Math.Mat3ZRotation(Math.DegToRad(*yaw)).VecMul(
 		Math.Mat3XRotation(Math.DegToRad(*pitch)).VecMul(Math.Vector3{
@@ -61,15 +111,15 @@ func main() {
 		Y: 0,
 		Z: Math.DegToRad(*yaw),
 	})
-	if *envImage == "" {
+	if *envImage != "" {
+		app.SetEnvironmentImage(*envImage)
+	} else if *sceneFile == "" {
 		Utils.LogWarning("No environment image specified. Using plain environment")
 		app.SetEnvironmentSimple(Math.Vector3{
 			X: 0.1,
 			Y: 0.1,
 			Z: 0.1,
 		})
-	} else {
-		app.SetEnvironmentImage(*envImage)
 	}
 	Utils.Log("Starting the app")
 	app.Run()